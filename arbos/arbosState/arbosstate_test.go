@@ -5,10 +5,16 @@ package arbosState
 
 import (
 	"bytes"
+	"math/big"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/offchainlabs/nitro/arbos/arbostypes"
 	"github.com/offchainlabs/nitro/arbos/burn"
+	"github.com/offchainlabs/nitro/arbos/l1pricing"
 	"github.com/offchainlabs/nitro/arbos/storage"
 	"github.com/offchainlabs/nitro/arbos/util"
 	"github.com/offchainlabs/nitro/util/colors"
@@ -91,3 +97,68 @@ func TestStorageSlots(t *testing.T) {
 		Fail(t, "page offset mismatch")
 	}
 }
+
+func TestUpgradeArbosVersion(t *testing.T) {
+	statedb, err := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	Require(t, err)
+	chainConfig := params.ArbitrumDevTestChainConfig()
+	chainConfig.ArbitrumChainParams.InitialArbOSVersion = 1
+	aState, err := InitializeArbosState(statedb, burn.NewSystemBurner(nil, false), chainConfig, arbostypes.TestInitMessage)
+	Require(t, err)
+	if aState.ArbOSVersion() != 1 {
+		Fail(t, "state initialized at version", aState.ArbOSVersion())
+	}
+
+	checkUpgraded := func() {
+		t.Helper()
+		if ArbOSVersion(statedb) != 11 {
+			Fail(t, "stored ArbOS version", ArbOSVersion(statedb), "after upgrading to 11")
+		}
+		perBatchGasCost, err := aState.L1PricingState().PerBatchGasCost()
+		Require(t, err)
+		if perBatchGasCost != l1pricing.InitialPerBatchGasCostV12 {
+			Fail(t, "per batch gas cost", perBatchGasCost, "after upgrading to 11")
+		}
+		// set to max by the version 3 upgrade, then corrected to 0 by version 11
+		amortizedCostCap, err := aState.L1PricingState().AmortizedCostCapBips()
+		Require(t, err)
+		if amortizedCostCap != 0 {
+			Fail(t, "amortized cost cap", amortizedCostCap, "after upgrading to 11")
+		}
+	}
+	Require(t, aState.UpgradeArbosVersion(11, false, statedb, chainConfig))
+	checkUpgraded()
+
+	// upgrading to a version the state is already at must change nothing
+	Require(t, aState.UpgradeArbosVersion(11, false, statedb, chainConfig))
+	checkUpgraded()
+	reopened, err := OpenArbosState(statedb, burn.NewSystemBurner(nil, false))
+	Require(t, err)
+	if reopened.ArbOSVersion() != 11 {
+		Fail(t, "reopened state has version", reopened.ArbOSVersion())
+	}
+}
+
+func TestL2BaseFeePersists(t *testing.T) {
+	db := state.NewDatabase(rawdb.NewMemoryDatabase())
+	statedb, err := state.New(common.Hash{}, db, nil)
+	Require(t, err)
+	aState, err := InitializeArbosState(statedb, burn.NewSystemBurner(nil, false), params.ArbitrumDevTestChainConfig(), arbostypes.TestInitMessage)
+	Require(t, err)
+
+	baseFee := big.NewInt(123456789)
+	Require(t, aState.L2PricingState().SetBaseFeeWei(baseFee))
+	root, err := statedb.Commit(0, true)
+	Require(t, err)
+
+	// reopen the ArbOS state from the committed root, as a restarted node would
+	reopenedDB, err := state.New(root, db, nil)
+	Require(t, err)
+	reopened, err := OpenArbosState(reopenedDB, burn.NewSystemBurner(nil, false))
+	Require(t, err)
+	fee, err := reopened.L2PricingState().BaseFeeWei()
+	Require(t, err)
+	if fee.Cmp(baseFee) != 0 {
+		Fail(t, "L2 base fee was", fee, "after reopening instead of", baseFee)
+	}
+}
@@ -10,8 +10,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
@@ -21,6 +23,7 @@ import (
 	"github.com/gobwas/httphead"
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsflate"
+	"github.com/gobwas/ws/wsutil"
 	flag "github.com/spf13/pflag"
 
 	"github.com/ethereum/go-ethereum/log"
@@ -45,6 +48,9 @@ type FeedConfig struct {
 }
 
 func (fc *FeedConfig) Validate() error {
+	if err := fc.Input.Validate(); err != nil {
+		return err
+	}
 	return fc.Output.Validate()
 }
 
@@ -65,6 +71,7 @@ var FeedConfigDefault = FeedConfig{
 type Config struct {
 	ReconnectInitialBackoff time.Duration            `koanf:"reconnect-initial-backoff" reload:"hot"`
 	ReconnectMaximumBackoff time.Duration            `koanf:"reconnect-maximum-backoff" reload:"hot"`
+	ReconnectJitter         float64                  `koanf:"reconnect-jitter" reload:"hot"`
 	RequireChainId          bool                     `koanf:"require-chain-id" reload:"hot"`
 	RequireFeedVersion      bool                     `koanf:"require-feed-version" reload:"hot"`
 	Timeout                 time.Duration            `koanf:"timeout" reload:"hot"`
@@ -72,6 +79,14 @@ type Config struct {
 	SecondaryURL            []string                 `koanf:"secondary-url"`
 	Verify                  signature.VerifierConfig `koanf:"verify"`
 	EnableCompression       bool                     `koanf:"enable-compression" reload:"hot"`
+	AllowedMigrationHosts   []string                 `koanf:"allowed-migration-hosts" reload:"hot"`
+}
+
+func (c *Config) Validate() error {
+	if c.ReconnectJitter < 0 || c.ReconnectJitter > 1 {
+		return fmt.Errorf("reconnect-jitter must be between 0 and 1, got %v", c.ReconnectJitter)
+	}
+	return nil
 }
 
 func (c *Config) Enable() bool {
@@ -83,6 +98,7 @@ type ConfigFetcher func() *Config
 func ConfigAddOptions(prefix string, f *flag.FlagSet) {
 	f.Duration(prefix+".reconnect-initial-backoff", DefaultConfig.ReconnectInitialBackoff, "initial duration to wait before reconnect")
 	f.Duration(prefix+".reconnect-maximum-backoff", DefaultConfig.ReconnectMaximumBackoff, "maximum duration to wait before reconnect")
+	f.Float64(prefix+".reconnect-jitter", DefaultConfig.ReconnectJitter, "randomly vary each reconnect wait by up to this fraction (0 to 1) so clients disconnected together don't all reconnect at once")
 	f.Bool(prefix+".require-chain-id", DefaultConfig.RequireChainId, "require chain id to be present on connect")
 	f.Bool(prefix+".require-feed-version", DefaultConfig.RequireFeedVersion, "require feed version to be present on connect")
 	f.Duration(prefix+".timeout", DefaultConfig.Timeout, "duration to wait before timing out connection to sequencer feed")
@@ -90,11 +106,13 @@ func ConfigAddOptions(prefix string, f *flag.FlagSet) {
 	f.StringSlice(prefix+".secondary-url", DefaultConfig.SecondaryURL, "list of secondary URLs of sequencer feed source. Would be started in the order they appear in the list when primary feeds fails")
 	signature.FeedVerifierConfigAddOptions(prefix+".verify", f)
 	f.Bool(prefix+".enable-compression", DefaultConfig.EnableCompression, "enable per message deflate compression support")
+	f.StringSlice(prefix+".allowed-migration-hosts", DefaultConfig.AllowedMigrationHosts, "hosts other than the feed's own a feed server may migrate the client to")
 }
 
 var DefaultConfig = Config{
 	ReconnectInitialBackoff: time.Second * 1,
 	ReconnectMaximumBackoff: time.Second * 64,
+	ReconnectJitter:         0.1,
 	RequireChainId:          false,
 	RequireFeedVersion:      false,
 	Verify:                  signature.DefultFeedVerifierConfig,
@@ -102,11 +120,13 @@ var DefaultConfig = Config{
 	SecondaryURL:            []string{},
 	Timeout:                 20 * time.Second,
 	EnableCompression:       true,
+	AllowedMigrationHosts:   []string{},
 }
 
 var DefaultTestConfig = Config{
 	ReconnectInitialBackoff: 0,
 	ReconnectMaximumBackoff: 0,
+	ReconnectJitter:         0,
 	RequireChainId:          false,
 	RequireFeedVersion:      false,
 	Verify:                  signature.DefultFeedVerifierConfig,
@@ -114,6 +134,7 @@ var DefaultTestConfig = Config{
 	SecondaryURL:            []string{},
 	Timeout:                 200 * time.Millisecond,
 	EnableCompression:       true,
+	AllowedMigrationHosts:   []string{},
 }
 
 type TransactionStreamerInterface interface {
@@ -125,6 +146,10 @@ type BroadcastClient struct {
 
 	config       ConfigFetcher
 	websocketUrl string
+	// migrationUrl is where a feed server migrated the client to. It is used
+	// instead of websocketUrl for the next connection attempt only, so a
+	// client whose migration fails returns to the configured feed.
+	migrationUrl string
 	nextSeqNum   arbutil.MessageIndex
 	sigVerifier  *signature.Verifier
 
@@ -199,10 +224,9 @@ func (bc *BroadcastClient) Start(ctxIn context.Context) {
 				break
 			}
 			log.Warn("failed connect to sequencer broadcast, waiting and retrying", "url", bc.websocketUrl, "err", err)
-			timer := time.NewTimer(backoffDuration)
-			if backoffDuration < bc.config().ReconnectMaximumBackoff {
-				backoffDuration *= 2
-			}
+			config := bc.config()
+			timer := time.NewTimer(jitterBackoff(backoffDuration, config.ReconnectJitter))
+			backoffDuration = nextBackoff(backoffDuration, config.ReconnectMaximumBackoff)
 			select {
 			case <-ctx.Done():
 				timer.Stop()
@@ -218,13 +242,18 @@ func (bc *BroadcastClient) connect(ctx context.Context, nextSeqNum arbutil.Messa
 		// Nothing to do
 		return nil, nil
 	}
+	websocketUrl := bc.websocketUrl
+	if bc.migrationUrl != "" {
+		websocketUrl = bc.migrationUrl
+		bc.migrationUrl = ""
+	}
 
 	header := ws.HandshakeHeaderHTTP(http.Header{
 		wsbroadcastserver.HTTPHeaderFeedClientVersion:       []string{strconv.Itoa(wsbroadcastserver.FeedClientVersion)},
 		wsbroadcastserver.HTTPHeaderRequestedSequenceNumber: []string{strconv.FormatUint(uint64(nextSeqNum), 10)},
 	})
 
-	log.Info("connecting to arbitrum inbox message broadcaster", "url", bc.websocketUrl)
+	log.Info("connecting to arbitrum inbox message broadcaster", "url", websocketUrl)
 	var foundChainId bool
 	var foundFeedServerVersion bool
 	var chainId uint64
@@ -287,7 +316,7 @@ func (bc *BroadcastClient) connect(ctx context.Context, nextSeqNum arbutil.Messa
 		return nil, nil
 	}
 
-	conn, br, _, err := timeoutDialer.Dial(ctx, bc.websocketUrl)
+	conn, br, _, err := timeoutDialer.Dial(ctx, websocketUrl)
 	if errors.Is(err, ErrIncorrectFeedServerVersion) || errors.Is(err, ErrIncorrectChainId) {
 		return nil, err
 	}
@@ -329,6 +358,28 @@ func (bc *BroadcastClient) connect(ctx context.Context, nextSeqNum arbutil.Messa
 	return earlyFrameData, nil
 }
 
+// nextBackoff doubles the reconnect backoff, without going over the maximum
+func nextBackoff(backoff time.Duration, maximum time.Duration) time.Duration {
+	if backoff >= maximum {
+		return backoff
+	}
+	backoff *= 2
+	if backoff > maximum {
+		return maximum
+	}
+	return backoff
+}
+
+// jitterBackoff randomly varies backoff by up to the given fraction either way,
+// so that clients disconnected by the same server restart spread out their
+// reconnect attempts instead of all arriving together.
+func jitterBackoff(backoff time.Duration, fraction float64) time.Duration {
+	if backoff <= 0 || fraction <= 0 {
+		return backoff
+	}
+	return time.Duration(float64(backoff) * (1 + (2*rand.Float64()-1)*fraction))
+}
+
 func (bc *BroadcastClient) startBackgroundReader(earlyFrameData io.Reader) {
 	bc.LaunchThread(func(ctx context.Context) {
 		connected := false
@@ -347,11 +398,27 @@ func (bc *BroadcastClient) startBackgroundReader(earlyFrameData io.Reader) {
 			var err error
 			config := bc.config()
 			msg, op, err = wsbroadcastserver.ReadData(ctx, bc.conn, earlyFrameData, config.Timeout, ws.StateClientSide, config.EnableCompression, flateReader)
+			if err == nil && msg != nil {
+				// a corrupted message is fetched again after reconnecting
+				err = m.VerifyChecksum(msg)
+			}
 			if err != nil {
 				if bc.isShuttingDown() {
 					return
 				}
-				if strings.Contains(err.Error(), "i/o timeout") {
+				var closed wsutil.ClosedError
+				migrating := errors.As(err, &closed) && closed.Code == wsbroadcastserver.CloseStatusMigrate
+				if migrating {
+					if err := bc.validateMigrationTarget(closed.Reason); err != nil {
+						log.Warn("ignoring feed server migration to invalid target", "url", bc.websocketUrl, "err", err)
+						migrating = false
+					} else {
+						log.Info("feed server migrated client", "url", bc.websocketUrl, "target", closed.Reason, "nextSeqNum", bc.nextSeqNum)
+						bc.migrationUrl = closed.Reason
+					}
+				} else if errors.Is(err, m.ErrChecksumMismatch) {
+					log.Error("feed message failed its checksum, reconnecting", "url", bc.websocketUrl, "nextSeqNum", bc.nextSeqNum, "err", err)
+				} else if strings.Contains(err.Error(), "i/o timeout") {
 					log.Error("Server connection timed out without receiving data", "url", bc.websocketUrl, "err", err)
 				} else if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
 					log.Warn("readData returned EOF", "url", bc.websocketUrl, "opcode", int(op), "err", err)
@@ -365,15 +432,17 @@ func (bc *BroadcastClient) startBackgroundReader(earlyFrameData io.Reader) {
 					sourcesDisconnectedGauge.Inc(1)
 				}
 				_ = bc.conn.Close()
-				timer := time.NewTimer(backoffDuration)
-				if backoffDuration < bc.config().ReconnectMaximumBackoff {
-					backoffDuration *= 2
-				}
-				select {
-				case <-ctx.Done():
-					timer.Stop()
-					return
-				case <-timer.C:
+				// a migrated client is expected by its new server, so it
+				// doesn't back off before reconnecting
+				if !migrating {
+					timer := time.NewTimer(jitterBackoff(backoffDuration, config.ReconnectJitter))
+					backoffDuration = nextBackoff(backoffDuration, config.ReconnectMaximumBackoff)
+					select {
+					case <-ctx.Done():
+						timer.Stop()
+						return
+					case <-timer.C:
+					}
 				}
 				earlyFrameData = bc.retryConnect(ctx)
 				continue
@@ -441,6 +510,29 @@ func (bc *BroadcastClient) isShuttingDown() bool {
 	return bc.shuttingDown
 }
 
+// validateMigrationTarget checks that a feed server may migrate the client to
+// target. Besides being a websocket URL, target must be on the same host as
+// the configured feed or on one of the allowed migration hosts.
+func (bc *BroadcastClient) validateMigrationTarget(target string) error {
+	if err := wsbroadcastserver.ValidateMigrationTarget(target); err != nil {
+		return err
+	}
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	host := parsed.Hostname()
+	if feed, err := url.Parse(bc.websocketUrl); err == nil && strings.EqualFold(feed.Hostname(), host) {
+		return nil
+	}
+	for _, allowed := range bc.config().AllowedMigrationHosts {
+		if strings.EqualFold(allowed, host) {
+			return nil
+		}
+	}
+	return fmt.Errorf("migration target host %q is not allowed", host)
+}
+
 func (bc *BroadcastClient) retryConnect(ctx context.Context) io.Reader {
 	maxWaitDuration := 15 * time.Second
 	waitDuration := 500 * time.Millisecond
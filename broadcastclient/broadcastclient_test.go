@@ -837,6 +837,228 @@ func connectAndGetCachedMessages(ctx context.Context, addr net.Addr, chainId uin
 	}()
 }
 
+func TestReconnectBackoff(t *testing.T) {
+	backoff := 100 * time.Millisecond
+	maximum := 60 * time.Second
+	var schedule []time.Duration
+	for i := 0; i < 12; i++ {
+		schedule = append(schedule, backoff)
+		backoff = nextBackoff(backoff, maximum)
+	}
+	expected := []time.Duration{
+		100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond,
+		1600 * time.Millisecond, 3200 * time.Millisecond, 6400 * time.Millisecond, 12800 * time.Millisecond,
+		25600 * time.Millisecond, 51200 * time.Millisecond, maximum, maximum,
+	}
+	for i := range expected {
+		if schedule[i] != expected[i] {
+			t.Fatalf("backoff %d was %v instead of %v", i, schedule[i], expected[i])
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		jittered := jitterBackoff(time.Second, 0.1)
+		if jittered < 900*time.Millisecond || jittered > 1100*time.Millisecond {
+			t.Fatalf("jittered backoff %v outside of 10%% of 1s", jittered)
+		}
+	}
+	if jitterBackoff(time.Second, 0) != time.Second {
+		t.Fatal("backoff changed with jitter disabled")
+	}
+}
+
+func TestReconnectAttemptsBackOff(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a server that drops every connection, so the client keeps retrying
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Require(t, err)
+	defer listener.Close()
+	attempts := make(chan time.Time, 100)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			attempts <- time.Now()
+			_ = conn.Close()
+		}
+	}()
+
+	config := DefaultTestConfig
+	config.ReconnectInitialBackoff = 50 * time.Millisecond
+	config.ReconnectMaximumBackoff = 400 * time.Millisecond
+	feedErrChan := make(chan error, 10)
+	broadcastClient, err := newTestBroadcastClient(config, listener.Addr(), 8742, 0, NewDummyTransactionStreamer(8742, nil), nil, feedErrChan, nil)
+	Require(t, err)
+	broadcastClient.Start(ctx)
+	defer broadcastClient.StopAndWait()
+
+	expectedGaps := []time.Duration{
+		50 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond,
+		400 * time.Millisecond, 400 * time.Millisecond,
+	}
+	var last time.Time
+	for i := 0; i <= len(expectedGaps); i++ {
+		var attempt time.Time
+		select {
+		case attempt = <-attempts:
+		case err := <-feedErrChan:
+			t.Fatal("feed error", err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for reconnect attempt", i)
+		}
+		if i > 0 {
+			gap := attempt.Sub(last)
+			if gap < expectedGaps[i-1] {
+				t.Fatalf("reconnect attempt %d came after %v, expected at least %v", i, gap, expectedGaps[i-1])
+			}
+		}
+		last = attempt
+	}
+}
+
+func TestBroadcastClientMigratesToNewServer(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	settings := wsbroadcastserver.DefaultTestBroadcasterConfig
+
+	privateKey, err := crypto.GenerateKey()
+	Require(t, err)
+	sequencerAddr := crypto.PubkeyToAddress(privateKey.PublicKey)
+	dataSigner := signature.DataSignerFromPrivateKey(privateKey)
+
+	feedErrChan := make(chan error, 10)
+	chainId := uint64(8746)
+	startBroadcaster := func() *broadcaster.Broadcaster {
+		b := broadcaster.NewBroadcaster(func() *wsbroadcastserver.BroadcasterConfig { return &settings }, chainId, feedErrChan, dataSigner)
+		Require(t, b.Initialize())
+		Require(t, b.Start(ctx))
+		t.Cleanup(b.StopAndWait)
+		return b
+	}
+	// the standby server carries the same feed as the active one
+	active := startBroadcaster()
+	standby := startBroadcaster()
+	broadcast := func(start, count int) {
+		for i := start; i < start+count; i++ {
+			Require(t, active.BroadcastSingle(arbostypes.TestMessageWithMetadataAndRequestId, arbutil.MessageIndex(i)))
+			Require(t, standby.BroadcastSingle(arbostypes.TestMessageWithMetadataAndRequestId, arbutil.MessageIndex(i)))
+		}
+	}
+
+	config := DefaultTestConfig
+	config.Timeout = 10 * time.Second
+	ts := NewDummyTransactionStreamer(chainId, &sequencerAddr)
+	broadcastClient, err := newTestBroadcastClient(config, active.ListenerAddr(), chainId, 0, ts, nil, feedErrChan, &sequencerAddr)
+	Require(t, err)
+	broadcastClient.Start(ctx)
+	defer broadcastClient.StopAndWait()
+
+	expectMessages := func(start, count int) {
+		t.Helper()
+		for i := start; i < start+count; i++ {
+			select {
+			case msg := <-ts.messageReceiver:
+				if msg.SequenceNumber != arbutil.MessageIndex(i) {
+					t.Fatalf("received message %d instead of %d", msg.SequenceNumber, i)
+				}
+			case err := <-feedErrChan:
+				t.Fatalf("Broadcaster error: %s", err.Error())
+			case <-time.After(10 * time.Second):
+				t.Fatalf("timed out waiting for message %d", i)
+			}
+		}
+	}
+	broadcast(0, 10)
+	expectMessages(0, 10)
+
+	target := fmt.Sprintf("ws://127.0.0.1:%d/", standby.ListenerAddr().(*net.TCPAddr).Port)
+	if _, err := active.MigrateClients("http://127.0.0.1/"); err == nil {
+		t.Fatal("migration to a non-websocket URL was accepted")
+	}
+	migrated, err := active.MigrateClients(target)
+	Require(t, err)
+	if migrated != 1 {
+		t.Fatalf("migrated %d clients instead of 1", migrated)
+	}
+
+	// the client must pick up on the standby server where it left off
+	broadcast(10, 10)
+	expectMessages(10, 10)
+	deadline := time.Now().Add(10 * time.Second)
+	for active.ClientCount() != 0 || standby.ClientCount() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("active server has %d clients and standby has %d after migration", active.ClientCount(), standby.ClientCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBroadcastClientMigrationTargets(t *testing.T) {
+	config := DefaultTestConfig
+	config.AllowedMigrationHosts = []string{"standby.example.com"}
+	bc := &BroadcastClient{
+		config:       func() *Config { return &config },
+		websocketUrl: "wss://feed.example.com/",
+	}
+	for _, target := range []string{
+		"wss://feed.example.com:9643/",
+		"ws://FEED.example.com/",
+		"wss://standby.example.com/",
+	} {
+		if err := bc.validateMigrationTarget(target); err != nil {
+			t.Error("migration to", target, "rejected:", err)
+		}
+	}
+	for _, target := range []string{
+		"wss://attacker.example.com/",
+		"https://feed.example.com/",
+		"wss://feed.example.com.attacker.example.com/",
+	} {
+		if err := bc.validateMigrationTarget(target); err == nil {
+			t.Error("migration to", target, "accepted")
+		}
+	}
+}
+
+func TestBroadcastClientFallsBackAfterFailedMigration(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	settings := wsbroadcastserver.DefaultTestBroadcasterConfig
+
+	feedErrChan := make(chan error, 10)
+	chainId := uint64(8746)
+	b := broadcaster.NewBroadcaster(func() *wsbroadcastserver.BroadcasterConfig { return &settings }, chainId, feedErrChan, nil)
+	Require(t, b.Initialize())
+	Require(t, b.Start(ctx))
+	defer b.StopAndWait()
+
+	// nothing listens on the migration target once the listener is closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Require(t, err)
+	deadTarget := fmt.Sprintf("ws://127.0.0.1:%d/", listener.Addr().(*net.TCPAddr).Port)
+	Require(t, listener.Close())
+
+	broadcastClient, err := newTestBroadcastClient(DefaultTestConfig, b.ListenerAddr(), chainId, 0, nil, nil, feedErrChan, nil)
+	Require(t, err)
+	broadcastClient.migrationUrl = deadTarget
+	if _, err := broadcastClient.connect(ctx, 0); err == nil {
+		t.Fatal("connected to migration target with nothing listening")
+	}
+	if broadcastClient.websocketUrl == deadTarget {
+		t.Fatal("migration target replaced the configured feed URL")
+	}
+	_, err = broadcastClient.connect(ctx, 0)
+	Require(t, err, "client didn't fall back to the configured feed")
+	_ = broadcastClient.conn.Close()
+}
+
 func Require(t *testing.T, err error, printables ...interface{}) {
 	t.Helper()
 	testhelpers.RequireImpl(t, err, printables...)
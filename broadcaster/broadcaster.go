@@ -126,6 +126,23 @@ func (b *Broadcaster) ClientCount() int32 {
 	return b.server.ClientCount()
 }
 
+// RemoveByIP disconnects every feed client connected from ip
+func (b *Broadcaster) RemoveByIP(ip net.IP) int {
+	return b.server.RemoveByIP(ip)
+}
+
+// EvictSlowConsumers disconnects every feed client whose send queue is more
+// than queueDepthFraction full
+func (b *Broadcaster) EvictSlowConsumers(queueDepthFraction float64) int {
+	return b.server.EvictSlowConsumers(queueDepthFraction)
+}
+
+// MigrateClients tells every feed client to reconnect to the broadcast server
+// at targetServerAddr, and disconnects them
+func (b *Broadcaster) MigrateClients(targetServerAddr string) (int, error) {
+	return b.server.MigrateClients(targetServerAddr)
+}
+
 func (b *Broadcaster) ListenerAddr() net.Addr {
 	return b.server.ListenerAddr()
 }
@@ -1,6 +1,11 @@
 package message
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/offchainlabs/nitro/arbos/arbostypes"
 	"github.com/offchainlabs/nitro/arbutil"
@@ -10,6 +15,15 @@ const (
 	V1 = 1
 )
 
+// Priorities of broadcast messages. Messages above PriorityNormal that carry
+// no feed messages are sent to clients ahead of any feed messages already
+// queued for them.
+const (
+	PriorityNormal uint8 = iota
+	PriorityHigh
+	PriorityCritical
+)
+
 // BroadcastMessage is the base message type for messages to send over the network.
 //
 // Acts as a variant holding the message types. The type of the message is
@@ -29,6 +43,48 @@ type BroadcastMessage struct {
 	// TODO better name than messages since there are different types of messages
 	Messages                       []*BroadcastFeedMessage         `json:"messages,omitempty"`
 	ConfirmedSequenceNumberMessage *ConfirmedSequenceNumberMessage `json:"confirmedSequenceNumberMessage,omitempty"`
+	// ServerTimestamp is when the broadcast server sent the message, in Unix
+	// nanoseconds, if the server is configured to include it
+	ServerTimestamp int64 `json:"serverTimestamp,omitempty"`
+	// Checksum is the CRC32C of the JSON encoding of Messages, if the server is
+	// configured to include it, so clients can detect corruption in transit
+	Checksum *uint32 `json:"checksum,omitempty"`
+	// Priority is only used by the broadcast server and isn't sent
+	Priority uint8 `json:"-"`
+}
+
+var ErrChecksumMismatch = errors.New("broadcast message checksum mismatch")
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// MessagesChecksum returns the checksum of messages to send in
+// BroadcastMessage.Checksum
+func MessagesChecksum(messages []*BroadcastFeedMessage) (uint32, error) {
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return 0, err
+	}
+	return crc32.Checksum(data, castagnoliTable), nil
+}
+
+// VerifyChecksum checks the checksum of a serialized BroadcastMessage against
+// its feed messages exactly as received, returning ErrChecksumMismatch if they
+// differ. Messages without a checksum, or that can't be parsed, aren't checked.
+func VerifyChecksum(data []byte) error {
+	if !bytes.Contains(data, []byte(`"checksum"`)) {
+		return nil
+	}
+	var received struct {
+		Messages json.RawMessage `json:"messages"`
+		Checksum *uint32         `json:"checksum"`
+	}
+	if err := json.Unmarshal(data, &received); err != nil || received.Checksum == nil {
+		return nil
+	}
+	if crc32.Checksum(received.Messages, castagnoliTable) != *received.Checksum {
+		return ErrChecksumMismatch
+	}
+	return nil
 }
 
 type BroadcastFeedMessage struct {
@@ -133,7 +133,7 @@ func PreCheckTx(bc *core.BlockChain, chainConfig *params.ChainConfig, header *ty
 		}
 	}
 	if arbmath.BigLessThan(tx.GasFeeCap(), baseFee) {
-		return fmt.Errorf("%w: address %v, maxFeePerGas: %s baseFee: %s", core.ErrFeeCapTooLow, sender, tx.GasFeeCap(), header.BaseFee)
+		return fmt.Errorf("%w: address %v, maxFeePerGas: %s baseFee: %s", core.ErrFeeCapTooLow, sender, tx.GasFeeCap(), baseFee)
 	}
 	stateNonce := statedb.GetNonce(sender)
 	if tx.Nonce() < stateNonce {
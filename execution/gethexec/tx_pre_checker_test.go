@@ -0,0 +1,82 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package gethexec
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+
+	"github.com/offchainlabs/nitro/arbos/arbosState"
+	"github.com/offchainlabs/nitro/util/testhelpers"
+)
+
+func TestPreCheckTxMinBaseFee(t *testing.T) {
+	arbos, statedb := arbosState.NewArbosMemoryBackedArbOSState()
+	floor := big.NewInt(params.GWei)
+	Require(t, arbos.L2PricingState().SetMinBaseFeeWei(floor))
+
+	chainConfig := params.ArbitrumDevTestChainConfig()
+	// at this strictness the fee cap is checked against the minimum base fee,
+	// not the block's base fee
+	header := &types.Header{
+		Number:  big.NewInt(1),
+		BaseFee: new(big.Int).Mul(floor, big.NewInt(10)),
+	}
+	config := &TxPreCheckerConfig{Strictness: TxPreCheckerStrictnessAlwaysCompatible}
+
+	key, err := crypto.GenerateKey()
+	Require(t, err)
+	signer := types.MakeSigner(chainConfig, header.Number, header.Time)
+	to := common.HexToAddress("0x1234")
+
+	for _, test := range []struct {
+		name      string
+		gasFeeCap *big.Int
+		valid     bool
+	}{
+		{"below the floor", new(big.Int).Sub(floor, common.Big1), false},
+		{"at the floor", floor, true},
+		{"above the floor", new(big.Int).Add(floor, common.Big1), true},
+	} {
+		tx, err := types.SignNewTx(key, signer, &types.DynamicFeeTx{
+			ChainID:   chainConfig.ChainID,
+			To:        &to,
+			Gas:       params.TxGas,
+			GasFeeCap: test.gasFeeCap,
+			GasTipCap: common.Big0,
+		})
+		Require(t, err)
+
+		err = PreCheckTx(nil, chainConfig, header, statedb, arbos, tx, nil, config)
+		if test.valid {
+			Require(t, err, test.name)
+			continue
+		}
+		if !errors.Is(err, core.ErrFeeCapTooLow) {
+			Fail(t, test.name, "returned", err, "instead of", core.ErrFeeCapTooLow)
+		}
+		// the error reports the floor that was checked rather than the block's base fee
+		if !strings.Contains(err.Error(), "baseFee: "+floor.String()) {
+			Fail(t, test.name, "error doesn't report the minimum base fee:", err)
+		}
+	}
+}
+
+func Require(t *testing.T, err error, printables ...interface{}) {
+	t.Helper()
+	testhelpers.RequireImpl(t, err, printables...)
+}
+
+func Fail(t *testing.T, printables ...interface{}) {
+	t.Helper()
+	testhelpers.FailImpl(t, printables...)
+}
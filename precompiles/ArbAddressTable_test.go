@@ -88,6 +88,56 @@ func TestAddressTable1(t *testing.T) {
 	}
 }
 
+func TestAddressTableManyAddresses(t *testing.T) {
+	evm := newMockEVMForTesting()
+	atab := ArbAddressTable{}
+	context := testContext(common.Address{}, evm)
+
+	numAddresses := 1000
+	addrs := make([]common.Address, numAddresses)
+	for i := range addrs {
+		addrs[i] = testhelpers.RandomAddress()
+		slot, err := atab.Register(context, evm, addrs[i])
+		Require(t, err)
+		if !slot.IsInt64() || slot.Int64() != int64(i) {
+			Fail(t, "address", i, "registered at slot", slot)
+		}
+	}
+
+	// registering an address a second time must return its original slot
+	for i, addr := range addrs {
+		slot, err := atab.Register(context, evm, addr)
+		Require(t, err)
+		if !slot.IsInt64() || slot.Int64() != int64(i) {
+			Fail(t, "re-registering address", i, "returned slot", slot)
+		}
+	}
+
+	size, err := atab.Size(context, evm)
+	Require(t, err)
+	if !size.IsInt64() || size.Int64() != int64(numAddresses) {
+		Fail(t, "table size was", size, "instead of", numAddresses)
+	}
+
+	for i, addr := range addrs {
+		exists, err := atab.AddressExists(context, evm, addr)
+		Require(t, err)
+		if !exists {
+			Fail(t, "address", i, "not found in table")
+		}
+		index, err := atab.Lookup(context, evm, addr)
+		Require(t, err)
+		if !index.IsInt64() || index.Int64() != int64(i) {
+			Fail(t, "address", i, "looked up at index", index)
+		}
+		roundTrip, err := atab.LookupIndex(context, evm, index)
+		Require(t, err)
+		if roundTrip != addr {
+			Fail(t, "index", i, "returned", roundTrip, "instead of", addr)
+		}
+	}
+}
+
 func TestAddressTableCompressNotInTable(t *testing.T) {
 	evm := newMockEVMForTesting()
 	atab := ArbAddressTable{}
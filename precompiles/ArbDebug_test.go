@@ -0,0 +1,45 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package precompiles
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/offchainlabs/nitro/arbos/arbosState"
+	templates "github.com/offchainlabs/nitro/solgen/go/precompilesgen"
+)
+
+func TestArbDebugOnlyInDebugMode(t *testing.T) {
+	h := newPrecompileHarness(t)
+	debugAddress := common.HexToAddress("ff")
+	caller := common.HexToAddress("0x1234")
+	isOwner := func() bool {
+		t.Helper()
+		state, err := arbosState.OpenSystemArbosState(h.evm.StateDB, nil, true)
+		Require(t, err)
+		member, err := state.ChainOwners().IsMember(caller)
+		Require(t, err)
+		return member
+	}
+
+	h.evm.ChainConfig().ArbitrumChainParams.AllowDebugPrecompiles = false
+	_, gasUsed, err := h.call(debugAddress, templates.ArbDebugMetaData, caller, common.Big0, "becomeChainOwner")
+	if err == nil {
+		Fail(t, "debug precompile callable without debug precompiles allowed")
+	}
+	if gasUsed != harnessGasSupplied {
+		Fail(t, "disabled debug precompile used", gasUsed, "gas instead of all of it")
+	}
+	if isOwner() {
+		Fail(t, "caller became a chain owner through a disabled debug precompile")
+	}
+
+	h.evm.ChainConfig().ArbitrumChainParams.AllowDebugPrecompiles = true
+	h.mustCall(debugAddress, templates.ArbDebugMetaData, caller, common.Big0, "becomeChainOwner")
+	if !isOwner() {
+		Fail(t, "becomeChainOwner didn't make the caller a chain owner")
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package precompiles
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/params"
+
+	"github.com/offchainlabs/nitro/arbos/storage"
+	"github.com/offchainlabs/nitro/util/arbmath"
+)
+
+func requireBigEquals(t *testing.T, name string, actual, expected *big.Int) {
+	t.Helper()
+	if actual.Cmp(expected) != 0 {
+		Fail(t, name, "was", actual, "instead of", expected)
+	}
+}
+
+func TestArbGasInfoPrices(t *testing.T) {
+	evm := newMockEVMForTesting()
+	evm.Context.BaseFee = big.NewInt(2 * params.GWei)
+	callCtx := testContext(common.Address{}, evm)
+
+	l1PricePerUnit := big.NewInt(50 * params.GWei)
+	Require(t, callCtx.State.L1PricingState().SetPricePerUnit(l1PricePerUnit))
+	minBaseFee, err := callCtx.State.L2PricingState().MinBaseFeeWei()
+	Require(t, err)
+
+	gasInfo := &ArbGasInfo{}
+
+	perL2Tx, weiForL1Calldata, weiForL2Storage, perArbGasBase, perArbGasCongestion, perArbGasTotal, err := gasInfo.GetPricesInWei(callCtx, evm)
+	Require(t, err)
+	expectedWeiForL1Calldata := arbmath.BigMulByUint(l1PricePerUnit, params.TxDataNonZeroGasEIP2028)
+	expectedPerL2Tx := arbmath.BigMulByUint(expectedWeiForL1Calldata, AssumedSimpleTxSize)
+	requireBigEquals(t, "perL2Tx", perL2Tx, expectedPerL2Tx)
+	requireBigEquals(t, "weiForL1Calldata", weiForL1Calldata, expectedWeiForL1Calldata)
+	requireBigEquals(t, "weiForL2Storage", weiForL2Storage, arbmath.BigMulByUint(evm.Context.BaseFee, storage.StorageWriteCost))
+	requireBigEquals(t, "perArbGasBase", perArbGasBase, minBaseFee)
+	requireBigEquals(t, "perArbGasCongestion", perArbGasCongestion, arbmath.BigSub(evm.Context.BaseFee, minBaseFee))
+	requireBigEquals(t, "perArbGasTotal", perArbGasTotal, evm.Context.BaseFee)
+
+	gasPerL2Tx, gasForL1Calldata, gasForL2Storage, err := gasInfo.GetPricesInArbGas(callCtx, evm)
+	Require(t, err)
+	requireBigEquals(t, "gasPerL2Tx", gasPerL2Tx, arbmath.BigDiv(expectedPerL2Tx, evm.Context.BaseFee))
+	requireBigEquals(t, "gasForL1Calldata", gasForL1Calldata, arbmath.BigDiv(expectedWeiForL1Calldata, evm.Context.BaseFee))
+	requireBigEquals(t, "gasForL2Storage", gasForL2Storage, big.NewInt(int64(storage.StorageWriteCost)))
+}
+
+func TestArbGasInfoGasAccountingParams(t *testing.T) {
+	evm := newMockEVMForTesting()
+	callCtx := testContext(common.Address{}, evm)
+
+	speedLimit := uint64(12_000_000)
+	perBlockGasLimit := uint64(48_000_000)
+	Require(t, callCtx.State.L2PricingState().SetSpeedLimitPerSecond(speedLimit))
+	Require(t, callCtx.State.L2PricingState().SetMaxPerBlockGasLimit(perBlockGasLimit))
+
+	gasInfo := &ArbGasInfo{}
+	reportedSpeedLimit, poolSize, maxTxGasLimit, err := gasInfo.GetGasAccountingParams(callCtx, evm)
+	Require(t, err)
+	requireBigEquals(t, "speedLimit", reportedSpeedLimit, arbmath.UintToBig(speedLimit))
+	requireBigEquals(t, "poolSize", poolSize, arbmath.UintToBig(perBlockGasLimit))
+	requireBigEquals(t, "maxTxGasLimit", maxTxGasLimit, arbmath.UintToBig(perBlockGasLimit))
+}
+
+func TestArbGasInfoL1PricingParams(t *testing.T) {
+	evm := newMockEVMForTesting()
+	callCtx := testContext(common.Address{}, evm)
+	gasInfo := &ArbGasInfo{}
+	l1Pricing := callCtx.State.L1PricingState()
+
+	pricePerUnit := big.NewInt(30 * params.GWei)
+	rewardRate := uint64(17)
+	equilibrationUnits := big.NewInt(12_345_678)
+	Require(t, l1Pricing.SetPricePerUnit(pricePerUnit))
+	Require(t, l1Pricing.SetPerUnitReward(rewardRate))
+	Require(t, l1Pricing.SetEquilibrationUnits(equilibrationUnits))
+
+	check := func() {
+		t.Helper()
+		baseFeeEstimate, err := gasInfo.GetL1BaseFeeEstimate(callCtx, evm)
+		Require(t, err)
+		requireBigEquals(t, "L1 base fee estimate", baseFeeEstimate, pricePerUnit)
+		gasPriceEstimate, err := gasInfo.GetL1GasPriceEstimate(callCtx, evm)
+		Require(t, err)
+		requireBigEquals(t, "L1 gas price estimate", gasPriceEstimate, pricePerUnit)
+		reward, err := gasInfo.GetL1RewardRate(callCtx, evm)
+		Require(t, err)
+		if reward != rewardRate {
+			Fail(t, "L1 reward rate was", reward, "instead of", rewardRate)
+		}
+		units, err := gasInfo.GetL1PricingEquilibrationUnits(callCtx, evm)
+		Require(t, err)
+		requireBigEquals(t, "L1 pricing equilibration units", units, equilibrationUnits)
+	}
+	check()
+
+	// the getters must follow the L1 pricing state as ArbOS updates it
+	pricePerUnit = big.NewInt(45 * params.GWei)
+	Require(t, l1Pricing.SetPricePerUnit(pricePerUnit))
+	check()
+}
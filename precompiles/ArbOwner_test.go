@@ -19,6 +19,7 @@ import (
 	"github.com/offchainlabs/nitro/arbos/burn"
 	"github.com/offchainlabs/nitro/arbos/l1pricing"
 	"github.com/offchainlabs/nitro/arbos/util"
+	templates "github.com/offchainlabs/nitro/solgen/go/precompilesgen"
 	"github.com/offchainlabs/nitro/util/testhelpers"
 )
 
@@ -227,3 +228,65 @@ func TestArbInfraFeeAccount(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestArbOwnerAccessControl(t *testing.T) {
+	evm := newMockEVMForTesting()
+	owner := common.BytesToAddress(crypto.Keccak256([]byte{})[:20])
+	nonOwner := common.BytesToAddress(crypto.Keccak256([]byte{4})[:20])
+	callCtx := testContext(owner, evm)
+	Require(t, callCtx.State.ChainOwners().Add(owner))
+
+	ownerABI, err := templates.ArbOwnerMetaData.GetAbi()
+	Require(t, err)
+	ownerAddress := common.HexToAddress("70")
+	call := func(caller common.Address, method string, args ...interface{}) error {
+		calldata, err := ownerABI.Pack(method, args...)
+		Require(t, err)
+		_, _, err = Precompiles()[ownerAddress].Call(
+			calldata, ownerAddress, ownerAddress, caller, big.NewInt(0), false, 1000000, evm,
+		)
+		return err
+	}
+
+	newOwner := common.BytesToAddress(crypto.Keccak256([]byte{5})[:20])
+	recipient := common.BytesToAddress(crypto.Keccak256([]byte{6})[:20])
+	baseFee := big.NewInt(params.GWei)
+
+	// every governance method must reject callers that aren't chain owners
+	for _, err := range []error{
+		call(nonOwner, "addChainOwner", newOwner),
+		call(nonOwner, "setL2BaseFee", baseFee),
+		call(nonOwner, "setL1PricingRewardRecipient", recipient),
+	} {
+		if err == nil || err.Error() != "unauthorized caller to access-controlled method" {
+			Fail(t, "non-owner call wasn't rejected", err)
+		}
+	}
+	member, err := callCtx.State.ChainOwners().IsMember(newOwner)
+	Require(t, err)
+	if member {
+		Fail(t, "non-owner was able to add a chain owner")
+	}
+
+	Require(t, call(owner, "addChainOwner", newOwner))
+	member, err = callCtx.State.ChainOwners().IsMember(newOwner)
+	Require(t, err)
+	if !member {
+		Fail(t, "owner failed to add a chain owner")
+	}
+
+	// the newly added owner may now act on the chain's behalf
+	Require(t, call(newOwner, "setL2BaseFee", baseFee))
+	fee, err := callCtx.State.L2PricingState().BaseFeeWei()
+	Require(t, err)
+	if fee.Cmp(baseFee) != 0 {
+		Fail(t, "L2 base fee was", fee, "instead of", baseFee)
+	}
+
+	Require(t, call(newOwner, "setL1PricingRewardRecipient", recipient))
+	payTo, err := callCtx.State.L1PricingState().PayRewardsTo()
+	Require(t, err)
+	if payTo != recipient {
+		Fail(t, "L1 reward recipient was", payTo, "instead of", recipient)
+	}
+}
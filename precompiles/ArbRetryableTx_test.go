@@ -7,9 +7,11 @@ import (
 	"math/big"
 	"testing"
 
+	"github.com/offchainlabs/nitro/arbos/retryables"
 	"github.com/offchainlabs/nitro/arbos/storage"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
 	templates "github.com/offchainlabs/nitro/solgen/go/precompilesgen"
 )
 
@@ -63,3 +65,75 @@ func TestRetryableRedeem(t *testing.T) {
 		Fail(t, "didn't consume all the expected gas")
 	}
 }
+
+func TestRetryableLifecycle(t *testing.T) {
+	evm := newMockEVMForTesting()
+	retryAddress := common.HexToAddress("6e")
+	precompile := Precompiles()[retryAddress].Precompile()
+	//nolint:errcheck
+	retryableTx := precompile.implementer.Interface().(*ArbRetryableTx)
+
+	id := common.BigToHash(big.NewInt(978645611143))
+	timeout := evm.Context.Time + 10
+	from := common.HexToAddress("0x030405")
+	to := common.HexToAddress("0x06070809")
+	beneficiary := common.HexToAddress("0x0301040105090206")
+	createCtx := testContext(common.Address{}, evm)
+	_, err := createCtx.State.RetryableState().CreateRetryable(
+		id,
+		timeout,
+		from,
+		&to,
+		big.NewInt(0),
+		beneficiary,
+		[]byte{0x01, 0x02, 0x03},
+	)
+	Require(t, err)
+
+	callCtx := testContext(beneficiary, evm)
+	reportedTimeout, err := retryableTx.GetTimeout(callCtx, evm, id)
+	Require(t, err)
+	if reportedTimeout.Uint64() != timeout {
+		Fail(t, "unexpected timeout", reportedTimeout, "instead of", timeout)
+	}
+	reportedBeneficiary, err := retryableTx.GetBeneficiary(callCtx, evm, id)
+	Require(t, err)
+	if reportedBeneficiary != beneficiary {
+		Fail(t, "unexpected beneficiary", reportedBeneficiary, "instead of", beneficiary)
+	}
+
+	newTimeout, err := retryableTx.Keepalive(callCtx, evm, id)
+	Require(t, err)
+	if newTimeout.Uint64() != timeout+retryables.RetryableLifetimeSeconds {
+		Fail(t, "keepalive extended timeout to", newTimeout, "instead of", timeout+retryables.RetryableLifetimeSeconds)
+	}
+	reportedTimeout, err = retryableTx.GetTimeout(callCtx, evm, id)
+	Require(t, err)
+	if reportedTimeout.Cmp(newTimeout) != 0 {
+		Fail(t, "timeout", reportedTimeout, "does not match extended timeout", newTimeout)
+	}
+
+	// only the beneficiary may cancel
+	if err := retryableTx.Cancel(testContext(from, evm), evm, id); err == nil {
+		Fail(t, "retryable canceled by someone other than the beneficiary")
+	}
+	Require(t, retryableTx.Cancel(callCtx, evm, id))
+	if _, err := retryableTx.GetTimeout(callCtx, evm, id); err == nil {
+		Fail(t, "canceled retryable still has a timeout")
+	}
+
+	//nolint:errcheck
+	logs := evm.StateDB.(*state.StateDB).Logs()
+	expectedEvents := []string{"LifetimeExtended", "Canceled"}
+	if len(logs) != len(expectedEvents) {
+		Fail(t, "expected", len(expectedEvents), "events but found", len(logs))
+	}
+	for i, name := range expectedEvents {
+		if logs[i].Topics[0] != precompile.events[name].template.ID {
+			Fail(t, "event", i, "is not", name)
+		}
+		if logs[i].Topics[1] != id {
+			Fail(t, "event", name, "has ticket id", logs[i].Topics[1], "instead of", id)
+		}
+	}
+}
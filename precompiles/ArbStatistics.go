@@ -11,7 +11,7 @@ import (
 // In Classic, this was how a user would get info such as the total number of accounts,
 // but there's now better ways to do that with geth.
 type ArbStatistics struct {
-	Address addr // 0x6e
+	Address addr // 0x6f
 }
 
 // GetStats returns the current block number and some statistics about the rollup's pre-Nitro state
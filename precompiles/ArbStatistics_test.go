@@ -0,0 +1,29 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package precompiles
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestArbStatisticsGetStats(t *testing.T) {
+	evm := newMockEVMForTesting()
+	evm.Context.BlockNumber = big.NewInt(1234)
+	callCtx := testContext(common.Address{}, evm)
+
+	stats := &ArbStatistics{}
+	blockNum, numAccounts, storageSum, gasSum, numTxes, numContracts, err := stats.GetStats(callCtx, evm)
+	Require(t, err)
+	requireBigEquals(t, "blockNum", blockNum, big.NewInt(1234))
+
+	// the Classic counters are frozen at the Nitro upgrade rather than maintained in ArbOS state
+	requireBigEquals(t, "numAccounts", numAccounts, common.Big0)
+	requireBigEquals(t, "storageSum", storageSum, common.Big0)
+	requireBigEquals(t, "gasSum", gasSum, common.Big0)
+	requireBigEquals(t, "numTxes", numTxes, common.Big0)
+	requireBigEquals(t, "numContracts", numContracts, common.Big0)
+}
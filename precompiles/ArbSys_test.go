@@ -0,0 +1,554 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package precompiles
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/metrics"
+
+	"github.com/offchainlabs/nitro/arbos"
+	"github.com/offchainlabs/nitro/arbos/arbosState"
+	"github.com/offchainlabs/nitro/arbos/storage"
+	"github.com/offchainlabs/nitro/arbos/util"
+	templates "github.com/offchainlabs/nitro/solgen/go/precompilesgen"
+	"github.com/offchainlabs/nitro/util/arbmath"
+)
+
+func TestArbSysChainIDAndVersion(t *testing.T) {
+	t.Parallel()
+	sys := templates.ArbSysMetaData
+	caller := common.HexToAddress("0x1234")
+
+	for _, test := range []struct {
+		name     string
+		method   string
+		chainId  int64
+		version  uint64
+		value    *big.Int
+		gas      uint64
+		expected *big.Int
+		err      error
+	}{
+		{"zero chain id", "arbChainID", 0, 11, common.Big0, harnessGasSupplied, big.NewInt(0), nil},
+		{"arbitrum one", "arbChainID", 42161, 11, common.Big0, harnessGasSupplied, big.NewInt(42161), nil},
+		{"arbitrum sepolia", "arbChainID", 421614, 11, common.Big0, harnessGasSupplied, big.NewInt(421614), nil},
+		{"chain id with value", "arbChainID", 42161, 11, common.Big1, harnessGasSupplied, nil, vm.ErrExecutionReverted},
+		{"chain id out of gas", "arbChainID", 42161, 11, common.Big0, 0, nil, vm.ErrOutOfGas},
+		{"chain id uninitialized state", "arbChainID", 42161, 0, common.Big0, harnessGasSupplied, nil, arbosState.ErrUninitializedArbOS},
+		{"first version", "arbOSVersion", 42161, 1, common.Big0, harnessGasSupplied, big.NewInt(56), nil},
+		{"version 6", "arbOSVersion", 42161, 6, common.Big0, harnessGasSupplied, big.NewInt(61), nil},
+		{"version 10", "arbOSVersion", 42161, 10, common.Big0, harnessGasSupplied, big.NewInt(65), nil},
+		{"version 11", "arbOSVersion", 42161, 11, common.Big0, harnessGasSupplied, big.NewInt(66), nil},
+		{"version with value", "arbOSVersion", 42161, 11, common.Big1, harnessGasSupplied, nil, vm.ErrExecutionReverted},
+		{"version out of gas", "arbOSVersion", 42161, 11, common.Big0, 0, nil, vm.ErrOutOfGas},
+		{"version uninitialized state", "arbOSVersion", 42161, 0, common.Big0, harnessGasSupplied, nil, arbosState.ErrUninitializedArbOS},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			h := newPrecompileHarness(t)
+			h.gas = test.gas
+			h.evm.ChainConfig().ChainID = big.NewInt(test.chainId)
+			testContext(common.Address{}, h.evm).State.SetFormatVersion(test.version)
+			h.stateDB().AddBalance(caller, test.value)
+
+			// view methods must leave the state as they found it
+			root := h.stateDB().IntermediateRoot(true)
+			results, _, err := h.call(types.ArbSysAddress, sys, caller, test.value, test.method)
+			if h.stateDB().IntermediateRoot(true) != root {
+				Fail(t, test.method, "changed the state")
+			}
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					Fail(t, test.method, "returned error", err, "instead of", test.err)
+				}
+				return
+			}
+			Require(t, err)
+			requireBigEquals(t, test.method, results[0].(*big.Int), test.expected)
+		})
+	}
+
+	// the version must be read from the state on each call, not cached by the precompile
+	h := newPrecompileHarness(t)
+	state := testContext(common.Address{}, h.evm).State
+	for _, version := range []uint64{1, 6, 10, 11} {
+		state.SetFormatVersion(version)
+		results := h.mustCall(types.ArbSysAddress, sys, caller, common.Big0, "arbOSVersion")
+		requireBigEquals(t, "arbOSVersion", results[0].(*big.Int), new(big.Int).SetUint64(55+version))
+	}
+}
+
+func TestArbSysGasCharged(t *testing.T) {
+	evm := newMockEVMForTesting()
+	sysABI, err := templates.ArbSysMetaData.GetAbi()
+	Require(t, err)
+	sysAddress := common.HexToAddress("64")
+
+	testcases := []struct {
+		method string
+		args   []interface{}
+		// view methods open the ArbOS state, which reads its version from storage
+		readsState bool
+	}{
+		{"arbBlockNumber", nil, true},
+		{"arbChainID", nil, true},
+		{"arbOSVersion", nil, true},
+		{"getStorageGasAvailable", nil, true},
+		{"mapL1SenderContractAddressToL2Alias", []interface{}{common.HexToAddress("0x1234"), common.Address{}}, false},
+	}
+
+	gasSupplied := uint64(1000000)
+	for _, tc := range testcases {
+		calldata, err := sysABI.Pack(tc.method, tc.args...)
+		Require(t, err)
+		var firstGasUsed uint64
+		// repeated calls must keep paying, rather than becoming free once storage is warm
+		for i := 0; i < 10; i++ {
+			_, gasLeft, err := Precompiles()[sysAddress].Call(
+				calldata, sysAddress, sysAddress, common.Address{}, big.NewInt(0), true, gasSupplied, evm,
+			)
+			Require(t, err, tc.method)
+			gasUsed := gasSupplied - gasLeft
+			if gasUsed == 0 {
+				Fail(t, tc.method, "charged no gas")
+			}
+			if tc.readsState && gasUsed < storage.StorageReadCost {
+				Fail(t, tc.method, "charged", gasUsed, "gas, less than a storage read")
+			}
+			if i == 0 {
+				firstGasUsed = gasUsed
+			} else if gasUsed != firstGasUsed {
+				Fail(t, tc.method, "charged", gasUsed, "gas instead of", firstGasUsed, "on call", i)
+			}
+		}
+	}
+}
+
+func TestArbSysRejectsValueForNonPayableMethods(t *testing.T) {
+	evm := newMockEVMForTesting()
+	sysAddress := common.HexToAddress("64")
+	precompile := Precompiles()[sysAddress].Precompile()
+
+	// only methods that move funds to L1 may receive value
+	for name, method := range precompile.methodsByName {
+		shouldBePayable := name == "SendTxToL1" || name == "WithdrawEth"
+		if (method.purity == payable) != shouldBePayable {
+			Fail(t, "ArbSys method", name, "has unexpected purity", method.purity)
+		}
+	}
+
+	sysABI, err := templates.ArbSysMetaData.GetAbi()
+	Require(t, err)
+	calldata, err := sysABI.Pack("arbBlockNumber")
+	Require(t, err)
+	call := func(value *big.Int) error {
+		_, _, err := Precompiles()[sysAddress].Call(
+			calldata, sysAddress, sysAddress, common.Address{}, value, false, 1000000, evm,
+		)
+		return err
+	}
+	Require(t, call(big.NewInt(0)))
+	if err := call(big.NewInt(1)); !errors.Is(err, vm.ErrExecutionReverted) {
+		Fail(t, "sending 1 wei to arbBlockNumber didn't revert:", err)
+	}
+}
+
+func TestArbSysHarness(t *testing.T) {
+	h := newPrecompileHarness(t)
+	h.evm.Context.BlockNumber = big.NewInt(300)
+	sys := templates.ArbSysMetaData
+	sysAddress := types.ArbSysAddress
+	caller := common.HexToAddress("0x1234")
+
+	results := h.mustCall(sysAddress, sys, caller, common.Big0, "arbBlockNumber")
+	requireBigEquals(t, "arbBlockNumber", results[0].(*big.Int), big.NewInt(300))
+
+	results = h.mustCall(sysAddress, sys, caller, common.Big0, "arbBlockHash", big.NewInt(299))
+	if common.Hash(results[0].([32]byte)) != h.evm.Context.GetHash(299) {
+		Fail(t, "arbBlockHash returned the wrong hash", results[0])
+	}
+	for _, blockNum := range []int64{300, 43} {
+		if _, _, err := h.call(sysAddress, sys, caller, common.Big0, "arbBlockHash", big.NewInt(blockNum)); err == nil {
+			Fail(t, "arbBlockHash didn't revert for out of range block", blockNum)
+		}
+	}
+
+	results = h.mustCall(sysAddress, sys, caller, common.Big0, "arbChainID")
+	requireBigEquals(t, "arbChainID", results[0].(*big.Int), h.evm.ChainConfig().ChainID)
+
+	results = h.mustCall(sysAddress, sys, caller, common.Big0, "arbOSVersion")
+	expectedVersion := new(big.Int).SetUint64(55 + arbosState.ArbOSVersion(h.evm.StateDB))
+	requireBigEquals(t, "arbOSVersion", results[0].(*big.Int), expectedVersion)
+
+	results = h.mustCall(sysAddress, sys, caller, common.Big0, "getStorageGasAvailable")
+	requireBigEquals(t, "getStorageGasAvailable", results[0].(*big.Int), common.Big0)
+
+	results = h.mustCall(sysAddress, sys, caller, common.Big0, "isTopLevelCall")
+	if !results[0].(bool) {
+		Fail(t, "call from the harness wasn't top level")
+	}
+
+	results = h.mustCall(sysAddress, sys, caller, common.Big0, "mapL1SenderContractAddressToL2Alias", caller, common.Address{})
+	if results[0].(common.Address) != util.RemapL1Address(caller) {
+		Fail(t, "wrong L2 alias", results[0])
+	}
+
+	results = h.mustCall(sysAddress, sys, caller, common.Big0, "wasMyCallersAddressAliased")
+	if results[0].(bool) {
+		Fail(t, "caller reported as aliased outside of an aliasing tx")
+	}
+
+	results = h.mustCall(sysAddress, sys, caller, common.Big0, "myCallersAddressWithoutAliasing")
+	if results[0].(common.Address) != (common.Address{}) {
+		Fail(t, "unexpected caller's caller", results[0])
+	}
+
+	// withdrawing burns the value and records the send in the outbox
+	value := big.NewInt(1000)
+	destination := common.HexToAddress("0x5678")
+	h.stateDB().AddBalance(caller, value)
+	results = h.mustCall(sysAddress, sys, caller, value, "withdrawEth", destination)
+	requireBigEquals(t, "leaf number", results[0].(*big.Int), common.Big0)
+	requireBigEquals(t, "caller balance", h.stateDB().GetBalance(caller), common.Big0)
+	requireBigEquals(t, "precompile balance", h.stateDB().GetBalance(sysAddress), common.Big0)
+
+	sysABI, err := sys.GetAbi()
+	Require(t, err)
+	if findLog(h.logs(), sysAddress, sysABI.Events["L2ToL1Tx"]) == nil {
+		Fail(t, "withdrawEth didn't emit L2ToL1Tx")
+	}
+
+	results = h.mustCall(sysAddress, sys, common.Address{}, common.Big0, "sendMerkleTreeState")
+	requireBigEquals(t, "send merkle tree size", results[0].(*big.Int), common.Big1)
+	if _, _, err := h.call(sysAddress, sys, caller, common.Big0, "sendMerkleTreeState"); err == nil {
+		Fail(t, "sendMerkleTreeState didn't revert for a nonzero caller")
+	}
+}
+
+func TestArbSysL2ToL1TxEvent(t *testing.T) {
+	h := newPrecompileHarness(t)
+	h.evm.Context.BlockNumber = big.NewInt(300)
+	h.evm.Context.Time = 1234567
+	sysAddress := types.ArbSysAddress
+	caller := common.HexToAddress("0x1234")
+	destination := common.HexToAddress("0x5678")
+	value := big.NewInt(777)
+	calldataForL1 := []byte("calldata for L1")
+
+	h.stateDB().AddBalance(caller, value)
+	results := h.mustCall(sysAddress, templates.ArbSysMetaData, caller, value, "sendTxToL1", destination, calldataForL1)
+	leafNum := results[0].(*big.Int)
+
+	sysABI, err := templates.ArbSysMetaData.GetAbi()
+	Require(t, err)
+	log := findLog(h.logs(), sysAddress, sysABI.Events["L2ToL1Tx"])
+	if log == nil {
+		Fail(t, "sendTxToL1 didn't emit L2ToL1Tx")
+	}
+	// destination, hash, and position are indexed
+	if len(log.Topics) != 4 {
+		Fail(t, "L2ToL1Tx has", len(log.Topics), "topics instead of 4")
+	}
+
+	// decode the log the same way L1 tooling does, through the generated bindings
+	filterer, err := templates.NewArbSysFilterer(sysAddress, nil)
+	Require(t, err)
+	event, err := filterer.ParseL2ToL1Tx(*log)
+	Require(t, err)
+
+	l1BlockNum, err := testContext(caller, h.evm).State.Blockhashes().L1BlockNumber()
+	Require(t, err)
+	expectedHash := crypto.Keccak256Hash(
+		caller.Bytes(),
+		destination.Bytes(),
+		arbmath.U256Bytes(h.evm.Context.BlockNumber),
+		arbmath.U256Bytes(arbmath.UintToBig(l1BlockNum)),
+		arbmath.U256Bytes(arbmath.UintToBig(h.evm.Context.Time)),
+		common.BigToHash(value).Bytes(),
+		calldataForL1,
+	)
+
+	if event.Caller != caller {
+		Fail(t, "caller was", event.Caller, "instead of", caller)
+	}
+	if event.Destination != destination {
+		Fail(t, "destination was", event.Destination, "instead of", destination)
+	}
+	requireBigEquals(t, "hash", event.Hash, expectedHash.Big())
+	requireBigEquals(t, "position", event.Position, leafNum)
+	requireBigEquals(t, "arbBlockNum", event.ArbBlockNum, h.evm.Context.BlockNumber)
+	requireBigEquals(t, "ethBlockNum", event.EthBlockNum, arbmath.UintToBig(l1BlockNum))
+	requireBigEquals(t, "timestamp", event.Timestamp, arbmath.UintToBig(h.evm.Context.Time))
+	requireBigEquals(t, "callvalue", event.Callvalue, value)
+	if !bytes.Equal(event.Data, calldataForL1) {
+		Fail(t, "data was", event.Data, "instead of", calldataForL1)
+	}
+}
+
+func TestArbSysRawCalldata(t *testing.T) {
+	h := newPrecompileHarness(t)
+	caller := common.HexToAddress("0x1234")
+	sender := common.HexToAddress("0xabcd")
+
+	// build the calldata by hand rather than with the generated ABI bindings
+	selector := crypto.Keccak256([]byte("mapL1SenderContractAddressToL2Alias(address,address)"))[:4]
+	calldata := append([]byte{}, selector...)
+	calldata = append(calldata, common.LeftPadBytes(sender.Bytes(), 32)...)
+	calldata = append(calldata, common.LeftPadBytes(common.Address{}.Bytes(), 32)...)
+
+	output, _, err := h.callRaw(types.ArbSysAddress, caller, common.Big0, calldata)
+	Require(t, err)
+	expected := common.LeftPadBytes(util.RemapL1Address(sender).Bytes(), 32)
+	if !bytes.Equal(output, expected) {
+		Fail(t, "mapL1SenderContractAddressToL2Alias returned", common.Bytes2Hex(output), "instead of", common.Bytes2Hex(expected))
+	}
+
+	if _, _, err := h.callRaw(types.ArbSysAddress, caller, common.Big0, calldata[:len(calldata)-1]); err == nil {
+		Fail(t, "truncated calldata didn't revert")
+	}
+	if _, _, err := h.callRaw(types.ArbSysAddress, caller, common.Big0, []byte{0xde, 0xad, 0xbe, 0xef}); err == nil {
+		Fail(t, "unknown selector didn't revert")
+	}
+	if _, _, err := h.callRaw(types.ArbSysAddress, caller, common.Big0, selector[:3]); err == nil {
+		Fail(t, "calldata shorter than a selector didn't revert")
+	}
+}
+
+// referenceL2Alias reproduces the bridge contracts' AddressAliasHelper, which
+// adds the offset to uint160(l1Address) in an unchecked block, so the sum wraps
+// around at 2^160. The address is ABI encoded to get the same left padded
+// word the contract operates on.
+func referenceL2Alias(t *testing.T, l1Address common.Address) common.Address {
+	t.Helper()
+	addressType, err := abi.NewType("address", "", nil)
+	Require(t, err)
+	word, err := abi.Arguments{{Type: addressType}}.Pack(l1Address)
+	Require(t, err)
+	offset, _ := new(big.Int).SetString("1111000000000000000000000000000000001111", 16)
+	sum := new(big.Int).Add(new(big.Int).SetBytes(word), offset)
+	sum.Mod(sum, new(big.Int).Lsh(common.Big1, 160))
+	return common.BigToAddress(sum)
+}
+
+func TestArbSysAddressAliasing(t *testing.T) {
+	h := newPrecompileHarness(t)
+	caller := common.HexToAddress("0x1234")
+	senders := []common.Address{
+		{},
+		common.HexToAddress("0x1"),
+		common.HexToAddress("0xabcd"),
+		common.HexToAddress("0xeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee"),
+		common.HexToAddress("0xffffffffffffffffffffffffffffffffffffffff"),
+	}
+	// the alias is the same whatever the destination, including the null destination
+	dests := []common.Address{{}, caller, common.HexToAddress("0xffffffffffffffffffffffffffffffffffffffff")}
+
+	for _, sender := range senders {
+		expected := referenceL2Alias(t, sender)
+		for _, dest := range dests {
+			results := h.mustCall(types.ArbSysAddress, templates.ArbSysMetaData, caller, common.Big0, "mapL1SenderContractAddressToL2Alias", sender, dest)
+			if results[0].(common.Address) != expected {
+				Fail(t, "alias of", sender, "with destination", dest, "was", results[0], "instead of", expected)
+			}
+		}
+		// myCallersAddressWithoutAliasing undoes the alias this way
+		if util.InverseRemapL1Address(expected) != sender {
+			Fail(t, "dealiasing", expected, "gave", util.InverseRemapL1Address(expected), "instead of", sender)
+		}
+	}
+
+	wrapped := referenceL2Alias(t, common.HexToAddress("0xffffffffffffffffffffffffffffffffffffffff"))
+	if wrapped != common.HexToAddress("0x1111000000000000000000000000000000001110") {
+		Fail(t, "alias of the max address didn't wrap around", wrapped)
+	}
+}
+
+func TestPrecompileStats(t *testing.T) {
+	// stats are only recorded with metrics enabled
+	metricsEnabled := metrics.Enabled
+	metrics.Enabled = true
+	defer func() { metrics.Enabled = metricsEnabled }()
+
+	h := newPrecompileHarness(t)
+	caller := common.HexToAddress("0x1234")
+	before := GetStats()["ArbSys.ArbBlockNumber"]
+
+	calls := uint64(1000)
+	var gasUsed uint64
+	for i := uint64(0); i < calls; i++ {
+		_, gas, err := h.call(types.ArbSysAddress, templates.ArbSysMetaData, caller, common.Big0, "arbBlockNumber")
+		Require(t, err)
+		gasUsed += gas
+	}
+
+	after := GetStats()["ArbSys.ArbBlockNumber"]
+	if after.Calls-before.Calls != calls {
+		Fail(t, "recorded", after.Calls-before.Calls, "calls instead of", calls)
+	}
+	if after.GasUsed-before.GasUsed != gasUsed {
+		Fail(t, "recorded", after.GasUsed-before.GasUsed, "gas instead of", gasUsed)
+	}
+}
+
+// the L2-to-L1 events as they appear in the bridge's copy of the ArbSys ABI
+const bridgeArbSysEventsABI = `[
+	{"type":"event","name":"L2ToL1Tx","anonymous":false,"inputs":[
+		{"name":"caller","type":"address","indexed":false},
+		{"name":"destination","type":"address","indexed":true},
+		{"name":"hash","type":"uint256","indexed":true},
+		{"name":"position","type":"uint256","indexed":true},
+		{"name":"arbBlockNum","type":"uint256","indexed":false},
+		{"name":"ethBlockNum","type":"uint256","indexed":false},
+		{"name":"timestamp","type":"uint256","indexed":false},
+		{"name":"callvalue","type":"uint256","indexed":false},
+		{"name":"data","type":"bytes","indexed":false}
+	]},
+	{"type":"event","name":"L2ToL1Transaction","anonymous":false,"inputs":[
+		{"name":"caller","type":"address","indexed":false},
+		{"name":"destination","type":"address","indexed":true},
+		{"name":"uniqueId","type":"uint256","indexed":true},
+		{"name":"batchNumber","type":"uint256","indexed":true},
+		{"name":"indexInBatch","type":"uint256","indexed":false},
+		{"name":"arbBlockNum","type":"uint256","indexed":false},
+		{"name":"ethBlockNum","type":"uint256","indexed":false},
+		{"name":"timestamp","type":"uint256","indexed":false},
+		{"name":"callvalue","type":"uint256","indexed":false},
+		{"name":"data","type":"bytes","indexed":false}
+	]}
+]`
+
+func TestL2ToL1TransactionTopicMatchesBridgeABI(t *testing.T) {
+	bridgeABI, err := abi.JSON(strings.NewReader(bridgeArbSysEventsABI))
+	Require(t, err)
+	arbSysABI, err := templates.ArbSysMetaData.GetAbi()
+	Require(t, err)
+
+	for event, topic := range map[string]string{
+		"L2ToL1Tx":          L2ToL1TxTopic,
+		"L2ToL1Transaction": L2ToL1TransactionTopic,
+	} {
+		expected := common.HexToHash(topic)
+		if bridgeABI.Events[event].ID != expected {
+			Fail(t, event, "topic", topic, "doesn't match the bridge ABI's", bridgeABI.Events[event].ID)
+		}
+		// the precompile emits events with the topics of the generated ABI
+		if arbSysABI.Events[event].ID != expected {
+			Fail(t, event, "topic", topic, "doesn't match the ArbSys ABI's", arbSysABI.Events[event].ID)
+		}
+	}
+}
+
+func TestArbSysBlockNumbers(t *testing.T) {
+	t.Parallel()
+	sys := templates.ArbSysMetaData
+	caller := common.HexToAddress("0x1234")
+
+	for _, test := range []struct {
+		name        string
+		blockNumber uint64
+	}{
+		{"genesis", 0},
+		{"first", 1},
+		{"large", 1 << 40},
+		{"max", ^uint64(0)},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			h := newPrecompileHarness(t)
+			h.evm.Context.BlockNumber = new(big.Int).SetUint64(test.blockNumber)
+			results := h.mustCall(types.ArbSysAddress, sys, caller, common.Big0, "arbBlockNumber")
+			requireBigEquals(t, "arbBlockNumber", results[0].(*big.Int), h.evm.Context.BlockNumber)
+		})
+	}
+}
+
+func TestArbSysBlockHashRange(t *testing.T) {
+	t.Parallel()
+	sys := templates.ArbSysMetaData
+	caller := common.HexToAddress("0x1234")
+
+	for _, test := range []struct {
+		name      string
+		requested *big.Int
+		valid     bool
+	}{
+		{"previous", big.NewInt(299), true},
+		{"oldest", big.NewInt(300 - 256), true},
+		{"current", big.NewInt(300), false},
+		{"future", big.NewInt(301), false},
+		{"too old", big.NewInt(300 - 257), false},
+		{"not a uint64", new(big.Int).Lsh(common.Big1, 64), false},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			h := newPrecompileHarness(t)
+			h.evm.Context.BlockNumber = big.NewInt(300)
+			results, _, err := h.call(types.ArbSysAddress, sys, caller, common.Big0, "arbBlockHash", test.requested)
+			if !test.valid {
+				if err == nil {
+					Fail(t, "arbBlockHash didn't revert for block", test.requested)
+				}
+				return
+			}
+			Require(t, err)
+			if common.Hash(results[0].([32]byte)) != h.evm.Context.GetHash(test.requested.Uint64()) {
+				Fail(t, "arbBlockHash returned the wrong hash", results[0])
+			}
+		})
+	}
+}
+
+func TestArbSysCallerAliasing(t *testing.T) {
+	t.Parallel()
+	sys := templates.ArbSysMetaData
+	caller := common.HexToAddress("0x1234")
+
+	txType := func(tipe byte) *byte { return &tipe }
+	for _, test := range []struct {
+		name    string
+		txType  *byte
+		aliased bool
+	}{
+		{"no tx", nil, false},
+		{"legacy", txType(types.LegacyTxType), false},
+		{"dynamic fee", txType(types.DynamicFeeTxType), false},
+		{"deposit", txType(types.ArbitrumDepositTxType), false},
+		{"unsigned", txType(types.ArbitrumUnsignedTxType), true},
+		{"contract", txType(types.ArbitrumContractTxType), true},
+		{"retry", txType(types.ArbitrumRetryTxType), true},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			h := newPrecompileHarness(t)
+			txProcessor, ok := h.evm.ProcessingHook.(*arbos.TxProcessor)
+			if !ok {
+				Fail(t, "harness EVM has no TxProcessor")
+			}
+			txProcessor.TopTxType = test.txType
+
+			results := h.mustCall(types.ArbSysAddress, sys, caller, common.Big0, "isTopLevelCall")
+			if !results[0].(bool) {
+				Fail(t, "call from the harness wasn't top level")
+			}
+			results = h.mustCall(types.ArbSysAddress, sys, caller, common.Big0, "wasMyCallersAddressAliased")
+			if results[0].(bool) != test.aliased {
+				Fail(t, "wasMyCallersAddressAliased returned", results[0], "expected", test.aliased)
+			}
+		})
+	}
+}
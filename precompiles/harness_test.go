@@ -0,0 +1,124 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package precompiles
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+const harnessGasSupplied = 10_000_000
+
+// precompileHarness calls precompiles through their ABI dispatcher, the same
+// entrypoint the EVM uses, against a memory-backed stateDB with ArbOS initialized.
+// Unlike calling the implementer directly, this exercises argument decoding,
+// purity and value checks, gas accounting, and event emission.
+type precompileHarness struct {
+	t   *testing.T
+	evm *vm.EVM
+	// gas is supplied to each call, harnessGasSupplied unless a test lowers it
+	gas uint64
+}
+
+func newPrecompileHarness(t *testing.T) *precompileHarness {
+	t.Helper()
+	evm := newMockEVMForTestingWithVersionAndRunMode(nil, core.MessageCommitMode)
+	evm.Context.GetHash = func(number uint64) common.Hash {
+		return common.BigToHash(new(big.Int).SetUint64(number))
+	}
+	return &precompileHarness{t: t, evm: evm, gas: harnessGasSupplied}
+}
+
+func (h *precompileHarness) stateDB() *state.StateDB {
+	//nolint:errcheck
+	return h.evm.StateDB.(*state.StateDB)
+}
+
+// logs returns every log emitted since the harness was created
+func (h *precompileHarness) logs() []*types.Log {
+	return h.stateDB().Logs()
+}
+
+// call invokes method on the precompile at address and returns its decoded outputs
+// and the gas used. As in the EVM, value moves from the caller to the precompile
+// before the call, and all state changes are reverted if the call fails.
+func (h *precompileHarness) call(
+	address common.Address,
+	metadata *bind.MetaData,
+	caller common.Address,
+	value *big.Int,
+	method string,
+	args ...interface{},
+) ([]interface{}, uint64, error) {
+	h.t.Helper()
+	contractABI, err := metadata.GetAbi()
+	Require(h.t, err)
+	calldata, err := contractABI.Pack(method, args...)
+	Require(h.t, err, method)
+
+	output, gasUsed, err := h.callRaw(address, caller, value, calldata)
+	if err != nil {
+		return nil, gasUsed, err
+	}
+	results, err := contractABI.Methods[method].Outputs.Unpack(output)
+	Require(h.t, err, method)
+	return results, gasUsed, nil
+}
+
+// callRaw is like call but takes the calldata as is and returns the undecoded output
+func (h *precompileHarness) callRaw(
+	address common.Address,
+	caller common.Address,
+	value *big.Int,
+	calldata []byte,
+) ([]byte, uint64, error) {
+	statedb := h.stateDB()
+	snapshot := statedb.Snapshot()
+	if value.Sign() != 0 {
+		statedb.SubBalance(caller, value)
+		statedb.AddBalance(address, value)
+	}
+	output, gasLeft, err := Precompiles()[address].Call(
+		calldata, address, address, caller, value, false, h.gas, h.evm,
+	)
+	gasUsed := h.gas - gasLeft
+	if err != nil {
+		statedb.RevertToSnapshot(snapshot)
+		return nil, gasUsed, err
+	}
+	return output, gasUsed, nil
+}
+
+// mustCall is like call but fails the test if the call reverts
+func (h *precompileHarness) mustCall(
+	address common.Address,
+	metadata *bind.MetaData,
+	caller common.Address,
+	value *big.Int,
+	method string,
+	args ...interface{},
+) []interface{} {
+	h.t.Helper()
+	results, _, err := h.call(address, metadata, caller, value, method, args...)
+	Require(h.t, err, method)
+	return results
+}
+
+// findLog returns the first log emitted by address with the given event's topic
+func findLog(logs []*types.Log, address common.Address, event abi.Event) *types.Log {
+	for _, log := range logs {
+		if log.Address == address && len(log.Topics) > 0 && log.Topics[0] == event.ID {
+			return log
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2021-2023, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package precompiles
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Interceptor is told the name and decoded arguments of each call made to the
+// precompile it's installed on, before the call is executed
+type Interceptor func(method string, args []interface{})
+
+// interceptors stays nil unless a test installs one, so in production looking
+// up an interceptor costs a single atomic load and nil check. Installs and
+// removals replace the whole map so lookups never need the mutex.
+var (
+	interceptorsMutex sync.Mutex
+	interceptors      atomic.Pointer[map[common.Address]Interceptor]
+)
+
+// InstallInterceptor records calls to the precompile at address without
+// changing their behavior, so tests can check which methods were called and
+// with what arguments. It replaces any interceptor already installed there.
+// It's only meant for tests; nothing outside of them should install one.
+func InstallInterceptor(address common.Address, interceptor Interceptor) {
+	interceptorsMutex.Lock()
+	defer interceptorsMutex.Unlock()
+	updated := make(map[common.Address]Interceptor)
+	if current := interceptors.Load(); current != nil {
+		for addr, existing := range *current {
+			updated[addr] = existing
+		}
+	}
+	updated[address] = interceptor
+	interceptors.Store(&updated)
+}
+
+// RemoveInterceptor stops recording calls to the precompile at address
+func RemoveInterceptor(address common.Address) {
+	interceptorsMutex.Lock()
+	defer interceptorsMutex.Unlock()
+	current := interceptors.Load()
+	if current == nil {
+		return
+	}
+	updated := make(map[common.Address]Interceptor)
+	for addr, existing := range *current {
+		if addr != address {
+			updated[addr] = existing
+		}
+	}
+	if len(updated) == 0 {
+		interceptors.Store(nil)
+		return
+	}
+	interceptors.Store(&updated)
+}
+
+func interceptorFor(address common.Address) Interceptor {
+	current := interceptors.Load()
+	if current == nil {
+		return nil
+	}
+	return (*current)[address]
+}
@@ -0,0 +1,57 @@
+// Copyright 2021-2023, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package precompiles
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	templates "github.com/offchainlabs/nitro/solgen/go/precompilesgen"
+)
+
+func TestInterceptor(t *testing.T) {
+	h := newPrecompileHarness(t)
+	caller := common.HexToAddress("0x1234")
+	expected, _, err := h.call(types.ArbSysAddress, templates.ArbSysMetaData, caller, common.Big0, "arbBlockNumber")
+	Require(t, err)
+
+	var methods []string
+	var args [][]interface{}
+	InstallInterceptor(types.ArbSysAddress, func(method string, methodArgs []interface{}) {
+		methods = append(methods, method)
+		args = append(args, methodArgs)
+	})
+	defer RemoveInterceptor(types.ArbSysAddress)
+
+	result, _, err := h.call(types.ArbSysAddress, templates.ArbSysMetaData, caller, common.Big0, "arbBlockNumber")
+	Require(t, err)
+	if result[0].(*big.Int).Cmp(expected[0].(*big.Int)) != 0 {
+		Fail(t, "intercepted call returned", result[0], "instead of", expected[0])
+	}
+	sender := common.HexToAddress("0x5678")
+	_, _, err = h.call(types.ArbSysAddress, templates.ArbSysMetaData, caller, common.Big0, "mapL1SenderContractAddressToL2Alias", sender, common.Address{})
+	Require(t, err)
+	if len(methods) != 2 || methods[0] != "ArbBlockNumber" || methods[1] != "MapL1SenderContractAddressToL2Alias" {
+		Fail(t, "interceptor recorded calls to", methods)
+	}
+	if len(args[0]) != 0 || len(args[1]) != 2 || args[1][0] != sender {
+		Fail(t, "interceptor recorded arguments", args)
+	}
+
+	// calls to other precompiles aren't recorded
+	_, _, err = h.call(common.HexToAddress("0x6c"), templates.ArbGasInfoMetaData, caller, common.Big0, "getL1BaseFeeEstimate")
+	Require(t, err)
+	RemoveInterceptor(types.ArbSysAddress)
+	_, _, err = h.call(types.ArbSysAddress, templates.ArbSysMetaData, caller, common.Big0, "arbBlockNumber")
+	Require(t, err)
+	if len(methods) != 2 {
+		Fail(t, "interceptor recorded", methods, "after other calls or removal")
+	}
+	if interceptors.Load() != nil {
+		Fail(t, "interceptors still set after the last one was removed")
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
 	glog "github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/params"
 )
 
@@ -74,6 +75,7 @@ type PrecompileMethod struct {
 	purity       purity
 	handler      reflect.Method
 	arbosVersion uint64
+	stats        *methodStats
 }
 
 type PrecompileEvent struct {
@@ -227,6 +229,7 @@ func MakePrecompile(metadata *bind.MetaData, implementer interface{}) (addr, *Pr
 			purity,
 			handler,
 			0,
+			statsFor(contract, name),
 		}
 		methods[id] = &method
 		methodsByName[name] = &method
@@ -650,6 +653,11 @@ func (p *Precompile) Call(
 		// method does not exist or hasn't yet been activated
 		return nil, 0, vm.ErrExecutionReverted
 	}
+	if metrics.Enabled {
+		defer func() {
+			method.stats.record(gasSupplied - gasLeft)
+		}()
+	}
 
 	if method.purity >= view && actingAsAddress != precompileAddress {
 		// should not access precompile superpowers when not acting as the precompile
@@ -723,6 +731,9 @@ func (p *Precompile) Call(
 		// calldata does not match the method's signature
 		return nil, 0, vm.ErrExecutionReverted
 	}
+	if intercept := interceptorFor(p.address); intercept != nil {
+		intercept(method.name, args)
+	}
 	for _, arg := range args {
 		converted := reflect.ValueOf(arg).Convert(method.handler.Type.In(len(reflectArgs)))
 		reflectArgs = append(reflectArgs, converted)
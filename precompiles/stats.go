@@ -0,0 +1,71 @@
+// Copyright 2021-2023, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package precompiles
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// PrecompileStats is the number of calls made to a precompile method and the
+// total gas they used
+type PrecompileStats struct {
+	Calls   uint64
+	GasUsed uint64
+}
+
+// methodStats is shared by every instance of a precompile method, since the
+// precompiles are rebuilt each time Precompiles is called
+type methodStats struct {
+	calls   atomic.Uint64
+	gasUsed atomic.Uint64
+	gas     metrics.Histogram
+}
+
+var (
+	methodStatsMutex sync.Mutex
+	allMethodStats   = make(map[string]*methodStats)
+)
+
+func statsFor(contract, method string) *methodStats {
+	key := contract + "." + method
+	methodStatsMutex.Lock()
+	defer methodStatsMutex.Unlock()
+	stats, ok := allMethodStats[key]
+	if !ok {
+		stats = &methodStats{
+			gas: metrics.GetOrRegisterHistogram("arb/precompile/"+contract+"/"+method+"/gas", nil, metrics.NewBoundedHistogramSample()),
+		}
+		allMethodStats[key] = stats
+	}
+	return stats
+}
+
+func (s *methodStats) record(gasUsed uint64) {
+	s.calls.Add(1)
+	s.gasUsed.Add(gasUsed)
+	s.gas.Update(int64(gasUsed))
+}
+
+// GetStats returns the call count and gas used of every precompile method that
+// has been called, keyed by contract and method name, such as "ArbSys.ArbBlockNumber".
+// Calls are only recorded while metrics are enabled.
+func GetStats() map[string]PrecompileStats {
+	methodStatsMutex.Lock()
+	defer methodStatsMutex.Unlock()
+	result := make(map[string]PrecompileStats, len(allMethodStats))
+	for key, stats := range allMethodStats {
+		calls := stats.calls.Load()
+		if calls == 0 {
+			continue
+		}
+		result[key] = PrecompileStats{
+			Calls:   calls,
+			GasUsed: stats.gasUsed.Load(),
+		}
+	}
+	return result
+}
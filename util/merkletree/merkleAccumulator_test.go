@@ -10,7 +10,9 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/offchainlabs/nitro/arbos/burn"
 	"github.com/offchainlabs/nitro/arbos/merkleAccumulator"
+	"github.com/offchainlabs/nitro/arbos/storage"
 )
 
 func TestEmptyAccumulator(t *testing.T) {
@@ -133,6 +135,37 @@ func TestAccumulator4(t *testing.T) {
 	testSerDe(mt, t)
 }
 
+func TestAccumulatorMatchesTree(t *testing.T) {
+	leafCount := uint64(1 << 14)
+	if testing.Short() {
+		leafCount = 1 << 10
+	}
+	sto := storage.NewMemoryBacked(burn.NewSystemBurner(nil, false))
+	merkleAccumulator.InitializeMerkleAccumulator(sto)
+	acc := merkleAccumulator.OpenMerkleAccumulator(sto)
+	mt := NewEmptyMerkleTree()
+	for i := uint64(0); i < leafCount; i++ {
+		itemHash := pseudorandomForTesting(i)
+		accAppend(t, acc, itemHash)
+		mt = mt.Append(itemHash)
+		if root(t, acc) != mt.Hash() {
+			Fail(t, "accumulator root differs from the tree's after", i+1, "leaves")
+		}
+	}
+
+	// the accumulator must pick up where it left off from its stored state
+	reopened := merkleAccumulator.OpenMerkleAccumulator(sto)
+	if size(t, reopened) != leafCount || root(t, reopened) != mt.Hash() {
+		Fail(t, "reopened accumulator doesn't match the one that was written")
+	}
+	itemHash := pseudorandomForTesting(leafCount)
+	accAppend(t, reopened, itemHash)
+	mt = mt.Append(itemHash)
+	if root(t, reopened) != mt.Hash() {
+		Fail(t, "reopened accumulator root differs from the tree's after appending")
+	}
+}
+
 func testAllSummarySizes(tree MerkleTree, t *testing.T) {
 	for i := uint64(1); i <= tree.Size(); i++ {
 		sum := tree.SummarizeUpTo(i)
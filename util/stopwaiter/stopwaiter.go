@@ -8,6 +8,7 @@ import (
 	"errors"
 	"reflect"
 	"runtime"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
@@ -116,6 +117,31 @@ func (s *StopWaiterSafe) StopAndWait() error {
 	return s.stopAndWaitImpl(stopDelayWarningTimeout)
 }
 
+// WaitForStop stops and waits up to timeout for all threads to exit, returning false if they haven't.
+// Threads that are still running when the timeout elapses are left to exit in the background.
+// May be called multiple times, even before start.
+func (s *StopWaiterSafe) WaitForStop(timeout time.Duration) bool {
+	s.StopOnly()
+	if !s.Started() {
+		return true
+	}
+	waitChan, err := s.GetWaitChannel()
+	if err != nil {
+		// the threads can't be waited on, so they can't be known to have exited
+		log.Error("error waiting for stop", "name", s.name, "err", err)
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	select {
+	case <-ctx.Done():
+		log.Warn("timed out waiting for stop", "name", s.name, "timeout", timeout)
+		return false
+	case <-waitChan:
+		return true
+	}
+}
+
 func getAllStackTraces() string {
 	buf := make([]byte, 64*1024*1024)
 	size := runtime.Stack(buf, true)
@@ -183,6 +209,39 @@ func (s *StopWaiterSafe) LaunchThreadSafe(foo func(context.Context)) error {
 	return nil
 }
 
+// LaunchThreadWithRecoverySafe launches foo in a thread that recovers from and logs panics.
+// If restart is set, foo is launched again after delay once it panics, until the StopWaiter is stopped.
+// If stop was already called, thread might silently not be launched
+func (s *StopWaiterSafe) LaunchThreadWithRecoverySafe(foo func(context.Context), restart bool, delay time.Duration) error {
+	return s.LaunchThreadSafe(func(ctx context.Context) {
+		for {
+			if !s.runRecovering(ctx, foo) || !restart {
+				return
+			}
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			log.Info("restarting thread after panic", "name", s.name)
+		}
+	})
+}
+
+// runRecovering calls foo and returns true if it panicked
+func (s *StopWaiterSafe) runRecovering(ctx context.Context, foo func(context.Context)) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("recovered from panic in thread", "name", s.name, "err", r, "stack", string(debug.Stack()))
+			panicked = true
+		}
+	}()
+	foo(ctx)
+	return false
+}
+
 // This calls go foo() directly, with the benefit of being easily searchable.
 // Callers may rely on the assumption that foo runs even if this is stopped.
 func (s *StopWaiterSafe) LaunchUntrackedThread(foo func()) {
@@ -333,6 +392,13 @@ func (s *StopWaiter) LaunchThread(foo func(context.Context)) {
 	}
 }
 
+// If stop was already called, thread might silently not be launched
+func (s *StopWaiter) LaunchThreadWithRecovery(foo func(context.Context), restart bool, delay time.Duration) {
+	if err := s.StopWaiterSafe.LaunchThreadWithRecoverySafe(foo, restart, delay); err != nil {
+		panic(err)
+	}
+}
+
 func (s *StopWaiter) CallIteratively(foo func(context.Context) time.Duration) {
 	if err := s.StopWaiterSafe.CallIterativelySafe(foo); err != nil {
 		panic(err)
@@ -5,6 +5,7 @@ package stopwaiter
 
 import (
 	"context"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -72,3 +73,84 @@ func TestStopWaiterStopAndWaitMultipleTimes(t *testing.T) {
 	sw.StopAndWait()
 	sw.StopAndWait()
 }
+
+func TestStopWaiterLaunchThreadWithRecovery(t *testing.T) {
+	logHandler := testhelpers.InitTestLog(t, log.LvlTrace)
+	sw := StopWaiter{}
+	sw.Start(context.Background(), &TestStruct{})
+	var runs atomic.Int32
+	running := make(chan struct{})
+	sw.LaunchThreadWithRecovery(func(ctx context.Context) {
+		if runs.Add(1) < 3 {
+			panic("test panic")
+		}
+		close(running)
+		<-ctx.Done()
+	}, true, 10*time.Millisecond)
+	select {
+	case <-running:
+	case <-time.After(5 * time.Second):
+		testhelpers.FailImpl(t, "thread not restarted after panics")
+	}
+	if runs.Load() != 3 {
+		testhelpers.FailImpl(t, "thread ran", runs.Load(), "times instead of 3")
+	}
+	if !logHandler.WasLogged("recovered from panic in thread") {
+		testhelpers.FailImpl(t, "Failed to log recovered panic")
+	}
+	sw.StopAndWait()
+}
+
+func TestStopWaiterLaunchThreadWithRecoveryNoRestart(t *testing.T) {
+	sw := StopWaiter{}
+	sw.Start(context.Background(), &TestStruct{})
+	var runs atomic.Int32
+	sw.LaunchThreadWithRecovery(func(ctx context.Context) {
+		runs.Add(1)
+		panic("test panic")
+	}, false, 0)
+	sw.StopAndWait()
+	if runs.Load() != 1 {
+		testhelpers.FailImpl(t, "thread ran", runs.Load(), "times instead of 1")
+	}
+}
+
+func TestStopWaiterWaitForStop(t *testing.T) {
+	sw := StopWaiter{}
+	sw.Start(context.Background(), &TestStruct{})
+	sw.LaunchThread(func(ctx context.Context) {
+		<-ctx.Done()
+	})
+	if !sw.WaitForStop(time.Second) {
+		testhelpers.FailImpl(t, "WaitForStop timed out although thread exits on stop")
+	}
+}
+
+func TestStopWaiterWaitForStopTimeout(t *testing.T) {
+	sw := StopWaiter{}
+	sw.Start(context.Background(), &TestStruct{})
+	testCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sw.LaunchThread(func(ctx context.Context) {
+		<-testCtx.Done()
+	})
+	timeout := 100 * time.Millisecond
+	start := time.Now()
+	if sw.WaitForStop(timeout) {
+		testhelpers.FailImpl(t, "WaitForStop returned true although thread is still running")
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		testhelpers.FailImpl(t, "WaitForStop returned after", elapsed, "before the", timeout, "timeout")
+	}
+	cancel()
+	if !sw.WaitForStop(time.Second) {
+		testhelpers.FailImpl(t, "WaitForStop timed out after thread exited")
+	}
+}
+
+func TestStopWaiterWaitForStopBeforeStart(t *testing.T) {
+	sw := StopWaiter{}
+	if !sw.WaitForStop(time.Millisecond) {
+		testhelpers.FailImpl(t, "WaitForStop before start should succeed")
+	}
+}
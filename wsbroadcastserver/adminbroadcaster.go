@@ -0,0 +1,265 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+const (
+	AdminURI = "/admin/ws"
+
+	adminStatsInterval = time.Second
+	// number of adminStatsInterval samples the messages per second is averaged over
+	adminRateWindow = 10
+	adminTopClients = 5
+)
+
+// ClientQueueDepth is the number of messages waiting in a client's send queue,
+// along with what has been sent to the client so far
+type ClientQueueDepth struct {
+	Name         string    `json:"name"`
+	QueueDepth   int       `json:"queueDepth"`
+	BytesSent    uint64    `json:"bytesSent"`
+	MessagesSent uint64    `json:"messagesSent"`
+	SendErrors   uint64    `json:"sendErrors"`
+	LastSent     time.Time `json:"lastSent"`
+	// CompressionRatio is 0 for clients that haven't been sent compressed messages
+	CompressionRatio float64 `json:"compressionRatio"`
+}
+
+// AdminStats is the snapshot of broadcast server state streamed to admin clients
+type AdminStats struct {
+	ActiveConnections      int32              `json:"activeConnections"`
+	MessagesPerSecond      float64            `json:"messagesPerSecond"`
+	TopClientsByQueueDepth []ClientQueueDepth `json:"topClientsByQueueDepth"`
+	BacklogSize            uint64             `json:"backlogSize"`
+	// CompressionTime is the total time spent compressing messages, in nanoseconds
+	CompressionTime time.Duration `json:"compressionTime"`
+}
+
+// adminConn is an admin client's connection. Stats and pings are written from
+// the AdminBroadcaster thread while replies to control frames are written from
+// the admin's reader, so writes must hold writeMutex.
+type adminConn struct {
+	net.Conn
+	writeMutex sync.Mutex
+}
+
+func (c *adminConn) writeFrame(frame []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	_, err := c.Write(frame)
+	return err
+}
+
+func (c *adminConn) writeStats(data []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return wsutil.WriteServerMessage(c, ws.OpText, data)
+}
+
+// AdminBroadcaster streams AdminStats to connected admin clients. It runs in
+// its own thread so that it doesn't hold up the main broadcast path, and only
+// asks the ClientManager thread for per-client data while admins are connected.
+type AdminBroadcaster struct {
+	cm          *ClientManager
+	addAdmin    chan *adminConn
+	adminClosed chan *adminConn
+	admins      map[*adminConn]bool
+	samples     [adminRateWindow]uint64
+	sampleIdx   int
+	lastCount   uint64
+	lastPing    time.Time
+}
+
+func NewAdminBroadcaster(cm *ClientManager) *AdminBroadcaster {
+	return &AdminBroadcaster{
+		cm:          cm,
+		addAdmin:    make(chan *adminConn, 8),
+		adminClosed: make(chan *adminConn),
+		admins:      make(map[*adminConn]bool),
+	}
+}
+
+// AddAdmin hands an upgraded admin connection to the AdminBroadcaster. The
+// connection is closed instead if the ClientManager is stopped.
+func (ab *AdminBroadcaster) AddAdmin(conn net.Conn) {
+	ctx, err := ab.cm.GetContextSafe()
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	select {
+	case <-ctx.Done():
+		_ = conn.Close()
+	case ab.addAdmin <- &adminConn{Conn: conn}:
+	}
+}
+
+// readAdmin reads from an admin connection until it fails, replying to control
+// frames, then hands it back to the AdminBroadcaster thread to be removed.
+// Admins are pinged regularly, so a read timing out means the connection is
+// gone. Closing the connection stops the reader.
+func (ab *AdminBroadcaster) readAdmin(ctx context.Context, conn *adminConn) {
+	controlHandler := wsutil.ControlFrameHandler(conn, ws.StateServerSide)
+	reader := wsutil.Reader{
+		Source:    conn,
+		State:     ws.StateServerSide,
+		CheckUTF8: true,
+	}
+	readFrame := func() error {
+		if err := conn.SetReadDeadline(time.Now().Add(ab.cm.config().ClientTimeout)); err != nil {
+			return err
+		}
+		header, err := reader.NextFrame()
+		if err != nil {
+			return err
+		}
+		if !header.OpCode.IsControl() {
+			// admins have nothing to send, ignore anything they do
+			return reader.Discard()
+		}
+		conn.writeMutex.Lock()
+		defer conn.writeMutex.Unlock()
+		return controlHandler(header, &reader)
+	}
+	for {
+		if err := readFrame(); err != nil {
+			log.Debug("admin client disconnected", "remoteAddr", conn.RemoteAddr(), "err", err)
+			select {
+			case <-ctx.Done():
+			case ab.adminClosed <- conn:
+			}
+			return
+		}
+	}
+}
+
+// recordSample stores the number of messages broadcast since the previous
+// sample and returns the messages per second averaged over the window.
+func (ab *AdminBroadcaster) recordSample(count uint64) float64 {
+	ab.samples[ab.sampleIdx] = count - ab.lastCount
+	ab.sampleIdx = (ab.sampleIdx + 1) % adminRateWindow
+	ab.lastCount = count
+	var sum uint64
+	for _, sample := range ab.samples {
+		sum += sample
+	}
+	return float64(sum) / (adminRateWindow * adminStatsInterval).Seconds()
+}
+
+func (ab *AdminBroadcaster) stats(ctx context.Context, messagesPerSecond float64) (*AdminStats, error) {
+	response := make(chan []ClientQueueDepth, 1)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case ab.cm.adminStatsRequest <- response:
+	}
+	var topClients []ClientQueueDepth
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case topClients = <-response:
+	}
+	return &AdminStats{
+		ActiveConnections:      ab.cm.ClientCount(),
+		MessagesPerSecond:      messagesPerSecond,
+		TopClientsByQueueDepth: topClients,
+		BacklogSize:            ab.cm.backlog.Count(),
+		CompressionTime:        TotalCompressionTime(),
+	}, nil
+}
+
+func (ab *AdminBroadcaster) removeAdmin(conn *adminConn) {
+	delete(ab.admins, conn)
+	_ = conn.Close()
+}
+
+func (ab *AdminBroadcaster) Start(ctx context.Context) {
+	ticker := time.NewTicker(adminStatsInterval)
+	defer ticker.Stop()
+	defer func() {
+		for conn := range ab.admins {
+			ab.removeAdmin(conn)
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case conn := <-ab.addAdmin:
+			ab.admins[conn] = true
+			ab.cm.LaunchThread(func(ctx context.Context) {
+				ab.readAdmin(ctx, conn)
+			})
+			log.Info("admin client connected", "remoteAddr", conn.RemoteAddr())
+		case conn := <-ab.adminClosed:
+			ab.removeAdmin(conn)
+		case <-ticker.C:
+			messagesPerSecond := ab.recordSample(ab.cm.messagesBroadcast.Load())
+			if len(ab.admins) == 0 {
+				continue
+			}
+			if time.Since(ab.lastPing) >= ab.cm.config().Ping {
+				ab.lastPing = time.Now()
+				for conn := range ab.admins {
+					if err := conn.writeFrame(ws.CompiledPing); err != nil {
+						logWarn(err, "error pinging admin client, disconnecting")
+						ab.removeAdmin(conn)
+					}
+				}
+			}
+			stats, err := ab.stats(ctx, messagesPerSecond)
+			if err != nil {
+				return
+			}
+			data, err := json.Marshal(stats)
+			if err != nil {
+				log.Error("failed to encode admin stats", "err", err)
+				continue
+			}
+			for conn := range ab.admins {
+				if err := conn.writeStats(data); err != nil {
+					logWarn(err, "error writing stats to admin client, disconnecting")
+					ab.removeAdmin(conn)
+				}
+			}
+		}
+	}
+}
+
+// topClientsByQueueDepth must only be called from the ClientManager thread
+func (cm *ClientManager) topClientsByQueueDepth(count int) []ClientQueueDepth {
+	depths := make([]ClientQueueDepth, 0, len(cm.clientPtrMap))
+	for client := range cm.clientPtrMap {
+		depths = append(depths, ClientQueueDepth{
+			Name:         client.Name,
+			QueueDepth:   client.QueueDepth(),
+			BytesSent:    client.BytesSent.Load(),
+			MessagesSent: client.MessagesSent.Load(),
+			SendErrors:   client.SendErrors.Load(),
+			LastSent:     client.GetLastSent(),
+
+			CompressionRatio: client.CompressionRatio(),
+		})
+	}
+	sort.Slice(depths, func(i, j int) bool {
+		return depths[i].QueueDepth > depths[j].QueueDepth
+	})
+	if len(depths) > count {
+		depths = depths[:count]
+	}
+	return depths
+}
@@ -0,0 +1,88 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	"github.com/offchainlabs/nitro/broadcaster/backlog"
+)
+
+func TestAdminBroadcasterMessageRate(t *testing.T) {
+	cm := NewClientManager(nil, func() *BroadcasterConfig { return &DefaultTestBroadcasterConfig }, nil)
+	ab := cm.adminBroadcaster
+
+	var count uint64
+	for i := 0; i < adminRateWindow; i++ {
+		count += 20
+		ab.recordSample(count)
+	}
+	rate := ab.recordSample(count + 20)
+	Expect(t, rate == 20, "unexpected messages per second", rate)
+
+	// a quiet second only contributes a tenth of the average
+	rate = ab.recordSample(count + 20)
+	Expect(t, rate == 18, "unexpected messages per second", rate)
+}
+
+func TestTopClientsByQueueDepth(t *testing.T) {
+	cm := NewClientManager(nil, func() *BroadcasterConfig { return &DefaultTestBroadcasterConfig }, nil)
+
+	numClients := adminTopClients + 2
+	for i := 0; i < numClients; i++ {
+		cc := newTestClientConnection(t, cm, 16)
+		for j := 0; j < i; j++ {
+			cc.out <- message{}
+		}
+		cm.clientPtrMap[cc] = true
+	}
+
+	top := cm.topClientsByQueueDepth(adminTopClients)
+	Expect(t, len(top) == adminTopClients, "unexpected number of top clients", len(top))
+	for i, depth := range top {
+		expected := numClients - 1 - i
+		Expect(t, depth.QueueDepth == expected, "client", i, "had queue depth", depth.QueueDepth, "instead of", expected)
+	}
+}
+
+func TestAdminClientClose(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	config.AdminToken = "secret"
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+
+	dialer := ws.Dialer{
+		Header: ws.HandshakeHeaderHTTP(http.Header{HTTPHeaderAdminToken: []string{config.AdminToken}}),
+	}
+	conn, _, _, err := dialer.Dial(ctx, "ws://"+server.ListenerAddr().String()+AdminURI)
+	Require(t, err)
+	defer func() { _ = conn.Close() }()
+	Require(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+	_, _, err = wsutil.ReadServerData(conn)
+	Require(t, err, "no stats received")
+
+	Require(t, ws.WriteFrame(conn, ws.MaskFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, "")))))
+	// stats may still arrive before the close frame is echoed
+	for {
+		frame, err := ws.ReadFrame(conn)
+		Require(t, err, "connection closed without echoing the close frame")
+		if frame.Header.OpCode == ws.OpClose {
+			break
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+
+	"github.com/offchainlabs/nitro/arbutil"
+	m "github.com/offchainlabs/nitro/broadcaster/message"
+	"github.com/offchainlabs/nitro/util/stopwaiter"
+)
+
+const (
+	broadcastClientDialTimeout     = 10 * time.Second
+	broadcastClientReadTimeout     = 20 * time.Second
+	broadcastClientInitialBackoff  = 100 * time.Millisecond
+	broadcastClientMaximumBackoff  = 10 * time.Second
+	broadcastClientMessageQueueLen = 1024
+)
+
+// BroadcastClient is a minimal consumer of a broadcast server's feed. It
+// delivers every message received on Messages, reconnecting with backoff when
+// the connection fails and resuming after the last feed message it received.
+// Unlike broadcastclient.BroadcastClient it doesn't check chain ids or feed
+// signatures, so it suits tools and tests rather than nodes.
+type BroadcastClient struct {
+	stopwaiter.StopWaiter
+
+	url         string
+	compression bool
+	messages    chan *m.BroadcastMessage
+
+	// nextSeqNum is only used by the client thread
+	nextSeqNum arbutil.MessageIndex
+}
+
+// NewBroadcastClient returns a client for the feed at url, which negotiates
+// per-message deflate with the server if compression is set
+func NewBroadcastClient(url string, compression bool) *BroadcastClient {
+	return &BroadcastClient{
+		url:         url,
+		compression: compression,
+		messages:    make(chan *m.BroadcastMessage, broadcastClientMessageQueueLen),
+	}
+}
+
+func (bc *BroadcastClient) Start(ctx context.Context) {
+	bc.StopWaiter.Start(ctx, bc)
+	bc.LaunchThread(bc.run)
+}
+
+// Messages returns the channel messages from the server are delivered on. It
+// is closed once the client has stopped.
+func (bc *BroadcastClient) Messages() <-chan *m.BroadcastMessage {
+	return bc.messages
+}
+
+func (bc *BroadcastClient) run(ctx context.Context) {
+	defer close(bc.messages)
+	backoff := broadcastClientInitialBackoff
+	for {
+		received, err := bc.receive(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if received {
+			backoff = broadcastClientInitialBackoff
+		}
+		log.Warn("broadcast client disconnected, reconnecting", "url", bc.url, "backoff", backoff, "err", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		backoff *= 2
+		if backoff > broadcastClientMaximumBackoff {
+			backoff = broadcastClientMaximumBackoff
+		}
+	}
+}
+
+// receive connects to the server and delivers messages until the connection
+// fails or ctx is done, returning whether any messages were received
+func (bc *BroadcastClient) receive(ctx context.Context) (bool, error) {
+	header := http.Header{HTTPHeaderFeedClientVersion: []string{strconv.Itoa(FeedClientVersion)}}
+	if bc.nextSeqNum > 0 {
+		header[HTTPHeaderRequestedSequenceNumber] = []string{strconv.FormatUint(uint64(bc.nextSeqNum), 10)}
+	}
+	dialer := ws.Dialer{
+		Header:  ws.HandshakeHeaderHTTP(header),
+		Timeout: broadcastClientDialTimeout,
+	}
+	if bc.compression {
+		dialer.Extensions = []httphead.Option{wsflate.DefaultParameters.Option()}
+	}
+	conn, br, _, err := dialer.Dial(ctx, bc.url)
+	if err != nil {
+		return false, fmt.Errorf("unable to connect: %w", err)
+	}
+	// closing the connection once ctx is done interrupts any read in progress
+	connDone := make(chan struct{})
+	defer close(connDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-connDone:
+		}
+		_ = conn.Close()
+	}()
+
+	var earlyFrameData io.Reader
+	if br != nil {
+		// frames read along with the upgrade response, see broadcastclient
+		earlyFrameData = io.LimitReader(br, int64(br.Buffered()))
+	}
+	flateReader := NewFlateReader()
+	received := false
+	for {
+		data, _, err := ReadData(ctx, conn, earlyFrameData, broadcastClientReadTimeout, ws.StateClientSide, bc.compression, flateReader)
+		if err != nil || ctx.Err() != nil {
+			return received, err
+		}
+		if data == nil {
+			// a control frame
+			continue
+		}
+		if err := m.VerifyChecksum(data); err != nil {
+			return received, err
+		}
+		bm := &m.BroadcastMessage{}
+		if err := json.Unmarshal(data, bm); err != nil {
+			return received, fmt.Errorf("error unmarshalling broadcast message: %w", err)
+		}
+		received = true
+		if count := len(bm.Messages); count > 0 && bm.Messages[count-1] != nil {
+			bc.nextSeqNum = bm.Messages[count-1].SequenceNumber + 1
+		}
+		select {
+		case bc.messages <- bm:
+		case <-ctx.Done():
+			return received, nil
+		}
+	}
+}
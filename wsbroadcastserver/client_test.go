@@ -0,0 +1,74 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/offchainlabs/nitro/arbutil"
+	"github.com/offchainlabs/nitro/broadcaster/backlog"
+	m "github.com/offchainlabs/nitro/broadcaster/message"
+)
+
+func TestBroadcastClient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+
+	url := "ws://" + server.ListenerAddr().String()
+	clients := []*BroadcastClient{NewBroadcastClient(url, false), NewBroadcastClient(url, true)}
+	for _, client := range clients {
+		client.Start(ctx)
+		defer client.StopAndWait()
+	}
+	for server.ClientCount() != len(clients) {
+		select {
+		case <-ctx.Done():
+			Fail(t, "clients not registered")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	messageCount := 1000
+	for i := 0; i < messageCount; i++ {
+		server.Broadcast(&m.BroadcastMessage{
+			Version:  m.V1,
+			Messages: m.CreateDummyBroadcastMessages(dummySeqNums(i, 1)),
+		})
+	}
+
+	for i, client := range clients {
+		next := arbutil.MessageIndex(0)
+		for int(next) < messageCount {
+			select {
+			case bm, ok := <-client.Messages():
+				if !ok {
+					Fail(t, "client", i, "stopped after", next, "messages")
+				}
+				for _, msg := range bm.Messages {
+					if msg.SequenceNumber != next {
+						Fail(t, "client", i, "received message", msg.SequenceNumber, "instead of", next)
+					}
+					next++
+				}
+			case <-ctx.Done():
+				Fail(t, "client", i, "timed out after", next, "messages")
+			}
+		}
+	}
+
+	clients[0].StopAndWait()
+	if _, ok := <-clients[0].Messages(); ok {
+		Fail(t, "messages channel left open after the client stopped")
+	}
+}
@@ -5,10 +5,12 @@ package wsbroadcastserver
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"math/rand"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,6 +19,7 @@ import (
 	"github.com/offchainlabs/nitro/arbutil"
 	"github.com/offchainlabs/nitro/broadcaster/backlog"
 	m "github.com/offchainlabs/nitro/broadcaster/message"
+	"github.com/offchainlabs/nitro/util/arbmath"
 
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsflate"
@@ -26,14 +29,33 @@ import (
 
 var errContextDone = errors.New("context done")
 
+// closeEchoTimeout is how long DrainAndClose waits for the client to echo its
+// close frame before closing the connection anyway
+const closeEchoTimeout = time.Second
+
+// highPrioritySendQueue is how many high priority messages may be waiting for
+// a client. They are sent ahead of everything else, so only a client that
+// has stopped reading would fill it.
+const highPrioritySendQueue = 16
+
 type message struct {
 	data           []byte
 	sequenceNumber *arbutil.MessageIndex
+	// uncompressedLen is the length data would have uncompressed, if data is
+	// compressed and the uncompressed variant was serialized too
+	uncompressedLen int
 }
 
 type ClientConnectionAction struct {
 	cc     *ClientConnection
 	create bool
+	// closeCode and closeReason are sent to a removed client, if closeCode
+	// isn't zero
+	closeCode   ws.StatusCode
+	closeReason string
+	// disconnected is set if the client closed the connection itself, which
+	// counts towards throttling its reconnects
+	disconnected bool
 }
 
 // ClientConnection represents client connection.
@@ -50,70 +72,164 @@ type ClientConnection struct {
 	clientAction    chan ClientConnectionAction
 	requestedSeqNum arbutil.MessageIndex
 	LastSentSeqNum  atomic.Uint64
+	// seqNumSent is whether LastSentSeqNum has been set, as a client that has
+	// been sent nothing still needs message 0
+	seqNumSent atomic.Bool
 
 	lastHeardUnix int64
+	lastSentUnix  int64
 	out           chan message
-	backlog       backlog.Backlog
-	registered    chan bool
-	backlogSent   bool
-
-	compression bool
-	flateReader *wsflate.Reader
+	// highPriority messages are sent before any queued on out
+	highPriority chan message
+	// queueBelowHalfUnixNano is the last time the out channel was seen less
+	// than half full
+	queueBelowHalfUnixNano int64
+	backlog                backlog.Backlog
+	registered             chan bool
+	backlogSent            bool
+
+	compression          bool
+	compressionThreshold int
+	flateReader          *wsflate.Reader
 
 	delay time.Duration
+	// sendDelay holds back each message taken from out, and is multiplied by
+	// 1-sendDelayDecay after each one. Both are guarded by ioMutex.
+	sendDelay      time.Duration
+	sendDelayDecay float64
+	// egress is shared by all clients of the ClientManager, and nil if the
+	// connection wasn't made by one
+	egress *egressLimiter
+
+	BytesSent    atomic.Uint64
+	MessagesSent atomic.Uint64
+	SendErrors   atomic.Uint64
+
+	// CompressedBytes and UncompressedBytes total the sizes of the messages
+	// sent to the client compressed, after and before compression
+	CompressedBytes   atomic.Uint64
+	UncompressedBytes atomic.Uint64
+}
+
+// ClientConnectionOptions are the per-client settings of a new ClientConnection
+type ClientConnectionOptions struct {
+	// RequestedSeqNum is the first sequence number the client wants sent
+	RequestedSeqNum      arbutil.MessageIndex
+	ConnectingIP         net.IP
+	Compression          bool
+	CompressionThreshold int
+	MaxSendQueue         int
+	// Delay holds back each message sent to the client
+	Delay   time.Duration
+	Backlog backlog.Backlog
 }
 
 func NewClientConnection(
 	conn net.Conn,
 	desc *netpoll.Desc,
 	clientAction chan ClientConnectionAction,
-	requestedSeqNum arbutil.MessageIndex,
-	connectingIP net.IP,
-	compression bool,
-	maxSendQueue int,
-	delay time.Duration,
-	bklg backlog.Backlog,
+	opts ClientConnectionOptions,
 ) *ClientConnection {
+	now := time.Now()
 	return &ClientConnection{
-		conn:            conn,
-		clientIp:        connectingIP,
-		desc:            desc,
-		creation:        time.Now(),
-		Name:            fmt.Sprintf("%s@%s-%d", connectingIP, conn.RemoteAddr(), rand.Intn(10)),
-		clientAction:    clientAction,
-		requestedSeqNum: requestedSeqNum,
-		lastHeardUnix:   time.Now().Unix(),
-		out:             make(chan message, maxSendQueue),
-		compression:     compression,
-		flateReader:     NewFlateReader(),
-		delay:           delay,
-		backlog:         bklg,
-		registered:      make(chan bool, 1),
-		backlogSent:     false,
+		conn:                   conn,
+		clientIp:               opts.ConnectingIP,
+		desc:                   desc,
+		creation:               now,
+		queueBelowHalfUnixNano: now.UnixNano(),
+		Name:                   fmt.Sprintf("%s@%s-%s", opts.ConnectingIP, clientAddr(conn), randomNameSuffix()),
+		clientAction:           clientAction,
+		requestedSeqNum:        opts.RequestedSeqNum,
+		lastHeardUnix:          now.Unix(),
+		out:                    make(chan message, opts.MaxSendQueue),
+		highPriority:           make(chan message, highPrioritySendQueue),
+		compression:            opts.Compression,
+		compressionThreshold:   opts.CompressionThreshold,
+		flateReader:            NewFlateReader(),
+		delay:                  opts.Delay,
+		backlog:                opts.Backlog,
+		registered:             make(chan bool, 1),
+		backlogSent:            false,
+	}
+}
+
+// clientAddr describes where a client connected from for its name. Unix socket
+// clients have no remote address, so the socket they connected to is used.
+func clientAddr(conn net.Conn) string {
+	if local := conn.LocalAddr(); local != nil && local.Network() == "unix" {
+		return "unix:" + local.String()
 	}
+	return fmt.Sprint(conn.RemoteAddr())
+}
+
+// randomNameSuffix returns 16 random hex characters to tell apart connections
+// that share an IP and remote address
+func randomNameSuffix() string {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		log.Warn("failed to generate random client name suffix", "err", err)
+	}
+	return hex.EncodeToString(suffix)
 }
 
 func (cc *ClientConnection) Age() time.Duration {
 	return time.Since(cc.creation)
 }
 
+// RemoteAddr returns the address of the client end of the connection
+func (cc *ClientConnection) RemoteAddr() net.Addr {
+	return cc.conn.RemoteAddr()
+}
+
+// LocalAddr returns the address of the server end of the connection
+func (cc *ClientConnection) LocalAddr() net.Addr {
+	return cc.conn.LocalAddr()
+}
+
 func (cc *ClientConnection) Compression() bool {
 	return cc.compression
 }
 
 // Register sends the ClientConnection to be registered with the ClientManager.
 func (cc *ClientConnection) Register() {
-	cc.clientAction <- ClientConnectionAction{
+	cc.sendAction(ClientConnectionAction{
 		cc:     cc,
 		create: true,
-	}
+	})
 }
 
 // Remove sends the ClientConnection to be removed from the ClientManager.
 func (cc *ClientConnection) Remove() {
-	cc.clientAction <- ClientConnectionAction{
+	cc.sendAction(ClientConnectionAction{
 		cc:     cc,
 		create: false,
+	})
+}
+
+// Disconnected sends the ClientConnection to be removed from the
+// ClientManager after the client closed the connection.
+func (cc *ClientConnection) Disconnected() {
+	cc.sendAction(ClientConnectionAction{
+		cc:           cc,
+		create:       false,
+		disconnected: true,
+	})
+}
+
+// sendAction sends action to the ClientManager unless the client is stopped
+// first. Nothing reads clientAction once the ClientManager thread has exited,
+// but it stops every client it still has as it exits, so a client blocked
+// here isn't left waiting forever.
+func (cc *ClientConnection) sendAction(action ClientConnectionAction) {
+	ctx, err := cc.GetContextSafe()
+	if err != nil {
+		// not started, so there's no thread to hold up
+		cc.clientAction <- action
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case cc.clientAction <- action:
 	}
 }
 
@@ -158,33 +274,45 @@ func (cc *ClientConnection) writeBacklog(ctx context.Context, segment backlog.Ba
 		// more messages are added.
 		end := uint64(msgs[len(msgs)-1].SequenceNumber)
 		cc.LastSentSeqNum.Store(end)
+		cc.seqNumSent.Store(true)
 		log.Debug("segment sent to client", "client", cc.Name, "sentCount", len(bm.Messages), "lastSentSeqNum", end)
 	}
 	return nil
 }
 
 func (cc *ClientConnection) writeBroadcastMessage(bm *m.BroadcastMessage) error {
-	notCompressed, compressed, err := serializeMessage(bm, !cc.compression, cc.compression)
+	// the message is only written to this client, so its buffers can be
+	// reused as soon as the write returns
+	notCompressed := getSerializeBuffer()
+	defer putSerializeBuffer(notCompressed)
+	compressed := getSerializeBuffer()
+	defer putSerializeBuffer(compressed)
+	err := serializeMessageInto(bm, notCompressed, compressed, !cc.compression || cc.compressionThreshold > 0, cc.compression)
 	if err != nil {
 		return err
 	}
 
-	var data []byte
-	if cc.compression {
-		data = compressed.Bytes()
-	} else {
-		data = notCompressed.Bytes()
-	}
-	err = cc.writeRaw(data)
-	if err != nil {
+	return cc.WritePreSerialized(notCompressed.Bytes(), compressed.Bytes())
+}
+
+// WritePreSerialized writes a message that has already been serialized, so
+// that a message sent to many clients is only encoded once. The compressed
+// variant is sent if the client negotiated compression and the message isn't
+// below the compression threshold.
+func (cc *ClientConnection) WritePreSerialized(notCompressed, compressed []byte) error {
+	if cc.compression && len(notCompressed) >= cc.compressionThreshold {
+		err := cc.writeRaw(compressed)
+		if err == nil && len(notCompressed) > 0 {
+			cc.recordCompression(len(notCompressed), len(compressed))
+		}
 		return err
 	}
-	return nil
+	return cc.writeRaw(notCompressed)
 }
 
 func (cc *ClientConnection) Start(parentCtx context.Context) {
 	cc.StopWaiter.Start(parentCtx, cc)
-	cc.LaunchThread(func(ctx context.Context) {
+	writer := func(ctx context.Context) {
 		// A delay may be configured, ensures the Broadcaster delays before any
 		// messages are sent to the client. The ClientConnection has not been
 		// registered so the out channel filling is not a concern.
@@ -228,44 +356,117 @@ func (cc *ClientConnection) Start(parentCtx context.Context) {
 			log.Error("timed out waiting for ClientConnection to register with ClientManager", "client", cc.Name)
 		}
 
-		// broadcast any new messages sent to the out channel
+		// broadcast any new messages sent to the out channel, sending those
+		// sent to the high priority channel ahead of any still queued
 		for {
+			var msg message
 			select {
-			case <-ctx.Done():
-				return
-			case msg := <-cc.out:
-				if msg.sequenceNumber != nil && uint64(*msg.sequenceNumber) <= cc.LastSentSeqNum.Load() {
-					log.Debug("client has already sent message with this sequence number, skipping the message", "client", cc.Name, "sequence number", *msg.sequenceNumber)
-					continue
-				}
-
-				expSeqNum := cc.LastSentSeqNum.Load() + 1
-				if !cc.backlogSent && msg.sequenceNumber != nil && uint64(*msg.sequenceNumber) > expSeqNum {
-					catchupSeqNum := uint64(*msg.sequenceNumber) - 1
-					bm, err := cc.backlog.Get(expSeqNum, catchupSeqNum)
-					if err != nil {
-						logWarn(err, fmt.Sprintf("error reading messages %d to %d from backlog", expSeqNum, catchupSeqNum))
+			case msg = <-cc.highPriority:
+			default:
+				select {
+				case <-ctx.Done():
+					return
+				case msg = <-cc.highPriority:
+				case msg = <-cc.out:
+					cc.updateQueueBelowHalfTime()
+					if !cc.waitSendDelay(ctx) {
 						return
 					}
+				}
+			}
+			if msg.sequenceNumber != nil && cc.alreadySent(*msg.sequenceNumber) {
+				log.Debug("client has already sent message with this sequence number, skipping the message", "client", cc.Name, "sequence number", *msg.sequenceNumber)
+				continue
+			}
+			if msg.sequenceNumber != nil && *msg.sequenceNumber < cc.requestedSeqNum {
+				log.Debug("client requested a later sequence number, skipping the message", "client", cc.Name, "sequence number", *msg.sequenceNumber, "requested", cc.requestedSeqNum)
+				continue
+			}
 
-					err = cc.writeBroadcastMessage(bm)
-					if err != nil {
-						logWarn(err, fmt.Sprintf("error writing messages %d to %d from backlog", expSeqNum, catchupSeqNum))
-						cc.Remove()
-						return
-					}
+			// don't catch up on messages from before the requested sequence number
+			expSeqNum := arbmath.MaxInt(cc.nextSeqNum(), uint64(cc.requestedSeqNum))
+			if !cc.backlogSent && msg.sequenceNumber != nil && uint64(*msg.sequenceNumber) > expSeqNum {
+				catchupSeqNum := uint64(*msg.sequenceNumber) - 1
+				bm, err := cc.backlog.Get(expSeqNum, catchupSeqNum)
+				if err != nil {
+					logWarn(err, fmt.Sprintf("error reading messages %d to %d from backlog", expSeqNum, catchupSeqNum))
+					return
 				}
-				cc.backlogSent = true
 
-				err := cc.writeRaw(msg.data)
+				err = cc.writeBroadcastMessage(bm)
 				if err != nil {
-					logWarn(err, "error writing data to client")
+					logWarn(err, fmt.Sprintf("error writing messages %d to %d from backlog", expSeqNum, catchupSeqNum))
 					cc.Remove()
 					return
 				}
 			}
+			cc.backlogSent = true
+
+			err := cc.writeRaw(msg.data)
+			if err != nil {
+				logWarn(err, "error writing data to client")
+				cc.Remove()
+				return
+			}
+			if msg.sequenceNumber != nil {
+				cc.LastSentSeqNum.Store(uint64(*msg.sequenceNumber))
+				cc.seqNumSent.Store(true)
+			}
+			if msg.uncompressedLen > 0 {
+				cc.recordCompression(msg.uncompressedLen, len(msg.data))
+			}
 		}
-	})
+	}
+	// a panic while writing to one client shouldn't take down the relay, but
+	// the client can't be sent anything more so it is removed
+	cc.LaunchThreadWithRecovery(func(ctx context.Context) {
+		panicked := true
+		defer func() {
+			if panicked {
+				cc.Remove()
+			}
+		}()
+		writer(ctx)
+		panicked = false
+	}, false, 0)
+}
+
+// SetDelay holds back each message subsequently taken from the client's send
+// queue by d, multiplying the delay by 1-decayRate after each message so that a
+// burst of delay wears off. A decayRate of 0 keeps the delay until it's changed
+// again. High priority messages are never delayed.
+func (cc *ClientConnection) SetDelay(d time.Duration, decayRate float64) {
+	if decayRate < 0 {
+		decayRate = 0
+	} else if decayRate > 1 {
+		decayRate = 1
+	}
+	cc.ioMutex.Lock()
+	defer cc.ioMutex.Unlock()
+	cc.sendDelay = d
+	cc.sendDelayDecay = decayRate
+}
+
+// waitSendDelay waits out the current send delay and decays it, returning false
+// if ctx is done first
+func (cc *ClientConnection) waitSendDelay(ctx context.Context) bool {
+	cc.ioMutex.Lock()
+	delay := cc.sendDelay
+	if delay > 0 {
+		cc.sendDelay = time.Duration(float64(delay) * (1 - cc.sendDelayDecay))
+	}
+	cc.ioMutex.Unlock()
+	if delay <= 0 {
+		return true
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
 }
 
 // Registered is used by the ClientManager to indicate that ClientConnection
@@ -282,6 +483,102 @@ func (cc *ClientConnection) StopOnly() {
 	}
 }
 
+// Close closes the connection at once, dropping any messages still queued for
+// the client, and waits for the client thread to exit
+func (cc *ClientConnection) Close() {
+	// closing the connection first fails any write the client thread is
+	// blocked in, rather than waiting for the write timeout
+	_ = cc.conn.Close()
+	cc.StopWaiter.StopAndWait()
+}
+
+// DrainAndClose closes the connection gracefully, as described in RFC 6455:
+// messages still queued for the client are sent, followed by a close frame with
+// the given code and reason, and the client is given closeEchoTimeout to echo
+// the close frame before the TCP connection is closed. The connection must
+// already have been removed from the poller, so that the echo isn't consumed
+// as a client request.
+func (cc *ClientConnection) DrainAndClose(code ws.StatusCode, reason string) {
+	// the client thread must have exited before the queue is drained, so that
+	// messages aren't written out of order
+	cc.StopWaiter.StopAndWait()
+	cc.drainQueue()
+	err := cc.writeClose(code, reason)
+	if err != nil {
+		log.Debug("error sending close frame to client", "client", cc.Name, "err", err)
+	} else {
+		cc.awaitCloseEcho(closeEchoTimeout)
+	}
+	err = cc.conn.Close()
+	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+		log.Warn("Failed to close client connection", "err", err)
+	}
+}
+
+// drainQueue writes out the messages left in the out channel once the client
+// thread has exited. If the client thread never caught up with the backlog,
+// the queue can't be sent without a gap, so the client is left to catch up
+// when it reconnects instead.
+func (cc *ClientConnection) drainQueue() {
+	if !cc.backlogSent {
+		return
+	}
+	for {
+		var msg message
+		select {
+		case msg = <-cc.highPriority:
+		default:
+			select {
+			case msg = <-cc.out:
+			default:
+				return
+			}
+		}
+		if msg.sequenceNumber != nil && (cc.alreadySent(*msg.sequenceNumber) || *msg.sequenceNumber < cc.requestedSeqNum) {
+			continue
+		}
+		if err := cc.writeRaw(msg.data); err != nil {
+			log.Debug("error draining messages to client", "client", cc.Name, "err", err)
+			return
+		}
+	}
+}
+
+// awaitCloseEcho reads and discards frames from the client until it echoes
+// the close frame, the connection fails, or timeout elapses
+func (cc *ClientConnection) awaitCloseEcho(timeout time.Duration) {
+	cc.ioMutex.Lock()
+	defer cc.ioMutex.Unlock()
+	if err := cc.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return
+	}
+	for {
+		frame, err := ws.ReadFrame(cc.conn)
+		if err != nil {
+			log.Debug("client did not echo close frame", "client", cc.Name, "err", err)
+			return
+		}
+		if frame.Header.OpCode == ws.OpClose {
+			return
+		}
+	}
+}
+
+// alreadySent returns whether the message with seqNum has been sent to the
+// client. It must only be called from the client's thread.
+func (cc *ClientConnection) alreadySent(seqNum arbutil.MessageIndex) bool {
+	return cc.seqNumSent.Load() && uint64(seqNum) <= cc.LastSentSeqNum.Load()
+}
+
+// nextSeqNum returns the sequence number of the next message the client
+// needs. It must only be called from the client's thread.
+func (cc *ClientConnection) nextSeqNum() uint64 {
+	if !cc.seqNumSent.Load() {
+		return 0
+	}
+	return cc.LastSentSeqNum.Load() + 1
+}
+
 func (cc *ClientConnection) RequestedSeqNum() arbutil.MessageIndex {
 	return cc.requestedSeqNum
 }
@@ -290,6 +587,37 @@ func (cc *ClientConnection) GetLastHeard() time.Time {
 	return time.Unix(atomic.LoadInt64(&cc.lastHeardUnix), 0)
 }
 
+func (cc *ClientConnection) GetLastSent() time.Time {
+	return time.Unix(atomic.LoadInt64(&cc.lastSentUnix), 0)
+}
+
+// QueueDepth is the number of messages waiting to be sent to the client
+func (cc *ClientConnection) QueueDepth() int {
+	return len(cc.out)
+}
+
+// QueueCapacity is the number of messages that may be queued for the client
+// before it is disconnected
+func (cc *ClientConnection) QueueCapacity() int {
+	return cap(cc.out)
+}
+
+// updateQueueBelowHalfTime records the current time against the client if its
+// send queue is less than half full. An empty queue always counts as less than
+// half full, so that clients with a send queue of one aren't taken as slow.
+func (cc *ClientConnection) updateQueueBelowHalfTime() {
+	depth := cc.QueueDepth()
+	if depth == 0 || depth*2 < cc.QueueCapacity() {
+		atomic.StoreInt64(&cc.queueBelowHalfUnixNano, time.Now().UnixNano())
+	}
+}
+
+// QueueBelowHalfTime is the last time the client's send queue was seen less
+// than half full
+func (cc *ClientConnection) QueueBelowHalfTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&cc.queueBelowHalfUnixNano))
+}
+
 // Receive reads next message from client's underlying connection.
 // It blocks until full message received.
 func (cc *ClientConnection) Receive(ctx context.Context, timeout time.Duration) ([]byte, ws.OpCode, error) {
@@ -317,12 +645,28 @@ func (cc *ClientConnection) readRequest(ctx context.Context, timeout time.Durati
 }
 
 func (cc *ClientConnection) writeRaw(p []byte) error {
+	cc.egress.wait(len(p))
+
 	cc.ioMutex.Lock()
 	defer cc.ioMutex.Unlock()
 
 	_, err := cc.conn.Write(p)
+	if err != nil {
+		cc.SendErrors.Add(1)
+		return err
+	}
+	cc.BytesSent.Add(uint64(len(p)))
+	cc.MessagesSent.Add(1)
+	atomic.StoreInt64(&cc.lastSentUnix, time.Now().Unix())
 
-	return err
+	return nil
+}
+
+// writeClose sends a close frame telling the client why it is being disconnected
+func (cc *ClientConnection) writeClose(code ws.StatusCode, reason string) error {
+	cc.ioMutex.Lock()
+	defer cc.ioMutex.Unlock()
+	return ws.WriteFrame(cc.conn, ws.NewCloseFrame(ws.NewCloseFrameBody(code, reason)))
 }
 
 func (cc *ClientConnection) Ping() error {
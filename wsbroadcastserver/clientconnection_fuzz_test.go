@@ -0,0 +1,93 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// clientFrame encodes payload as a masked text frame, as sent by a feed client
+func clientFrame(payload []byte, compress bool) ([]byte, error) {
+	var buf bytes.Buffer
+	state := ws.StateClientSide
+	if compress {
+		state |= ws.StateExtended
+	}
+	writer := wsutil.NewWriter(&buf, state, ws.OpText)
+	var dest io.WriteCloser = nopCloser{writer}
+	if compress {
+		var msg wsflate.MessageState
+		msg.SetCompressed(true)
+		writer.SetExtensions(&msg)
+		flateWriter, err := flate.NewWriterDict(writer, DeflateCompressionLevel, GetStaticCompressorDictionary())
+		if err != nil {
+			return nil, err
+		}
+		dest = flateWriter
+	}
+	if _, err := dest.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := dest.Close(); err != nil {
+		return nil, err
+	}
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func FuzzReadRequest(f *testing.F) {
+	payload := []byte(`{"version":1,"messages":[]}`)
+	uncompressed, err := clientFrame(payload, false)
+	if err != nil {
+		f.Fatal(err)
+	}
+	compressed, err := clientFrame(payload, true)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(uncompressed, false)
+	f.Add(compressed, true)
+	f.Add(compressed, false)
+	f.Add(ws.MustCompileFrame(ws.MaskFrame(ws.NewPingFrame(nil))), false)
+	f.Add(ws.MustCompileFrame(ws.MaskFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, "")))), true)
+
+	f.Fuzz(func(t *testing.T, data []byte, compression bool) {
+		// a new connection, and so a new flate reader, for every input
+		serverConn, clientConn := net.Pipe()
+		defer func() { _ = serverConn.Close() }()
+		cc := NewClientConnection(serverConn, nil, nil, ClientConnectionOptions{ConnectingIP: net.ParseIP("1.2.3.4"), Compression: compression, MaxSendQueue: 1})
+
+		go func() {
+			_, _ = clientConn.Write(data)
+			_ = clientConn.Close()
+		}()
+		go func() {
+			// drain any control frame replies
+			_, _ = io.Copy(io.Discard, clientConn)
+		}()
+
+		// only panics are failures, malformed frames should just return an error
+		_, _, _ = cc.readRequest(context.Background(), time.Second)
+	})
+}
@@ -0,0 +1,659 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	"github.com/offchainlabs/nitro/arbos/arbostypes"
+	"github.com/offchainlabs/nitro/arbutil"
+	"github.com/offchainlabs/nitro/broadcaster/backlog"
+	m "github.com/offchainlabs/nitro/broadcaster/message"
+)
+
+func dummySeqNums(start, count int) []arbutil.MessageIndex {
+	seqNums := make([]arbutil.MessageIndex, count)
+	for i := range seqNums {
+		seqNums[i] = arbutil.MessageIndex(start + i)
+	}
+	return seqNums
+}
+
+// testFeedClient is a started ClientConnection along with the sequence numbers
+// received on the other end of its connection.
+type testFeedClient struct {
+	cc         *ClientConnection
+	registered chan struct{}
+	received   chan arbutil.MessageIndex
+}
+
+func startTestFeedClient(t *testing.T, ctx context.Context, bklg backlog.Backlog, requestedSeqNum arbutil.MessageIndex) *testFeedClient {
+	t.Helper()
+	client := &testFeedClient{
+		registered: make(chan struct{}),
+		received:   make(chan arbutil.MessageIndex, 1024),
+	}
+
+	// stand in for the ClientManager, which registers the client once the backlog has been sent
+	clientAction := make(chan ClientConnectionAction, 1)
+	go func() {
+		for action := range clientAction {
+			if action.create {
+				action.cc.Registered()
+				close(client.registered)
+			}
+		}
+	}()
+
+	serverConn, clientConn := net.Pipe()
+	client.cc = NewClientConnection(serverConn, nil, clientAction, ClientConnectionOptions{RequestedSeqNum: requestedSeqNum, ConnectingIP: net.ParseIP("1.2.3.4"), MaxSendQueue: 16, Backlog: bklg})
+	client.cc.Start(ctx)
+	t.Cleanup(func() {
+		client.cc.StopAndWait()
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	go func() {
+		defer close(client.received)
+		for {
+			data, _, err := wsutil.ReadServerData(clientConn)
+			if err != nil {
+				return
+			}
+			var bm m.BroadcastMessage
+			if err := json.Unmarshal(data, &bm); err != nil {
+				return
+			}
+			for _, msg := range bm.Messages {
+				client.received <- msg.SequenceNumber
+			}
+		}
+	}()
+	return client
+}
+
+func (c *testFeedClient) waitForRegistration(t *testing.T) {
+	t.Helper()
+	select {
+	case <-c.registered:
+	case <-time.After(5 * time.Second):
+		Fail(t, "client was not registered after backlog was sent")
+	}
+}
+
+// sendLive queues a message on the client as the ClientManager does when broadcasting
+func (c *testFeedClient) sendLive(t *testing.T, seqNum arbutil.MessageIndex) {
+	t.Helper()
+	bm := &m.BroadcastMessage{
+		Version:  m.V1,
+		Messages: m.CreateDummyBroadcastMessages([]arbutil.MessageIndex{seqNum}),
+	}
+	notCompressed, _, err := serializeMessage(bm, true, false)
+	Require(t, err)
+	c.cc.out <- message{
+		data:           notCompressed.Bytes(),
+		sequenceNumber: &seqNum,
+	}
+}
+
+func (c *testFeedClient) expectNext(t *testing.T, expected arbutil.MessageIndex) {
+	t.Helper()
+	select {
+	case seqNum, ok := <-c.received:
+		if !ok {
+			Fail(t, "connection closed while waiting for message", expected)
+		}
+		if seqNum != expected {
+			Fail(t, "received message", seqNum, "instead of", expected)
+		}
+	case <-time.After(5 * time.Second):
+		Fail(t, "timed out waiting for message", expected)
+	}
+}
+
+func TestClientConnectionBacklogCatchup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backlogCount := 512
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &backlog.DefaultTestConfig })
+	Require(t, bklg.Append(&m.BroadcastMessage{Messages: m.CreateDummyBroadcastMessages(dummySeqNums(0, backlogCount))}))
+
+	client := startTestFeedClient(t, ctx, bklg, 0)
+	for i := 0; i < backlogCount; i++ {
+		client.expectNext(t, arbutil.MessageIndex(i))
+	}
+	client.waitForRegistration(t)
+
+	// live messages must pick up directly after the backlog
+	for _, seqNum := range dummySeqNums(backlogCount, 8) {
+		client.sendLive(t, seqNum)
+		client.expectNext(t, seqNum)
+	}
+}
+
+func TestClientConnectionSendsFirstMessageLive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// with nothing in the backlog, the client has been sent nothing when
+	// message 0 is broadcast, so it mustn't be taken as already sent
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &backlog.DefaultTestConfig })
+	client := startTestFeedClient(t, ctx, bklg, 0)
+	client.waitForRegistration(t)
+	client.sendLive(t, 0)
+	client.expectNext(t, 0)
+	client.sendLive(t, 0)
+	client.sendLive(t, 1)
+	client.expectNext(t, 1)
+}
+
+func TestClientConnectionSkipsMessagesBeforeRequested(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &backlog.DefaultTestConfig })
+	client := startTestFeedClient(t, ctx, bklg, 5)
+	client.waitForRegistration(t)
+
+	client.sendLive(t, 4)
+	client.sendLive(t, 5)
+	client.expectNext(t, 5)
+}
+
+func TestClientConnectionSetDelay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &backlog.DefaultTestConfig })
+	client := startTestFeedClient(t, ctx, bklg, 0)
+	client.waitForRegistration(t)
+	client.sendLive(t, 0)
+	client.expectNext(t, 0)
+
+	delay := 200 * time.Millisecond
+	client.cc.SetDelay(delay, 0)
+	for _, seqNum := range dummySeqNums(1, 2) {
+		start := time.Now()
+		client.sendLive(t, seqNum)
+		client.expectNext(t, seqNum)
+		Expect(t, time.Since(start) >= delay, "message", seqNum, "sent after", time.Since(start), "instead of", delay)
+	}
+
+	// halving the delay after each message
+	client.cc.SetDelay(delay, 0.5)
+	start := time.Now()
+	for _, seqNum := range dummySeqNums(3, 3) {
+		client.sendLive(t, seqNum)
+		client.expectNext(t, seqNum)
+	}
+	decayed := delay + delay/2 + delay/4
+	Expect(t, time.Since(start) >= decayed, "decaying delay took", time.Since(start), "instead of", decayed)
+	Expect(t, time.Since(start) < 3*delay, "delay didn't decay, took", time.Since(start))
+
+	client.cc.SetDelay(0, 0)
+	start = time.Now()
+	client.sendLive(t, 6)
+	client.expectNext(t, 6)
+	Expect(t, time.Since(start) < delay, "message delayed", time.Since(start), "after delay was removed")
+}
+
+func TestClientConnectionDrainAndClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &backlog.DefaultTestConfig })
+	client := startTestFeedClient(t, ctx, bklg, 0)
+	client.waitForRegistration(t)
+	client.sendLive(t, 0)
+	client.expectNext(t, 0)
+
+	// stop the client thread so that messages are left queued, as they are
+	// when a client is removed
+	client.cc.StopAndWait()
+	client.sendLive(t, 1)
+	client.sendLive(t, 2)
+
+	start := time.Now()
+	client.cc.DrainAndClose(ws.StatusGoingAway, "going away")
+	// the test client echoes the close frame, so there's no need to wait out the timeout
+	Expect(t, time.Since(start) < closeEchoTimeout, "close took", time.Since(start), "despite the close frame being echoed")
+	client.expectNext(t, 1)
+	client.expectNext(t, 2)
+	select {
+	case seqNum, ok := <-client.received:
+		Expect(t, !ok, "received message", seqNum, "after close")
+	case <-time.After(5 * time.Second):
+		Fail(t, "connection not closed")
+	}
+}
+
+func TestClientConnectionCloseDropsQueued(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &backlog.DefaultTestConfig })
+	client := startTestFeedClient(t, ctx, bklg, 0)
+	client.waitForRegistration(t)
+	client.sendLive(t, 0)
+	client.expectNext(t, 0)
+
+	client.cc.StopAndWait()
+	client.sendLive(t, 1)
+	client.cc.Close()
+	select {
+	case seqNum, ok := <-client.received:
+		Expect(t, !ok, "received message", seqNum, "queued before a forced close")
+	case <-time.After(5 * time.Second):
+		Fail(t, "connection not closed")
+	}
+}
+
+// panickingBacklog panics when the client starts sending it
+type panickingBacklog struct {
+	backlog.Backlog
+}
+
+func (b panickingBacklog) Head() backlog.BacklogSegment {
+	panic("test panic")
+}
+
+func TestClientConnectionRemovedAfterPanic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientAction := make(chan ClientConnectionAction, 1)
+	serverConn, clientConn := net.Pipe()
+	defer func() { _ = serverConn.Close() }()
+	defer func() { _ = clientConn.Close() }()
+	cc := NewClientConnection(serverConn, nil, clientAction, ClientConnectionOptions{ConnectingIP: net.ParseIP("1.2.3.4"), MaxSendQueue: 16, Backlog: panickingBacklog{}})
+	cc.Start(ctx)
+	defer cc.StopAndWait()
+
+	select {
+	case action := <-clientAction:
+		Expect(t, action.cc == cc && !action.create, "client not removed after panic")
+	case <-time.After(5 * time.Second):
+		Fail(t, "client not removed after panic")
+	}
+}
+
+func TestClientConnectionHighPriorityFirst(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientAction := make(chan ClientConnectionAction, 1)
+	go func() {
+		for action := range clientAction {
+			if action.create {
+				action.cc.Registered()
+			}
+		}
+	}()
+	serverConn, clientConn := net.Pipe()
+	defer func() { _ = serverConn.Close() }()
+	defer func() { _ = clientConn.Close() }()
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &backlog.DefaultTestConfig })
+	normalCount := 100
+	cc := NewClientConnection(serverConn, nil, clientAction, ClientConnectionOptions{ConnectingIP: net.ParseIP("1.2.3.4"), MaxSendQueue: normalCount, Backlog: bklg})
+
+	// queue everything before the client is started, as if it had fallen behind
+	for _, seqNum := range dummySeqNums(0, normalCount) {
+		seqNum := seqNum
+		notCompressed, _, err := serializeMessage(&m.BroadcastMessage{
+			Version:  m.V1,
+			Messages: m.CreateDummyBroadcastMessages([]arbutil.MessageIndex{seqNum}),
+		}, true, false)
+		Require(t, err)
+		cc.out <- message{data: notCompressed.Bytes(), sequenceNumber: &seqNum}
+	}
+	notCompressed, _, err := serializeMessage(&m.BroadcastMessage{
+		Version:                        m.V1,
+		ConfirmedSequenceNumberMessage: &m.ConfirmedSequenceNumberMessage{SequenceNumber: 42},
+		Priority:                       m.PriorityHigh,
+	}, true, false)
+	Require(t, err)
+	cc.highPriority <- message{data: notCompressed.Bytes()}
+	cc.Start(ctx)
+	defer cc.StopAndWait()
+
+	Require(t, clientConn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for i := 0; i <= normalCount; i++ {
+		data, _, err := wsutil.ReadServerData(clientConn)
+		Require(t, err)
+		var bm m.BroadcastMessage
+		Require(t, json.Unmarshal(data, &bm))
+		if i == 0 {
+			Expect(t, bm.ConfirmedSequenceNumberMessage != nil && len(bm.Messages) == 0, "first message sent wasn't the high priority one:", string(data))
+		} else {
+			Expect(t, len(bm.Messages) == 1 && bm.Messages[0].SequenceNumber == arbutil.MessageIndex(i-1), "message", i, "sent out of order:", string(data))
+		}
+	}
+}
+
+// BenchmarkClientConnectionHighPriorityLatency measures how long a high
+// priority message waits to be written while the client's out queue is full.
+// It should only wait for the write already in progress, well under 100µs.
+func BenchmarkClientConnectionHighPriorityLatency(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientAction := make(chan ClientConnectionAction, 1)
+	go func() {
+		for action := range clientAction {
+			if action.create {
+				action.cc.Registered()
+			}
+		}
+	}()
+	serverConn, clientConn := net.Pipe()
+	defer func() { _ = serverConn.Close() }()
+	defer func() { _ = clientConn.Close() }()
+	highPriorityWritten := make(chan struct{})
+	go func() {
+		for {
+			data, _, err := wsutil.ReadServerData(clientConn)
+			if err != nil {
+				return
+			}
+			if bytes.Contains(data, []byte("confirmedSequenceNumberMessage")) {
+				highPriorityWritten <- struct{}{}
+			}
+		}
+	}()
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &backlog.DefaultTestConfig })
+	cc := NewClientConnection(serverConn, nil, clientAction, ClientConnectionOptions{ConnectingIP: net.ParseIP("1.2.3.4"), MaxSendQueue: 1024, Backlog: bklg})
+	cc.Start(ctx)
+	defer cc.StopAndWait()
+
+	// normal messages have no sequence number so they are always written
+	normal, _, err := serializeMessage(&m.BroadcastMessage{
+		Version:  m.V1,
+		Messages: m.CreateDummyBroadcastMessages(dummySeqNums(0, 1)),
+	}, true, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	highPriority, _, err := serializeMessage(&m.BroadcastMessage{
+		Version:                        m.V1,
+		ConfirmedSequenceNumberMessage: &m.ConfirmedSequenceNumberMessage{SequenceNumber: 42},
+		Priority:                       m.PriorityHigh,
+	}, true, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for len(cc.out) < cap(cc.out) {
+			cc.out <- message{data: normal.Bytes()}
+		}
+		b.StartTimer()
+		cc.highPriority <- message{data: highPriority.Bytes()}
+		<-highPriorityWritten
+	}
+}
+
+func TestClientConnectionNamesUnique(t *testing.T) {
+	cm := NewClientManager(nil, func() *BroadcasterConfig { return &DefaultTestBroadcasterConfig }, nil)
+	names := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		serverConn, clientConn := net.Pipe()
+		cc := NewClientConnection(serverConn, nil, cm.clientAction, ClientConnectionOptions{ConnectingIP: net.ParseIP("1.2.3.4"), MaxSendQueue: 1})
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+		if names[cc.Name] {
+			Fail(t, "duplicate client name", cc.Name, "after", i, "connections")
+		}
+		names[cc.Name] = true
+	}
+}
+
+func TestClientConnectionSendStats(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	cc := NewClientConnection(serverConn, nil, nil, ClientConnectionOptions{ConnectingIP: net.ParseIP("1.2.3.4"), MaxSendQueue: 1})
+	Expect(t, cc.GetLastSent().Unix() == 0, "last sent time set before anything was sent")
+
+	go func() {
+		_, _ = io.Copy(io.Discard, clientConn)
+	}()
+	data := []byte("hello")
+	Require(t, cc.writeRaw(data))
+	Require(t, cc.writeRaw(data))
+	Expect(t, cc.BytesSent.Load() == uint64(2*len(data)), "unexpected bytes sent", cc.BytesSent.Load())
+	Expect(t, cc.MessagesSent.Load() == 2, "unexpected messages sent", cc.MessagesSent.Load())
+	Expect(t, time.Since(cc.GetLastSent()) < time.Minute, "last sent time not updated")
+
+	_ = clientConn.Close()
+	Expect(t, cc.writeRaw(data) != nil, "write to closed connection succeeded")
+	Expect(t, cc.SendErrors.Load() == 1, "unexpected send errors", cc.SendErrors.Load())
+	Expect(t, cc.MessagesSent.Load() == 2, "failed write counted as sent")
+	_ = serverConn.Close()
+}
+
+func TestClientConnectionCompressionStats(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer func() { _ = serverConn.Close() }()
+	defer func() { _ = clientConn.Close() }()
+	go func() {
+		_, _ = io.Copy(io.Discard, clientConn)
+	}()
+	cc := NewClientConnection(serverConn, nil, nil, ClientConnectionOptions{ConnectingIP: net.ParseIP("1.2.3.4"), Compression: true, MaxSendQueue: 1})
+	Expect(t, cc.CompressionRatio() == 0, "compression ratio", cc.CompressionRatio(), "before anything was sent")
+
+	// the shape of a signed ERC-20 transfer: selector, recipient and amount
+	// words with their zero padding, then the signature
+	random := rand.New(rand.NewSource(1))
+	transfer := func() []byte {
+		l2msg := []byte{0xa9, 0x05, 0x9c, 0xbb}
+		l2msg = append(l2msg, make([]byte, 12)...)
+		l2msg = append(l2msg, randomBytes(random, 20)...)
+		l2msg = append(l2msg, make([]byte, 24)...)
+		l2msg = append(l2msg, randomBytes(random, 8)...)
+		return append(l2msg, randomBytes(random, 65)...)
+	}
+	timeBefore := TotalCompressionTime()
+	for i := 0; i < 1000; i++ {
+		notCompressed, compressed, err := serializeMessage(&m.BroadcastMessage{
+			Version: m.V1,
+			Messages: []*m.BroadcastFeedMessage{{
+				SequenceNumber: arbutil.MessageIndex(i),
+				Message: arbostypes.MessageWithMetadata{
+					Message: &arbostypes.L1IncomingMessage{
+						Header: &arbostypes.L1IncomingMessageHeader{},
+						L2msg:  transfer(),
+					},
+				},
+			}},
+		}, true, true)
+		Require(t, err)
+		Require(t, cc.WritePreSerialized(notCompressed.Bytes(), compressed.Bytes()))
+	}
+	ratio := cc.CompressionRatio()
+	Expect(t, ratio > 0.1 && ratio < 0.9, "unexpected compression ratio", ratio)
+	Expect(t, cc.CompressedBytes.Load() == cc.BytesSent.Load(), "compressed bytes", cc.CompressedBytes.Load(), "don't match the", cc.BytesSent.Load(), "bytes sent")
+	Expect(t, TotalCompressionTime() > timeBefore, "no compression time recorded")
+}
+
+func randomBytes(random *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	_, _ = random.Read(b)
+	return b
+}
+
+func BenchmarkClientConnectionWriteBroadcastMessage(b *testing.B) {
+	serverConn, clientConn := net.Pipe()
+	defer func() { _ = clientConn.Close() }()
+	defer func() { _ = serverConn.Close() }()
+	go func() {
+		_, _ = io.Copy(io.Discard, clientConn)
+	}()
+	cc := NewClientConnection(serverConn, nil, nil, ClientConnectionOptions{ConnectingIP: net.ParseIP("1.2.3.4"), MaxSendQueue: 1})
+	bm := &m.BroadcastMessage{
+		Version:  m.V1,
+		Messages: m.CreateDummyBroadcastMessages(dummySeqNums(0, 1)),
+	}
+
+	// a fresh buffer for every message, as before the buffers were pooled
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			notCompressed, _, err := serializeMessage(bm, true, false)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := cc.writeRaw(notCompressed.Bytes()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := cc.writeBroadcastMessage(bm); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestClientConnectionReadTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverConn, clientConn := net.Pipe()
+	defer func() { _ = clientConn.Close() }()
+	cc := NewClientConnection(serverConn, nil, nil, ClientConnectionOptions{ConnectingIP: net.ParseIP("1.2.3.4"), MaxSendQueue: 1})
+	timeout := 50 * time.Millisecond
+	send := func(p []byte) {
+		go func() {
+			_ = wsutil.WriteClientText(clientConn, p)
+		}()
+	}
+
+	send([]byte("hello"))
+	data, _, err := cc.readRequest(ctx, timeout)
+	Require(t, err)
+	Expect(t, string(data) == "hello", "read", string(data), "instead of hello")
+
+	// the deadline must be cleared after each read and set again for the next
+	time.Sleep(2 * timeout)
+	send([]byte("again"))
+	data, _, err = cc.readRequest(ctx, timeout)
+	Require(t, err)
+	Expect(t, string(data) == "again", "read", string(data), "instead of again")
+
+	// a peer that stops part way through a frame, as a half-open connection
+	// would, must not block the read past the timeout
+	frame := ws.MaskFrameInPlace(ws.NewTextFrame([]byte("never finished")))
+	var buf bytes.Buffer
+	Require(t, ws.WriteFrame(&buf, frame))
+	go func() {
+		_, _ = clientConn.Write(buf.Bytes()[:buf.Len()/2])
+	}()
+	start := time.Now()
+	_, _, err = cc.Receive(ctx, timeout)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		Fail(t, "read from stalled peer returned", err, "instead of a timeout")
+	}
+	Expect(t, time.Since(start) < 5*time.Second, "read took", time.Since(start), "with a timeout of", timeout)
+	_, err = serverConn.Write([]byte("x"))
+	Expect(t, err != nil, "connection left open after timing out")
+}
+
+func TestClientConnectionWriteTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// nothing reads from clientConn, so writes stall as they would with a
+	// peer whose receive buffer is full
+	serverConn, clientConn := net.Pipe()
+	defer func() { _ = clientConn.Close() }()
+	clientAction := make(chan ClientConnectionAction, 4)
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &backlog.DefaultTestConfig })
+	cc := NewClientConnection(writeDeadliner{serverConn, 50 * time.Millisecond}, nil, clientAction, ClientConnectionOptions{ConnectingIP: net.ParseIP("1.2.3.4"), MaxSendQueue: 16, Backlog: bklg})
+
+	err := cc.writeRaw([]byte("hello"))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		Fail(t, "stalled write returned", err, "instead of a timeout")
+	}
+
+	cc.Start(ctx)
+	defer cc.StopAndWait()
+	select {
+	case action := <-clientAction:
+		Expect(t, action.create, "client removed before registering")
+		cc.Registered()
+	case <-time.After(5 * time.Second):
+		Fail(t, "client did not register")
+	}
+	seqNum := arbutil.MessageIndex(1)
+	cc.out <- message{data: []byte("hello"), sequenceNumber: &seqNum}
+	select {
+	case action := <-clientAction:
+		Expect(t, !action.create && action.cc == cc, "stalled client was not removed")
+	case <-time.After(5 * time.Second):
+		Fail(t, "write goroutine did not give up on the stalled client")
+	}
+}
+
+// requireThreadsExit waits for every thread launched by cc to exit, without
+// stopping it, so that only the cancellation of its parent context can end them
+func requireThreadsExit(t *testing.T, cc *ClientConnection) {
+	t.Helper()
+	waitChan, err := cc.GetWaitChannel()
+	Require(t, err)
+	select {
+	case <-waitChan:
+	case <-time.After(5 * time.Second):
+		Fail(t, "client thread still running 5s after its parent context was canceled")
+	}
+}
+
+func TestClientConnectionExitsOnParentCancel(t *testing.T) {
+	t.Run("while delayed", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		serverConn, clientConn := net.Pipe()
+		defer func() { _ = clientConn.Close() }()
+		clientAction := make(chan ClientConnectionAction, 1)
+		cc := NewClientConnection(serverConn, nil, clientAction, ClientConnectionOptions{ConnectingIP: net.ParseIP("1.2.3.4"), MaxSendQueue: 16, Delay: time.Hour})
+		cc.Start(ctx)
+		defer cc.StopAndWait()
+
+		cancel()
+		requireThreadsExit(t, cc)
+		Expect(t, len(clientAction) == 0, "client registered despite being canceled during its delay")
+	})
+
+	t.Run("while streaming", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		bklg := backlog.NewBacklog(func() *backlog.Config { return &backlog.DefaultTestConfig })
+		client := startTestFeedClient(t, ctx, bklg, 0)
+		client.waitForRegistration(t)
+		client.sendLive(t, 0)
+		client.expectNext(t, 0)
+
+		cancel()
+		requireThreadsExit(t, client.cc)
+	})
+}
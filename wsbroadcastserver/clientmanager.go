@@ -10,7 +10,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"strings"
+	"net"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -37,8 +39,15 @@ var (
 	clientsTotalFailedUpgradeCounter = metrics.NewRegisteredCounter("arb/feed/clients/failed/upgrade", nil)
 	clientsTotalFailedWorkerCounter  = metrics.NewRegisteredCounter("arb/feed/clients/failed/worker", nil)
 	clientsDurationHistogram         = metrics.NewRegisteredHistogram("arb/feed/clients/duration", nil, metrics.NewBoundedHistogramSample())
+	clientsQueueDepthHistogram       = metrics.NewRegisteredHistogram("arb/feed/clients/queue/depth", nil, metrics.NewBoundedHistogramSample())
+	sequenceViolationsCounter        = metrics.NewRegisteredCounter("arb/feed/sequence/violations", nil)
+	pauseOverflowCounter             = metrics.NewRegisteredCounter("arb/feed/pause/overflow", nil)
 )
 
+// closeStatusServiceRestart is the registered websocket close code telling
+// clients that the server is restarting, gobwas/ws has no constant for it
+const closeStatusServiceRestart ws.StatusCode = 1012
+
 // ClientManager manages client connections
 type ClientManager struct {
 	stopwaiter.StopWaiter
@@ -53,11 +62,82 @@ type ClientManager struct {
 	backlog       backlog.Backlog
 
 	connectionLimiter *ConnectionLimiter
+	reconnectThrottle *reconnectThrottle
+	egress            *egressLimiter
+
+	messagesBroadcast atomic.Uint64
+	adminBroadcaster  *AdminBroadcaster
+	adminStatsRequest chan chan []ClientQueueDepth
+	snapshotRequest   chan snapshotRequest
+	shutdownRequest   chan orderedShutdownRequest
+	pauseRequest      chan bool
+	removeByIPRequest chan removeByIPRequest
+	clientsRequest    chan chan []*ClientConnection
+	evictSlowRequest  chan evictSlowRequest
+
+	// SequenceViolations counts broadcast messages whose sequence number
+	// didn't directly follow the previous one
+	SequenceViolations atomic.Uint64
+	// lastBroadcastSeqNum is only accessed from the ClientManager thread
+	lastBroadcastSeqNum *arbutil.MessageIndex
+	// latestSeqNum is lastBroadcastSeqNum for other threads
+	latestSeqNum atomic.Pointer[arbutil.MessageIndex]
+
+	// closing tracks the connections of removed clients that are still
+	// being closed
+	closing sync.WaitGroup
+
+	// resumePoints are where clients imported from another server's snapshot
+	// resume the feed, keyed by IP
+	resumePointsMutex sync.Mutex
+	resumePoints      map[string]resumePoint
+}
+
+// ClientStats is a point in time view of a single client connection
+type ClientStats struct {
+	Name       string
+	IP         net.IP
+	Age        time.Duration
+	QueueDepth int
+	BytesSent  uint64
+	LastHeard  time.Time
+
+	QueueCapacity    int
+	CompressionRatio float64
+}
+
+// QueuePercent is how full the client's send queue is, from 0 to 100
+func (s ClientStats) QueuePercent() float64 {
+	if s.QueueCapacity == 0 {
+		return 0
+	}
+	return 100 * float64(s.QueueDepth) / float64(s.QueueCapacity)
+}
+
+type orderedShutdownRequest struct {
+	batchSize  int
+	batchDelay time.Duration
+	done       chan struct{}
+}
+
+type snapshotRequest struct {
+	stats    []ClientStats
+	response chan []ClientStats
+}
+
+type evictSlowRequest struct {
+	queueDepthFraction float64
+	response           chan int
+}
+
+type removeByIPRequest struct {
+	ip       net.IP
+	response chan int
 }
 
 func NewClientManager(poller netpoll.Poller, configFetcher BroadcasterConfigFetcher, bklg backlog.Backlog) *ClientManager {
 	config := configFetcher()
-	return &ClientManager{
+	cm := &ClientManager{
 		poller:            poller,
 		pool:              gopool.NewPool(config.Workers, config.Queue, 1),
 		clientPtrMap:      make(map[*ClientConnection]bool),
@@ -66,7 +146,18 @@ func NewClientManager(poller netpoll.Poller, configFetcher BroadcasterConfigFetc
 		config:            configFetcher,
 		backlog:           bklg,
 		connectionLimiter: NewConnectionLimiter(func() *ConnectionLimiterConfig { return &configFetcher().ConnectionLimits }),
+		reconnectThrottle: newReconnectThrottle(),
+		egress:            newEgressLimiter(configFetcher),
+		adminStatsRequest: make(chan chan []ClientQueueDepth),
+		snapshotRequest:   make(chan snapshotRequest),
+		shutdownRequest:   make(chan orderedShutdownRequest),
+		pauseRequest:      make(chan bool),
+		removeByIPRequest: make(chan removeByIPRequest),
+		clientsRequest:    make(chan chan []*ClientConnection),
+		evictSlowRequest:  make(chan evictSlowRequest),
 	}
+	cm.adminBroadcaster = NewAdminBroadcaster(cm)
+	return cm
 }
 
 func (cm *ClientManager) registerClient(ctx context.Context, clientConnection *ClientConnection) error {
@@ -82,6 +173,10 @@ func (cm *ClientManager) registerClient(ctx context.Context, clientConnection *C
 		return fmt.Errorf("Connection limited %s", clientConnection.clientIp)
 	}
 
+	if cm.config().LogConnect {
+		log.Info("client registered", "client", clientConnection.Name, "remoteAddr", clientConnection.RemoteAddr(), "ip", clientConnection.clientIp)
+	}
+
 	clientsCurrentGauge.Inc(1)
 	clientsConnectCount.Inc(1)
 
@@ -96,25 +191,177 @@ func (cm *ClientManager) registerClient(ctx context.Context, clientConnection *C
 func (cm *ClientManager) removeAll() {
 	// Only called after main ClientManager thread exits, so remove client directly
 	for client := range cm.clientPtrMap {
-		cm.removeClientImpl(client)
+		cm.removeClientImpl(client, ws.StatusGoingAway, "going away")
+	}
+}
+
+// OrderedShutdown disconnects all clients, oldest first, in batches of
+// batchSize with batchDelay between batches, so that they don't all try to
+// reconnect at once. Each client is sent a close frame saying the server is
+// restarting. Clients that connect while it runs are left connected.
+func (cm *ClientManager) OrderedShutdown(batchSize int, batchDelay time.Duration) {
+	ctx, err := cm.GetContextSafe()
+	if err != nil {
+		// not running, so there are no clients to disconnect
+		return
+	}
+	request := orderedShutdownRequest{
+		batchSize:  batchSize,
+		batchDelay: batchDelay,
+		done:       make(chan struct{}),
+	}
+	select {
+	case <-ctx.Done():
+		return
+	case cm.shutdownRequest <- request:
+	}
+	select {
+	case <-ctx.Done():
+	case <-request.done:
+	}
+}
+
+// RemoveByIP disconnects every client connected from ip and returns how many
+// were removed. It doesn't stop the IP from reconnecting, for that it must
+// also be added to the ip-filter blacklist.
+func (cm *ClientManager) RemoveByIP(ip net.IP) int {
+	ctx, err := cm.GetContextSafe()
+	if err != nil {
+		// not running, so there are no clients to disconnect
+		return 0
+	}
+	request := removeByIPRequest{
+		ip:       ip,
+		response: make(chan int, 1),
+	}
+	select {
+	case <-ctx.Done():
+		return 0
+	case cm.removeByIPRequest <- request:
+	}
+	select {
+	case <-ctx.Done():
+		return 0
+	case removed := <-request.response:
+		return removed
+	}
+}
+
+// removeByIP must only be called from the ClientManager thread
+func (cm *ClientManager) removeByIP(ip net.IP) int {
+	var matching []*ClientConnection
+	for client := range cm.clientPtrMap {
+		if client.clientIp.Equal(ip) {
+			matching = append(matching, client)
+		}
+	}
+	for _, client := range matching {
+		cm.removeClient(client)
+	}
+	if len(matching) > 0 {
+		log.Info("removed clients by IP", "ip", ip, "count", len(matching))
+	}
+	return len(matching)
+}
+
+// EvictSlowConsumers disconnects every client whose send queue is more than
+// queueDepthFraction full, and returns how many were disconnected. It lets
+// operators shed load from a backed up server without waiting for
+// slow-consumer-timeout.
+func (cm *ClientManager) EvictSlowConsumers(queueDepthFraction float64) int {
+	if queueDepthFraction < 0 {
+		log.Warn("not evicting slow consumers, queue depth fraction must not be negative", "fraction", queueDepthFraction)
+		return 0
+	}
+	ctx, err := cm.GetContextSafe()
+	if err != nil {
+		// not running, so there are no clients to disconnect
+		return 0
+	}
+	request := evictSlowRequest{
+		queueDepthFraction: queueDepthFraction,
+		response:           make(chan int, 1),
+	}
+	select {
+	case <-ctx.Done():
+		return 0
+	case cm.evictSlowRequest <- request:
+	}
+	select {
+	case <-ctx.Done():
+		return 0
+	case evicted := <-request.response:
+		return evicted
+	}
+}
+
+// evictSlowConsumers must only be called from the ClientManager thread
+func (cm *ClientManager) evictSlowConsumers(queueDepthFraction float64) int {
+	var slow []*ClientConnection
+	for client := range cm.clientPtrMap {
+		if float64(client.QueueDepth()) > queueDepthFraction*float64(client.QueueCapacity()) {
+			slow = append(slow, client)
+		}
 	}
+	for _, client := range slow {
+		cm.removeClient(client)
+	}
+	if len(slow) > 0 {
+		log.Warn("evicted slow consumers", "fraction", queueDepthFraction, "count", len(slow))
+	}
+	return len(slow)
 }
 
-func (cm *ClientManager) removeClientImpl(clientConnection *ClientConnection) {
-	clientConnection.StopOnly()
+// removeInCreationOrder must only be called from the ClientManager thread
+func (cm *ClientManager) removeInCreationOrder(ctx context.Context, batchSize int, batchDelay time.Duration) {
+	clients := make([]*ClientConnection, 0, len(cm.clientPtrMap))
+	for client := range cm.clientPtrMap {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].creation.Before(clients[j].creation)
+	})
+	if batchSize <= 0 {
+		batchSize = len(clients)
+	}
+	for i, client := range clients {
+		if i > 0 && i%batchSize == 0 && batchDelay > 0 {
+			timer := time.NewTimer(batchDelay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+		cm.removeClientWithClose(client, closeStatusServiceRestart, "server restarting")
+	}
+}
 
+// removeClientImpl stops polling the client's connection and closes it. With
+// a close code, the client is closed gracefully: the messages queued for it
+// are sent, followed by the close frame. A code of zero closes the connection
+// at once, for clients removed because they fell behind or failed, which can't
+// take any more data. Closing waits on the client's thread, so it is done in
+// the background rather than holding up the ClientManager thread.
+func (cm *ClientManager) removeClientImpl(clientConnection *ClientConnection, code ws.StatusCode, reason string) {
 	err := cm.poller.Stop(clientConnection.desc)
 	if err != nil {
 		log.Warn("Failed to stop poller", "err", err)
 	}
 
-	err = clientConnection.conn.Close()
-	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
-		log.Warn("Failed to close client connection", "err", err)
-	}
+	cm.closing.Add(1)
+	go func() {
+		defer cm.closing.Done()
+		if code == 0 {
+			clientConnection.Close()
+		} else {
+			clientConnection.DrainAndClose(code, reason)
+		}
+	}()
 
 	if cm.config().LogDisconnect {
-		log.Info("client removed", "client", clientConnection.Name, "age", clientConnection.Age())
+		log.Info("client removed", "client", clientConnection.Name, "remoteAddr", clientConnection.RemoteAddr(), "age", clientConnection.Age())
 	}
 
 	clientsDurationHistogram.Update(clientConnection.Age().Microseconds())
@@ -123,19 +370,29 @@ func (cm *ClientManager) removeClientImpl(clientConnection *ClientConnection) {
 	atomic.AddInt32(&cm.clientCount, -1)
 }
 
+// removeClient removes a registered client, closing its connection at once
 func (cm *ClientManager) removeClient(clientConnection *ClientConnection) {
+	cm.removeClientWithClose(clientConnection, 0, "")
+}
+
+func (cm *ClientManager) removeClientWithClose(clientConnection *ClientConnection, code ws.StatusCode, reason string) {
 	if !cm.clientPtrMap[clientConnection] {
 		return
 	}
 
-	cm.removeClientImpl(clientConnection)
+	cm.removeClientImpl(clientConnection, code, reason)
 	if cm.config().ConnectionLimits.Enable {
 		cm.connectionLimiter.Release(clientConnection.clientIp)
 	}
-
 	delete(cm.clientPtrMap, clientConnection)
 }
 
+// LatestSeqNum returns the sequence number of the last message broadcast, or
+// nil if none has been. It may be called from any thread.
+func (cm *ClientManager) LatestSeqNum() *arbutil.MessageIndex {
+	return cm.latestSeqNum.Load()
+}
+
 func (cm *ClientManager) ClientCount() int32 {
 	return atomic.LoadInt32(&cm.clientCount)
 }
@@ -151,27 +408,83 @@ func (cm *ClientManager) Broadcast(bm *m.BroadcastMessage) {
 	cm.broadcastChan <- bm
 }
 
+// checkSequence drops messages that don't come after the last broadcast
+// message, which clients would ignore anyway. A gap is logged and counted but
+// the messages are still sent, as the backlog restarts from them, and dropping
+// them would stop the feed until the sequencer is restarted.
+func (cm *ClientManager) checkSequence(bm *m.BroadcastMessage) *m.BroadcastMessage {
+	messages := make([]*m.BroadcastFeedMessage, 0, len(bm.Messages))
+	for _, msg := range bm.Messages {
+		if cm.lastBroadcastSeqNum != nil && msg.SequenceNumber != *cm.lastBroadcastSeqNum+1 {
+			cm.SequenceViolations.Add(1)
+			sequenceViolationsCounter.Inc(1)
+			if msg.SequenceNumber <= *cm.lastBroadcastSeqNum {
+				log.Error("dropping broadcast message with out of order sequence number", "sequenceNumber", msg.SequenceNumber, "last", *cm.lastBroadcastSeqNum)
+				continue
+			}
+			log.Warn("gap in broadcast message sequence numbers", "sequenceNumber", msg.SequenceNumber, "last", *cm.lastBroadcastSeqNum)
+		}
+		seqNum := msg.SequenceNumber
+		cm.lastBroadcastSeqNum = &seqNum
+		cm.latestSeqNum.Store(&seqNum)
+		messages = append(messages, msg)
+	}
+	if len(messages) == len(bm.Messages) {
+		return bm
+	}
+	return &m.BroadcastMessage{
+		Version:                        bm.Version,
+		Messages:                       messages,
+		ConfirmedSequenceNumberMessage: bm.ConfirmedSequenceNumberMessage,
+	}
+}
+
 func (cm *ClientManager) doBroadcast(bm *m.BroadcastMessage) ([]*ClientConnection, error) {
+	checked := cm.checkSequence(bm)
+	if checked != bm && len(checked.Messages) == 0 && checked.ConfirmedSequenceNumberMessage == nil {
+		// every message was dropped, so there's nothing left to send
+		return nil, nil
+	}
+	bm = checked
 	if err := cm.backlog.Append(bm); err != nil {
 		return nil, err
 	}
+	cm.messagesBroadcast.Add(uint64(len(bm.Messages)))
 	config := cm.config()
+	if config.IncludeServerTimestamp {
+		bm.ServerTimestamp = time.Now().UnixNano()
+	}
+	if config.EnableChecksums && len(bm.Messages) > 0 {
+		checksum, err := m.MessagesChecksum(bm.Messages)
+		if err != nil {
+			return nil, err
+		}
+		bm.Checksum = &checksum
+	}
 	//                                        /-> wsutil.Writer -> not compressed msg buffer
 	// bm -> json.Encoder -> io.MultiWriter -|
 	//                                        \-> flateWriter -> wsutil.Writer -> compressed msg buffer
 
-	notCompressed, compressed, err := serializeMessage(bm, !config.RequireCompression, config.EnableCompression)
+	notCompressed, compressed, err := serializeMessage(bm, !config.RequireCompression || config.CompressionThreshold > 0, config.EnableCompression)
 	if err != nil {
 		return nil, err
 	}
+	// compressing small messages costs more CPU than it saves in bandwidth
+	belowCompressionThreshold := notCompressed.Len() < config.CompressionThreshold
 
 	sendQueueTooLargeCount := 0
 	clientDeleteList := make([]*ClientConnection, 0, len(cm.clientPtrMap))
 	for client := range cm.clientPtrMap {
 		var data []byte
+		var uncompressedLen int
 		if client.Compression() {
 			if config.EnableCompression {
-				data = compressed.Bytes()
+				if belowCompressionThreshold {
+					data = notCompressed.Bytes()
+				} else {
+					data = compressed.Bytes()
+					uncompressedLen = notCompressed.Len()
+				}
 			} else {
 				log.Warn("disconnecting because client has enabled compression, but compression support is disabled", "client", client.Name)
 				clientDeleteList = append(clientDeleteList, client)
@@ -197,12 +510,20 @@ func (cm *ClientManager) doBroadcast(bm *m.BroadcastMessage) ([]*ClientConnectio
 			return nil, fmt.Errorf("doBroadcast was sent %d BroadcastFeedMessages, it can only parse 1 BroadcastFeedMessage at a time", n)
 		}
 
+		// feed messages must stay in order, so only messages without any
+		// can jump the queue
+		queue := client.out
+		if bm.Priority > m.PriorityNormal && seqNum == nil {
+			queue = client.highPriority
+		}
 		m := message{
-			sequenceNumber: seqNum,
-			data:           data,
+			sequenceNumber:  seqNum,
+			data:            data,
+			uncompressedLen: uncompressedLen,
 		}
 		select {
-		case client.out <- m:
+		case queue <- m:
+			client.updateQueueBelowHalfTime()
 		default:
 			// Queue for client too backed up, disconnect instead of blocking on channel send
 			sendQueueTooLargeCount++
@@ -222,48 +543,90 @@ func (cm *ClientManager) doBroadcast(bm *m.BroadcastMessage) ([]*ClientConnectio
 }
 
 func serializeMessage(bm *m.BroadcastMessage, enableNonCompressedOutput, enableCompressedOutput bool) (bytes.Buffer, bytes.Buffer, error) {
+	var notCompressed bytes.Buffer
+	var compressed bytes.Buffer
+	if err := serializeMessageInto(bm, &notCompressed, &compressed, enableNonCompressedOutput, enableCompressedOutput); err != nil {
+		return bytes.Buffer{}, bytes.Buffer{}, err
+	}
+	return notCompressed, compressed, nil
+}
+
+// serializeBufferPool holds buffers for messages written to a single client.
+// Broadcast messages are shared by every client's send queue, so only buffers
+// that are finished with once the write returns may be put back.
+var serializeBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getSerializeBuffer() *bytes.Buffer {
+	//nolint:errcheck
+	buf := serializeBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putSerializeBuffer(buf *bytes.Buffer) {
+	serializeBufferPool.Put(buf)
+}
+
+// serializeMessageInto writes the websocket frames for bm to the given buffers
+func serializeMessageInto(bm *m.BroadcastMessage, notCompressed, compressed *bytes.Buffer, enableNonCompressedOutput, enableCompressedOutput bool) error {
 	flateWriter, err := flate.NewWriterDict(nil, DeflateCompressionLevel, GetStaticCompressorDictionary())
 	if err != nil {
-		return bytes.Buffer{}, bytes.Buffer{}, fmt.Errorf("unable to create flate writer: %w", err)
+		return fmt.Errorf("unable to create flate writer: %w", err)
 	}
 
-	var notCompressed bytes.Buffer
-	var compressed bytes.Buffer
 	writers := []io.Writer{}
+	compressionTime := &timedWriter{w: flateWriter}
 	var notCompressedWriter *wsutil.Writer
 	var compressedWriter *wsutil.Writer
 	if enableNonCompressedOutput {
-		notCompressedWriter = wsutil.NewWriter(&notCompressed, ws.StateServerSide, ws.OpText)
+		notCompressedWriter = wsutil.NewWriter(notCompressed, ws.StateServerSide, ws.OpText)
 		writers = append(writers, notCompressedWriter)
 	}
 	if enableCompressedOutput {
-		compressedWriter = wsutil.NewWriter(&compressed, ws.StateServerSide|ws.StateExtended, ws.OpText)
+		compressedWriter = wsutil.NewWriter(compressed, ws.StateServerSide|ws.StateExtended, ws.OpText)
 		var msg wsflate.MessageState
 		msg.SetCompressed(true)
 		compressedWriter.SetExtensions(&msg)
 		flateWriter.Reset(compressedWriter)
-		writers = append(writers, flateWriter)
+		writers = append(writers, compressionTime)
 	}
 
 	multiWriter := io.MultiWriter(writers...)
 	encoder := json.NewEncoder(multiWriter)
 	if err := encoder.Encode(bm); err != nil {
-		return bytes.Buffer{}, bytes.Buffer{}, fmt.Errorf("unable to encode message: %w", err)
+		return fmt.Errorf("unable to encode message: %w", err)
 	}
 	if notCompressedWriter != nil {
 		if err := notCompressedWriter.Flush(); err != nil {
-			return bytes.Buffer{}, bytes.Buffer{}, fmt.Errorf("unable to flush message: %w", err)
+			return fmt.Errorf("unable to flush message: %w", err)
 		}
 	}
 	if compressedWriter != nil {
+		start := time.Now()
 		if err := flateWriter.Close(); err != nil {
-			return bytes.Buffer{}, bytes.Buffer{}, fmt.Errorf("unable to close flate writer: %w", err)
+			return fmt.Errorf("unable to close flate writer: %w", err)
 		}
+		recordCompressionTime(compressionTime.elapsed + time.Since(start))
 		if err := compressedWriter.Flush(); err != nil {
-			return bytes.Buffer{}, bytes.Buffer{}, fmt.Errorf("unable to flush message: %w", err)
+			return fmt.Errorf("unable to flush message: %w", err)
 		}
 	}
-	return notCompressed, compressed, nil
+	return nil
+}
+
+// isSlowConsumer returns true if the client's send queue has stayed at least
+// half full for longer than the configured SlowConsumerTimeout.
+func (cm *ClientManager) isSlowConsumer(client *ClientConnection) bool {
+	timeout := cm.config().SlowConsumerTimeout
+	if timeout == 0 {
+		return false
+	}
+	client.updateQueueBelowHalfTime()
+	return time.Since(client.QueueBelowHalfTime()) > timeout
 }
 
 // verifyClients should be called every cm.config.ClientPingInterval
@@ -273,13 +636,21 @@ func (cm *ClientManager) verifyClients() []*ClientConnection {
 	// Create list of clients to remove
 	clientDeleteList := make([]*ClientConnection, 0, clientConnectionCount)
 
+	cm.reconnectThrottle.prune(time.Now(), cm.config().ReconnectThrottleWindow)
+	cm.pruneResumePoints(time.Now())
+
 	// Send ping to all connected clients
 	log.Debug("pinging clients", "count", len(cm.clientPtrMap))
 	for client := range cm.clientPtrMap {
+		// sampled at each ping, to show how close clients come to max-send-queue
+		clientsQueueDepthHistogram.Update(int64(client.QueueDepth()))
 		diff := time.Since(client.GetLastHeard())
 		if diff > cm.config().ClientTimeout {
 			log.Debug("disconnecting because connection timed out", "client", client.Name)
 			clientDeleteList = append(clientDeleteList, client)
+		} else if cm.isSlowConsumer(client) {
+			log.Warn("disconnecting slow consumer because send queue stayed at least half full", "client", client.Name, "queued", client.QueueDepth(), "since", client.QueueBelowHalfTime())
+			clientDeleteList = append(clientDeleteList, client)
 		} else {
 			err := client.Ping()
 			if err != nil {
@@ -292,9 +663,165 @@ func (cm *ClientManager) verifyClients() []*ClientConnection {
 	return clientDeleteList
 }
 
+// Snapshot returns the stats of every connected client. The stats are written
+// into the given slice, which is only grown if it is too small to hold them,
+// so callers polling regularly can reuse the returned slice between calls.
+func (cm *ClientManager) Snapshot(ctx context.Context, stats []ClientStats) ([]ClientStats, error) {
+	request := snapshotRequest{
+		stats:    stats,
+		response: make(chan []ClientStats, 1),
+	}
+	select {
+	case <-ctx.Done():
+		return stats, ctx.Err()
+	case cm.snapshotRequest <- request:
+	}
+	select {
+	case <-ctx.Done():
+		return stats, ctx.Err()
+	case stats = <-request.response:
+		return stats, nil
+	}
+}
+
+// MaxQueueDepth returns the deepest send queue of any connected client. It may
+// be called from any thread.
+func (cm *ClientManager) MaxQueueDepth() int {
+	maxDepth := 0
+	next := cm.Iterator()
+	for client, ok := next(); ok; client, ok = next() {
+		if depth := client.QueueDepth(); depth > maxDepth {
+			maxDepth = depth
+		}
+	}
+	return maxDepth
+}
+
+// Iterator returns a function yielding each client connected at the time of
+// the call, then nil and false once they have all been returned. The clients
+// are copied out of the ClientManager thread up front, so callers may take as
+// long as they like over each client without holding up broadcasts, but
+// clients may disconnect while being iterated over.
+func (cm *ClientManager) Iterator() func() (*ClientConnection, bool) {
+	var clients []*ClientConnection
+	if ctx, err := cm.GetContextSafe(); err == nil {
+		response := make(chan []*ClientConnection, 1)
+		select {
+		case <-ctx.Done():
+		case cm.clientsRequest <- response:
+			select {
+			case <-ctx.Done():
+			case clients = <-response:
+			}
+		}
+	}
+	next := 0
+	return func() (*ClientConnection, bool) {
+		if next >= len(clients) {
+			return nil, false
+		}
+		client := clients[next]
+		next++
+		return client, true
+	}
+}
+
+// clients must only be called from the ClientManager thread
+func (cm *ClientManager) clients() []*ClientConnection {
+	clients := make([]*ClientConnection, 0, len(cm.clientPtrMap))
+	for client := range cm.clientPtrMap {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// snapshot must only be called from the ClientManager thread
+func (cm *ClientManager) snapshot(stats []ClientStats) []ClientStats {
+	if cap(stats) < len(cm.clientPtrMap) {
+		stats = make([]ClientStats, 0, len(cm.clientPtrMap))
+	}
+	stats = stats[:0]
+	for client := range cm.clientPtrMap {
+		stats = append(stats, ClientStats{
+			Name:       client.Name,
+			IP:         client.clientIp,
+			Age:        client.Age(),
+			QueueDepth: client.QueueDepth(),
+			BytesSent:  client.BytesSent.Load(),
+			LastHeard:  client.GetLastHeard(),
+
+			QueueCapacity:    client.QueueCapacity(),
+			CompressionRatio: client.CompressionRatio(),
+		})
+	}
+	return stats
+}
+
+// broadcastSplit broadcasts each message in bm separately and returns the
+// clients to remove. It must only be called from the ClientManager thread.
+func (cm *ClientManager) broadcastSplit(bm *m.BroadcastMessage) []*ClientConnection {
+	var clientDeleteList []*ClientConnection
+	for i, msg := range bm.Messages {
+		m := &m.BroadcastMessage{
+			Version:  bm.Version,
+			Messages: []*m.BroadcastFeedMessage{msg},
+			Priority: bm.Priority,
+		}
+		// This ensures that only one message is sent with the confirmed sequence number
+		if i == 0 {
+			m.ConfirmedSequenceNumberMessage = bm.ConfirmedSequenceNumberMessage
+		}
+		toDelete, err := cm.doBroadcast(m)
+		logError(err, "failed to do broadcast")
+		clientDeleteList = append(clientDeleteList, toDelete...)
+	}
+
+	// A message with ConfirmedSequenceNumberMessage could be sent without any messages
+	// this section ensures that message is still sent.
+	if len(bm.Messages) == 0 {
+		toDelete, err := cm.doBroadcast(bm)
+		logError(err, "failed to do broadcast")
+		clientDeleteList = append(clientDeleteList, toDelete...)
+	}
+	return clientDeleteList
+}
+
+// Pause stops messages being sent to clients, for example while the sequencer
+// is being upgraded. Clients stay connected and keep being pinged. Broadcast
+// messages are buffered until Resume is called, up to max-pause-buffer of
+// them. Once the buffer is full, every client is disconnected and broadcasting
+// resumes, so that Broadcast never blocks the sequencer.
+func (cm *ClientManager) Pause() {
+	cm.setPaused(true)
+}
+
+// Resume sends the messages buffered while paused and resumes broadcasting
+func (cm *ClientManager) Resume() {
+	cm.setPaused(false)
+}
+
+func (cm *ClientManager) setPaused(paused bool) {
+	ctx, err := cm.GetContextSafe()
+	if err != nil {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case cm.pauseRequest <- paused:
+	}
+}
+
+// StopAndWait stops the ClientManager, which removes every client, and waits
+// for their connections to be closed
+func (cm *ClientManager) StopAndWait() {
+	cm.StopWaiter.StopAndWait()
+	cm.closing.Wait()
+}
+
 func (cm *ClientManager) Start(parentCtx context.Context) {
 	cm.StopWaiter.Start(parentCtx, cm)
 
+	cm.LaunchThread(cm.adminBroadcaster.Start)
 	cm.LaunchThread(func(ctx context.Context) {
 		defer cm.removeAll()
 
@@ -302,6 +829,8 @@ func (cm *ClientManager) Start(parentCtx context.Context) {
 		pingTimer := time.NewTimer(cm.config().Ping)
 		var clientDeleteList []*ClientConnection
 		defer pingTimer.Stop()
+		var paused bool
+		var pauseBuffer []*m.BroadcastMessage
 		for {
 			select {
 			case <-ctx.Done():
@@ -311,33 +840,66 @@ func (cm *ClientManager) Start(parentCtx context.Context) {
 					err := cm.registerClient(ctx, clientAction.cc)
 					if err != nil {
 						// Log message already output in registerClient
-						cm.removeClientImpl(clientAction.cc)
+						cm.removeClientImpl(clientAction.cc, 0, "")
 					}
 					clientAction.cc.Registered()
+				} else if clientAction.closeCode != 0 {
+					cm.removeClientWithClose(clientAction.cc, clientAction.closeCode, clientAction.closeReason)
 				} else {
+					if clientAction.disconnected && cm.clientPtrMap[clientAction.cc] {
+						// only clients closing the connection themselves are
+						// throttled, not those the relay removed
+						config := cm.config()
+						cm.reconnectThrottle.recordDisconnect(clientAction.cc.clientIp, time.Now(), config.ReconnectThrottleWindow, config.ReconnectThrottleExemptPrivate)
+					}
 					cm.removeClient(clientAction.cc)
 				}
 			case bm := <-cm.broadcastChan:
-				var err error
-				for i, msg := range bm.Messages {
-					m := &m.BroadcastMessage{
-						Version:  bm.Version,
-						Messages: []*m.BroadcastFeedMessage{msg},
+				if paused {
+					pauseBuffer = append(pauseBuffer, bm)
+					if len(pauseBuffer) >= cm.config().MaxPauseBuffer {
+						// rather than holding up the sequencer, the pause is
+						// given up: clients are disconnected so they don't
+						// take the buffered messages as live, and catch up on
+						// them from the backlog when they reconnect
+						log.Warn("pause buffer full, disconnecting clients and resuming broadcasting", "buffered", len(pauseBuffer))
+						pauseOverflowCounter.Inc(1)
+						for client := range cm.clientPtrMap {
+							cm.removeClientWithClose(client, ws.StatusGoingAway, "broadcasting paused for too long")
+						}
+						paused = false
+						for _, bm := range pauseBuffer {
+							clientDeleteList = append(clientDeleteList, cm.broadcastSplit(bm)...)
+						}
+						pauseBuffer = nil
 					}
-					// This ensures that only one message is sent with the confirmed sequence number
-					if i == 0 {
-						m.ConfirmedSequenceNumberMessage = bm.ConfirmedSequenceNumberMessage
-					}
-					clientDeleteList, err = cm.doBroadcast(m)
-					logError(err, "failed to do broadcast")
+				} else {
+					clientDeleteList = cm.broadcastSplit(bm)
 				}
-
-				// A message with ConfirmedSequenceNumberMessage could be sent without any messages
-				// this section ensures that message is still sent.
-				if len(bm.Messages) == 0 {
-					clientDeleteList, err = cm.doBroadcast(bm)
-					logError(err, "failed to do broadcast")
+			case pause := <-cm.pauseRequest:
+				if pause != paused {
+					log.Info("broadcasting paused", "paused", pause, "buffered", len(pauseBuffer))
+				}
+				paused = pause
+				if !paused {
+					for _, bm := range pauseBuffer {
+						clientDeleteList = append(clientDeleteList, cm.broadcastSplit(bm)...)
+					}
+					pauseBuffer = nil
 				}
+			case response := <-cm.adminStatsRequest:
+				response <- cm.topClientsByQueueDepth(adminTopClients)
+			case request := <-cm.snapshotRequest:
+				request.response <- cm.snapshot(request.stats)
+			case request := <-cm.shutdownRequest:
+				cm.removeInCreationOrder(ctx, request.batchSize, request.batchDelay)
+				close(request.done)
+			case request := <-cm.removeByIPRequest:
+				request.response <- cm.removeByIP(request.ip)
+			case request := <-cm.evictSlowRequest:
+				request.response <- cm.evictSlowConsumers(request.queueDepthFraction)
+			case response := <-cm.clientsRequest:
+				response <- cm.clients()
 			case <-pingTimer.C:
 				clientDeleteList = cm.verifyClients()
 				pingTimer.Reset(cm.config().Ping)
@@ -0,0 +1,321 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mailru/easygo/netpoll"
+
+	"github.com/offchainlabs/nitro/arbos/arbostypes"
+	"github.com/offchainlabs/nitro/broadcaster/backlog"
+	m "github.com/offchainlabs/nitro/broadcaster/message"
+)
+
+// newTestClientConnection creates a ClientConnection backed by an in-memory
+// pipe. Anything written to the client is discarded.
+func newTestClientConnection(t testing.TB, cm *ClientManager, maxSendQueue int) *ClientConnection {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+	go func() {
+		_, _ = io.Copy(io.Discard, clientConn)
+	}()
+	return NewClientConnection(serverConn, nil, cm.clientAction, ClientConnectionOptions{ConnectingIP: net.ParseIP("1.2.3.4"), MaxSendQueue: maxSendQueue})
+}
+
+func TestSlowConsumerEviction(t *testing.T) {
+	config := DefaultTestBroadcasterConfig
+	config.SlowConsumerTimeout = 100 * time.Millisecond
+	cm := NewClientManager(nil, func() *BroadcasterConfig { return &config }, nil)
+
+	cc := newTestClientConnection(t, cm, 4)
+	cm.clientPtrMap[cc] = true
+
+	Expect(t, len(cm.verifyClients()) == 0, "client with empty send queue was removed")
+
+	// Nothing reads from the out channel, so the queue stays full
+	for i := 0; i < cap(cc.out); i++ {
+		cc.out <- message{}
+	}
+	Expect(t, len(cm.verifyClients()) == 0, "slow consumer removed before timeout elapsed")
+
+	time.Sleep(config.SlowConsumerTimeout + 50*time.Millisecond)
+	clientDeleteList := cm.verifyClients()
+	Expect(t, len(clientDeleteList) == 1, "slow consumer not removed after timeout elapsed")
+	Expect(t, clientDeleteList[0] == cc, "wrong client removed")
+}
+
+func TestSlowConsumerEvictionDisabled(t *testing.T) {
+	config := DefaultTestBroadcasterConfig
+	config.SlowConsumerTimeout = 0
+	cm := NewClientManager(nil, func() *BroadcasterConfig { return &config }, nil)
+
+	cc := newTestClientConnection(t, cm, 4)
+	cm.clientPtrMap[cc] = true
+	for i := 0; i < cap(cc.out); i++ {
+		cc.out <- message{}
+	}
+	atomic.StoreInt64(&cc.queueBelowHalfUnixNano, time.Now().Add(-time.Hour).UnixNano())
+	Expect(t, len(cm.verifyClients()) == 0, "client removed with slow consumer eviction disabled")
+}
+
+func TestSlowConsumerEvictionQueueOfOne(t *testing.T) {
+	config := DefaultTestBroadcasterConfig
+	config.SlowConsumerTimeout = 100 * time.Millisecond
+	cm := NewClientManager(nil, func() *BroadcasterConfig { return &config }, nil)
+
+	cc := newTestClientConnection(t, cm, 1)
+	cm.clientPtrMap[cc] = true
+	time.Sleep(config.SlowConsumerTimeout + 50*time.Millisecond)
+	Expect(t, len(cm.verifyClients()) == 0, "client with empty send queue of one was removed")
+}
+
+func BenchmarkSerializeMessage(b *testing.B) {
+	for _, size := range []int{16, 128, 512, 4096, 32768} {
+		bm := &m.BroadcastMessage{
+			Version: m.V1,
+			Messages: []*m.BroadcastFeedMessage{{
+				SequenceNumber: 1,
+				Message: arbostypes.MessageWithMetadata{
+					Message: &arbostypes.L1IncomingMessage{
+						Header: &arbostypes.L1IncomingMessageHeader{},
+						L2msg:  make([]byte, size),
+					},
+				},
+			}},
+		}
+		b.Run(fmt.Sprintf("%d-bytes/uncompressed", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, _, err := serializeMessage(bm, true, false); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("%d-bytes/compressed", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, _, err := serializeMessage(bm, false, true); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestIdleClientEviction(t *testing.T) {
+	config := DefaultTestBroadcasterConfig
+	config.ClientTimeout = time.Minute
+	cm := NewClientManager(nil, func() *BroadcasterConfig { return &config }, nil)
+
+	idle := newTestClientConnection(t, cm, 4)
+	active := newTestClientConnection(t, cm, 4)
+	cm.clientPtrMap[idle] = true
+	cm.clientPtrMap[active] = true
+
+	Expect(t, len(cm.verifyClients()) == 0, "client removed before it was idle")
+
+	// the client hasn't been heard from for longer than the timeout
+	atomic.StoreInt64(&idle.lastHeardUnix, time.Now().Add(-config.ClientTimeout-time.Second).Unix())
+	clientDeleteList := cm.verifyClients()
+	Expect(t, len(clientDeleteList) == 1, "idle client not removed after timeout elapsed")
+	Expect(t, clientDeleteList[0] == idle, "wrong client removed")
+}
+
+func TestClientManagerSnapshotReusesSlice(t *testing.T) {
+	cm := NewClientManager(nil, func() *BroadcasterConfig { return &DefaultTestBroadcasterConfig }, nil)
+	for i := 0; i < 3; i++ {
+		cm.clientPtrMap[newTestClientConnection(t, cm, 4)] = true
+	}
+
+	stats := cm.snapshot(nil)
+	Expect(t, len(stats) == 3, "unexpected number of client stats", len(stats))
+	for _, s := range stats {
+		Expect(t, s.IP.Equal(net.ParseIP("1.2.3.4")), "unexpected client IP", s.IP)
+	}
+
+	reused := cm.snapshot(stats)
+	Expect(t, len(reused) == 3, "unexpected number of client stats", len(reused))
+	Expect(t, &reused[0] == &stats[0], "snapshot allocated a new slice when the given one was large enough")
+}
+
+func TestClientManagerSnapshotQueuePercent(t *testing.T) {
+	cm := NewClientManager(nil, func() *BroadcasterConfig { return &DefaultTestBroadcasterConfig }, nil)
+	cc := newTestClientConnection(t, cm, 4)
+	cm.clientPtrMap[cc] = true
+	// the client isn't started, so queued messages stay queued
+	cc.out <- message{data: []byte("hello")}
+
+	Expect(t, cc.QueueDepth() == 1, "unexpected queue depth", cc.QueueDepth())
+	Expect(t, cc.QueueCapacity() == 4, "unexpected queue capacity", cc.QueueCapacity())
+	stats := cm.snapshot(nil)
+	Expect(t, len(stats) == 1, "unexpected number of client stats", len(stats))
+	Expect(t, stats[0].QueuePercent() == 25, "queue reported", stats[0].QueuePercent(), "percent full instead of 25")
+	Expect(t, ClientStats{}.QueuePercent() == 0, "empty stats reported a full queue")
+}
+
+func BenchmarkClientManagerSnapshot(b *testing.B) {
+	cm := NewClientManager(nil, func() *BroadcasterConfig { return &DefaultTestBroadcasterConfig }, nil)
+	for i := 0; i < 10000; i++ {
+		cm.clientPtrMap[newTestClientConnection(b, cm, 4)] = true
+	}
+	stats := cm.snapshot(nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stats = cm.snapshot(stats)
+	}
+}
+
+func TestBroadcastSequenceViolations(t *testing.T) {
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &backlog.DefaultTestConfig })
+	cm := NewClientManager(nil, func() *BroadcasterConfig { return &DefaultTestBroadcasterConfig }, bklg)
+
+	broadcast := func(seqNum int) {
+		t.Helper()
+		_, err := cm.doBroadcast(&m.BroadcastMessage{
+			Version:  m.V1,
+			Messages: m.CreateDummyBroadcastMessages(dummySeqNums(seqNum, 1)),
+		})
+		Require(t, err)
+	}
+
+	// the first message sets the baseline
+	broadcast(5)
+	broadcast(6)
+	Expect(t, cm.SequenceViolations.Load() == 0, "in order messages counted as violations")
+
+	// messages at or before the last one are dropped
+	broadcast(6)
+	broadcast(3)
+	Expect(t, cm.SequenceViolations.Load() == 2, "unexpected violation count", cm.SequenceViolations.Load())
+	Expect(t, cm.messagesBroadcast.Load() == 2, "out of order messages were broadcast")
+	Expect(t, bklg.Count() == 2, "out of order messages were added to the backlog")
+
+	// a gap is counted, but its messages are still sent
+	broadcast(9)
+	broadcast(10)
+	Expect(t, cm.SequenceViolations.Load() == 3, "unexpected violation count", cm.SequenceViolations.Load())
+	Expect(t, cm.messagesBroadcast.Load() == 4, "messages after a gap were dropped")
+}
+
+// BenchmarkBroadcastFanOut compares serializing a broadcast once for all
+// clients, as doBroadcast does, with serializing it separately for each
+// client. At 10k clients a 1000 msg/s feed leaves 1ms per broadcast.
+func BenchmarkBroadcastFanOut(b *testing.B) {
+	clientCount := 10000
+	cm := NewClientManager(nil, func() *BroadcasterConfig { return &DefaultTestBroadcasterConfig }, nil)
+	for i := 0; i < clientCount; i++ {
+		cm.clientPtrMap[newTestClientConnection(b, cm, 1)] = true
+	}
+	drain := func() {
+		for client := range cm.clientPtrMap {
+			select {
+			case <-client.out:
+			default:
+			}
+		}
+	}
+
+	b.Run("per-client", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			bm := &m.BroadcastMessage{
+				Version:  m.V1,
+				Messages: m.CreateDummyBroadcastMessages(dummySeqNums(i, 1)),
+			}
+			for client := range cm.clientPtrMap {
+				notCompressed, _, err := serializeMessage(bm, true, false)
+				if err != nil {
+					b.Fatal(err)
+				}
+				client.out <- message{data: notCompressed.Bytes(), sequenceNumber: &bm.Messages[0].SequenceNumber}
+			}
+			b.StopTimer()
+			drain()
+			b.StartTimer()
+		}
+	})
+	b.Run("shared", func(b *testing.B) {
+		cm.backlog = backlog.NewBacklog(func() *backlog.Config { return &backlog.DefaultTestConfig })
+		cm.lastBroadcastSeqNum = nil
+		for i := 0; i < b.N; i++ {
+			clientDeleteList, err := cm.doBroadcast(&m.BroadcastMessage{
+				Version:  m.V1,
+				Messages: m.CreateDummyBroadcastMessages(dummySeqNums(i, 1)),
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(clientDeleteList) > 0 {
+				b.Fatal("clients removed during benchmark")
+			}
+			b.StopTimer()
+			drain()
+			b.StartTimer()
+		}
+	})
+}
+
+// nopPoller stands in for the server's poller for clients that aren't polled
+type nopPoller struct{}
+
+func (nopPoller) Start(*netpoll.Desc, netpoll.CallbackFn) error { return nil }
+func (nopPoller) Stop(*netpoll.Desc) error                      { return nil }
+func (nopPoller) Resume(*netpoll.Desc) error                    { return nil }
+
+func TestClientManagerStopWithFailingClients(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &backlog.DefaultTestConfig })
+	cm := NewClientManager(nopPoller{}, func() *BroadcasterConfig { return &DefaultTestBroadcasterConfig }, bklg)
+	cm.Start(ctx)
+
+	// more clients than clientAction can buffer
+	clientCount := 2 * cap(cm.clientAction)
+	clients := make([]*ClientConnection, 0, clientCount)
+	for i := 0; i < clientCount; i++ {
+		serverConn, clientConn := net.Pipe()
+		// every write to the client fails once the other end is closed
+		_ = clientConn.Close()
+		cc := NewClientConnection(serverConn, nil, cm.clientAction, ClientConnectionOptions{ConnectingIP: net.ParseIP("1.2.3.4"), MaxSendQueue: 1, Backlog: bklg})
+		cc.Start(ctx)
+		clients = append(clients, cc)
+	}
+	for cm.ClientCount() != int32(clientCount) {
+		select {
+		case <-ctx.Done():
+			Fail(t, "only", cm.ClientCount(), "of", clientCount, "clients registered")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	// with the ClientManager thread gone, nothing reads the removals the
+	// clients send once their writes fail
+	cm.StopOnly()
+	for _, cc := range clients {
+		select {
+		case cc.out <- message{data: []byte("hello")}:
+		default:
+		}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		cm.StopAndWait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		Fail(t, "ClientManager didn't stop with", clientCount, "clients failing writes")
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+var (
+	compressionTimer = metrics.NewRegisteredTimer("arb/feed/compression/duration", nil)
+
+	// totalCompressionTime is kept apart from compressionTimer so that it's
+	// available to admin clients whether or not metrics are enabled
+	totalCompressionTime atomic.Int64
+)
+
+// TotalCompressionTime is how long has been spent compressing messages, which
+// is done once for each broadcast and shared by all clients, along with once
+// for each client catching up from the backlog
+func TotalCompressionTime() time.Duration {
+	return time.Duration(totalCompressionTime.Load())
+}
+
+func recordCompressionTime(elapsed time.Duration) {
+	totalCompressionTime.Add(int64(elapsed))
+	compressionTimer.Update(elapsed)
+}
+
+// timedWriter adds the time spent writing to w to elapsed
+type timedWriter struct {
+	w       io.Writer
+	elapsed time.Duration
+}
+
+func (tw *timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := tw.w.Write(p)
+	tw.elapsed += time.Since(start)
+	return n, err
+}
+
+// recordCompression adds a message sent to the client compressed to its
+// compression stats
+func (cc *ClientConnection) recordCompression(uncompressedLen, compressedLen int) {
+	cc.UncompressedBytes.Add(uint64(uncompressedLen))
+	cc.CompressedBytes.Add(uint64(compressedLen))
+}
+
+// CompressionRatio is the size of the messages sent to the client compressed
+// relative to their uncompressed size, or 0 if none have been
+func (cc *ClientConnection) CompressionRatio() float64 {
+	uncompressed := cc.UncompressedBytes.Load()
+	if uncompressed == 0 {
+		return 0
+	}
+	return float64(cc.CompressedBytes.Load()) / float64(uncompressed)
+}
@@ -0,0 +1,69 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+var (
+	egressThrottleCounter = metrics.NewRegisteredCounter("arb/feed/egress/throttle", nil)
+)
+
+// egressLimiter is a token bucket, holding up to a second's worth of
+// max-egress-bits-per-second, shared by all of a ClientManager's clients.
+// Writes that find it empty are paused, so the broadcast server doesn't
+// saturate its network interface.
+type egressLimiter struct {
+	mutex  sync.Mutex
+	config BroadcasterConfigFetcher
+	tokens float64 // bytes
+	last   time.Time
+}
+
+func newEgressLimiter(config BroadcasterConfigFetcher) *egressLimiter {
+	return &egressLimiter{config: config}
+}
+
+// wait takes n bytes from the bucket. If that empties it, the caller is paused
+// until the bucket would have refilled, but for no longer than
+// egress-throttle-duration, so a cap set too low slows the feed rather than
+// stopping it.
+func (l *egressLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	config := l.config()
+	if config.MaxEgressBitsPerSecond == 0 {
+		return
+	}
+	bytesPerSecond := float64(config.MaxEgressBitsPerSecond) / 8
+
+	l.mutex.Lock()
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = bytesPerSecond
+	} else {
+		l.tokens = math.Min(bytesPerSecond, l.tokens+now.Sub(l.last).Seconds()*bytesPerSecond)
+	}
+	l.last = now
+	// the debt is bounded so a burst doesn't throttle writes for long after
+	l.tokens = math.Max(-bytesPerSecond, l.tokens-float64(n))
+	deficit := -l.tokens
+	l.mutex.Unlock()
+
+	if deficit <= 0 {
+		return
+	}
+	delay := time.Duration(deficit / bytesPerSecond * float64(time.Second))
+	if delay > config.EgressThrottleDuration {
+		delay = config.EgressThrottleDuration
+	}
+	egressThrottleCounter.Inc(1)
+	time.Sleep(delay)
+}
@@ -0,0 +1,56 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEgressLimiter(t *testing.T) {
+	config := DefaultTestBroadcasterConfig
+	config.MaxEgressBitsPerSecond = 8 * 1000
+	config.EgressThrottleDuration = 50 * time.Millisecond
+	limiter := newEgressLimiter(func() *BroadcasterConfig { return &config })
+
+	// the bucket starts full, so a second's worth of data isn't held up
+	throttled := egressThrottleCounter.Count()
+	limiter.wait(1000)
+	Expect(t, egressThrottleCounter.Count() == throttled, "write within the cap was throttled")
+
+	start := time.Now()
+	limiter.wait(500)
+	Expect(t, egressThrottleCounter.Count() == throttled+1, "write beyond the cap wasn't throttled")
+	paused := time.Since(start)
+	Expect(t, paused >= config.EgressThrottleDuration, "write was only paused for", paused)
+	Expect(t, paused < time.Second, "write was paused for", paused, "despite egress-throttle-duration of", config.EgressThrottleDuration)
+
+	config.MaxEgressBitsPerSecond = 0
+	throttled = egressThrottleCounter.Count()
+	limiter.wait(1 << 20)
+	Expect(t, egressThrottleCounter.Count() == throttled, "write was throttled with the cap disabled")
+}
+
+func TestClientConnectionEgressCap(t *testing.T) {
+	config := DefaultTestBroadcasterConfig
+	config.MaxEgressBitsPerSecond = 8 * 1024
+	cm := NewClientManager(nil, func() *BroadcasterConfig { return &config }, nil)
+
+	// the clients share the ClientManager's cap, so together they exceed it
+	throttled := egressThrottleCounter.Count()
+	data := make([]byte, 512)
+	for i := 0; i < 3; i++ {
+		serverConn, clientConn := net.Pipe()
+		defer func() { _ = clientConn.Close() }()
+		go func() {
+			_, _ = io.Copy(io.Discard, clientConn)
+		}()
+		cc := NewClientConnection(serverConn, nil, cm.clientAction, ClientConnectionOptions{ConnectingIP: net.ParseIP("1.2.3.4"), MaxSendQueue: 1})
+		cc.egress = cm.egress
+		Require(t, cc.writeRaw(data))
+	}
+	Expect(t, egressThrottleCounter.Count() > throttled, "writes beyond the shared egress cap weren't throttled")
+}
@@ -0,0 +1,110 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"net"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+
+	"github.com/offchainlabs/nitro/arbutil"
+)
+
+// resumePointTimeout is how long after a snapshot is imported its clients may
+// reconnect and resume the feed. Clients that take longer get the backlog.
+const resumePointTimeout = 5 * time.Minute
+
+// ClientSnapshot records how far through the feed a connected client had got,
+// so that a standby server taking over can resume the client from there.
+type ClientSnapshot struct {
+	IP     net.IP
+	SeqNum arbutil.MessageIndex // the last sequence number sent
+	// SeqNumSent is false if the client hadn't been sent any messages, in
+	// which case SeqNum is meaningless
+	SeqNumSent  bool
+	ConnectedAt time.Time
+}
+
+// resumePoint is where a client imported from a snapshot resumes the feed
+type resumePoint struct {
+	seqNum  arbutil.MessageIndex
+	expires time.Time
+}
+
+// ExportSnapshot returns where every connected client is in the feed. It may
+// be called from any thread.
+func (cm *ClientManager) ExportSnapshot() []ClientSnapshot {
+	var snapshots []ClientSnapshot
+	next := cm.Iterator()
+	for client, ok := next(); ok; client, ok = next() {
+		// seqNumSent is loaded first, as it is stored after LastSentSeqNum
+		seqNumSent := client.seqNumSent.Load()
+		snapshots = append(snapshots, ClientSnapshot{
+			IP:          client.clientIp,
+			SeqNum:      arbutil.MessageIndex(client.LastSentSeqNum.Load()),
+			SeqNumSent:  seqNumSent,
+			ConnectedAt: client.creation,
+		})
+	}
+	return snapshots
+}
+
+// ImportSnapshot sets where clients exported from another server resume the
+// feed. The next client to connect from each IP within resumePointTimeout
+// without requesting a sequence number starts after the last message sent to
+// that IP, instead of receiving the whole backlog. If several clients shared
+// an IP, the earliest sequence number is used so that none of them miss
+// messages.
+func (cm *ClientManager) ImportSnapshot(snapshots []ClientSnapshot) {
+	cm.resumePointsMutex.Lock()
+	defer cm.resumePointsMutex.Unlock()
+	if cm.resumePoints == nil {
+		cm.resumePoints = make(map[string]resumePoint)
+	}
+	expires := time.Now().Add(resumePointTimeout)
+	for _, snapshot := range snapshots {
+		if snapshot.IP == nil || !snapshot.SeqNumSent {
+			continue
+		}
+		key := snapshot.IP.String()
+		seqNum := snapshot.SeqNum + 1
+		if existing, ok := cm.resumePoints[key]; !ok || seqNum < existing.seqNum {
+			cm.resumePoints[key] = resumePoint{seqNum: seqNum, expires: expires}
+		}
+	}
+	log.Info("imported client snapshot", "clients", len(snapshots), "ips", len(cm.resumePoints))
+}
+
+// takeResumePoint returns and forgets the imported sequence number a client
+// connecting from ip at now should start from
+func (cm *ClientManager) takeResumePoint(ip net.IP, now time.Time) (arbutil.MessageIndex, bool) {
+	if ip == nil {
+		return 0, false
+	}
+	cm.resumePointsMutex.Lock()
+	defer cm.resumePointsMutex.Unlock()
+	key := ip.String()
+	point, ok := cm.resumePoints[key]
+	if !ok {
+		return 0, false
+	}
+	delete(cm.resumePoints, key)
+	if now.After(point.expires) {
+		return 0, false
+	}
+	return point.seqNum, true
+}
+
+// pruneResumePoints forgets resume points that expired before now, so IPs that
+// don't reconnect aren't remembered forever
+func (cm *ClientManager) pruneResumePoints(now time.Time) {
+	cm.resumePointsMutex.Lock()
+	defer cm.resumePointsMutex.Unlock()
+	for key, point := range cm.resumePoints {
+		if now.After(point.expires) {
+			delete(cm.resumePoints, key)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	"github.com/offchainlabs/nitro/arbutil"
+	"github.com/offchainlabs/nitro/broadcaster/backlog"
+	m "github.com/offchainlabs/nitro/broadcaster/message"
+)
+
+func startFailoverTestServer(t *testing.T, ctx context.Context) *WSBroadcastServer {
+	t.Helper()
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	config.IPFilter.TrustedProxies = []string{"127.0.0.0/8"}
+	config.IPFilter.TrustXForwardedFor = true
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	t.Cleanup(server.StopAndWait)
+	return server
+}
+
+func dialFailoverTestServer(t *testing.T, ctx context.Context, server *WSBroadcastServer, ip string) net.Conn {
+	t.Helper()
+	dialer := ws.Dialer{
+		Header: ws.HandshakeHeaderHTTP(http.Header{HTTPHeaderXForwardedFor: []string{ip}}),
+	}
+	conn, _, _, err := dialer.Dial(ctx, "ws://"+server.ListenerAddr().String())
+	Require(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func broadcastSeqNums(server *WSBroadcastServer, start, count int) {
+	for i := start; i < start+count; i++ {
+		server.Broadcast(&m.BroadcastMessage{
+			Version:  m.V1,
+			Messages: m.CreateDummyBroadcastMessages(dummySeqNums(i, 1)),
+		})
+	}
+}
+
+func firstSeqNum(t *testing.T, conn net.Conn) arbutil.MessageIndex {
+	t.Helper()
+	Require(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	data, _, err := wsutil.ReadServerData(conn)
+	Require(t, err)
+	var bm m.BroadcastMessage
+	Require(t, json.Unmarshal(data, &bm))
+	if len(bm.Messages) == 0 {
+		Fail(t, "first message from server carried no feed messages")
+	}
+	return bm.Messages[0].SequenceNumber
+}
+
+func TestClientSnapshotFailover(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	active := startFailoverTestServer(t, ctx)
+	broadcastSeqNums(active, 0, 10)
+	clientCount := 100
+	for i := 0; i < clientCount; i++ {
+		dialFailoverTestServer(t, ctx, active, fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+	for active.ClientCount() != int32(clientCount) {
+		select {
+		case <-ctx.Done():
+			Fail(t, "only", active.ClientCount(), "of", clientCount, "clients registered")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	broadcastSeqNums(active, 10, 5)
+	lastSeqNum := arbutil.MessageIndex(14)
+
+	var snapshots []ClientSnapshot
+	for {
+		snapshots = active.clientManager.ExportSnapshot()
+		caughtUp := len(snapshots) == clientCount
+		for _, snapshot := range snapshots {
+			caughtUp = caughtUp && snapshot.SeqNum == lastSeqNum
+		}
+		if caughtUp {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			Fail(t, "clients were not all sent message", lastSeqNum)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	for _, snapshot := range snapshots {
+		Expect(t, snapshot.SeqNumSent, "client", snapshot.IP, "not marked as sent messages")
+		Expect(t, snapshot.IP.To4() != nil && snapshot.IP.To4()[0] == 10, "unexpected client IP", snapshot.IP)
+		Expect(t, time.Since(snapshot.ConnectedAt) < time.Minute, "unexpected connection time", snapshot.ConnectedAt)
+	}
+	encoded, err := json.Marshal(snapshots)
+	Require(t, err)
+
+	standby := startFailoverTestServer(t, ctx)
+	broadcastSeqNums(standby, 0, 20)
+	for standby.backlog.Count() != 20 {
+		select {
+		case <-ctx.Done():
+			Fail(t, "standby backlog has", standby.backlog.Count(), "messages instead of 20")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	var imported []ClientSnapshot
+	Require(t, json.Unmarshal(encoded, &imported))
+	standby.clientManager.ImportSnapshot(imported)
+
+	// a client that was on the active server picks up after its last message,
+	// but only once, and clients that weren't get the whole backlog
+	resumed := dialFailoverTestServer(t, ctx, standby, "10.0.0.42")
+	Expect(t, firstSeqNum(t, resumed) == lastSeqNum+1, "resumed client didn't start after", lastSeqNum)
+	reconnected := dialFailoverTestServer(t, ctx, standby, "10.0.0.42")
+	Expect(t, firstSeqNum(t, reconnected) == 0, "resume point used twice")
+	unknown := dialFailoverTestServer(t, ctx, standby, "192.168.0.1")
+	Expect(t, firstSeqNum(t, unknown) == 0, "client not in snapshot didn't get the whole backlog")
+}
+
+func TestResumePoints(t *testing.T) {
+	cm := NewClientManager(nil, func() *BroadcasterConfig { return &DefaultTestBroadcasterConfig }, nil)
+	sentZero := net.ParseIP("1.2.3.4")
+	sentNothing := net.ParseIP("5.6.7.8")
+	expiring := net.ParseIP("9.10.11.12")
+	cm.ImportSnapshot([]ClientSnapshot{
+		{IP: sentZero, SeqNum: 0, SeqNumSent: true},
+		{IP: sentNothing, SeqNum: 0, SeqNumSent: false},
+		{IP: expiring, SeqNum: 7, SeqNumSent: true},
+	})
+
+	now := time.Now()
+	seqNum, ok := cm.takeResumePoint(sentZero, now)
+	Expect(t, ok && seqNum == 1, "client sent message 0 resumed from", seqNum, ok)
+	_, ok = cm.takeResumePoint(sentNothing, now)
+	Expect(t, !ok, "client sent nothing given a resume point")
+	_, ok = cm.takeResumePoint(expiring, now.Add(resumePointTimeout+time.Second))
+	Expect(t, !ok, "expired resume point used")
+
+	cm.ImportSnapshot([]ClientSnapshot{{IP: expiring, SeqNum: 7, SeqNumSent: true}})
+	cm.pruneResumePoints(now.Add(resumePointTimeout + time.Second))
+	Expect(t, len(cm.resumePoints) == 0, "expired resume points not pruned")
+}
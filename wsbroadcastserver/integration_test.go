@@ -0,0 +1,245 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"github.com/gobwas/ws/wsutil"
+
+	"github.com/offchainlabs/nitro/broadcaster/backlog"
+	m "github.com/offchainlabs/nitro/broadcaster/message"
+)
+
+// readFeed reads messages from a feed connection until count messages have been
+// received, checking that they arrive in order with no gaps or duplicates.
+func readFeed(conn net.Conn, count int) error {
+	next := 0
+	for next < count {
+		data, _, err := wsutil.ReadServerData(conn)
+		if err != nil {
+			return fmt.Errorf("error after %d messages: %w", next, err)
+		}
+		var bm m.BroadcastMessage
+		if err := json.Unmarshal(data, &bm); err != nil {
+			return err
+		}
+		for _, msg := range bm.Messages {
+			if int(msg.SequenceNumber) != next {
+				return fmt.Errorf("received message %d, expected %d", msg.SequenceNumber, next)
+			}
+			next++
+		}
+	}
+	return nil
+}
+
+func TestBroadcastServerFeedIntegration(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	clientCount := 10
+	messageCount := 10000
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	// this test checks delivery, not slow consumer handling, so let the
+	// producer run ahead of the clients without them being disconnected
+	config.MaxSendQueue = messageCount
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+
+	results := make(chan error, clientCount)
+	for i := 0; i < clientCount; i++ {
+		conn, _, _, err := ws.Dial(ctx, "ws://"+server.ListenerAddr().String())
+		Require(t, err)
+		defer func() { _ = conn.Close() }()
+		go func() {
+			results <- readFeed(conn, messageCount)
+		}()
+	}
+	for server.ClientCount() != int32(clientCount) {
+		select {
+		case <-ctx.Done():
+			Fail(t, "only", server.ClientCount(), "of", clientCount, "clients registered")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	go func() {
+		for i := 0; i < messageCount; i++ {
+			if ctx.Err() != nil {
+				return
+			}
+			server.Broadcast(&m.BroadcastMessage{
+				Version:  m.V1,
+				Messages: m.CreateDummyBroadcastMessages(dummySeqNums(i, 1)),
+			})
+		}
+	}()
+
+	for i := 0; i < clientCount; i++ {
+		select {
+		case err := <-results:
+			Require(t, err)
+		case <-ctx.Done():
+			Fail(t, "timed out waiting for clients to receive", messageCount, "messages")
+		}
+	}
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	config.EnableCompression = true
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+
+	dial := func(extensions []httphead.Option) net.Conn {
+		dialer := ws.Dialer{Extensions: extensions}
+		conn, _, hs, err := dialer.Dial(ctx, "ws://"+server.ListenerAddr().String())
+		Require(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		Expect(t, len(hs.Extensions) == len(extensions), "negotiated extensions", hs.Extensions, "when requesting", extensions)
+		return conn
+	}
+	compressedConn := dial([]httphead.Option{wsflate.DefaultParameters.Option()})
+	uncompressedConn := dial(nil)
+	for server.ClientCount() != 2 {
+		select {
+		case <-ctx.Done():
+			Fail(t, "only", server.ClientCount(), "of 2 clients registered")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	server.Broadcast(&m.BroadcastMessage{
+		Version:  m.V1,
+		Messages: m.CreateDummyBroadcastMessages(dummySeqNums(0, 1)),
+	})
+	for _, tc := range []struct {
+		name       string
+		conn       net.Conn
+		compressed bool
+	}{
+		{"compressed", compressedConn, true},
+		{"uncompressed", uncompressedConn, false},
+	} {
+		Require(t, tc.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		frame, err := ws.ReadFrame(tc.conn)
+		Require(t, err, tc.name)
+		Expect(t, frame.Header.OpCode == ws.OpText, tc.name, "client received", frame.Header.OpCode, "frame instead of text")
+		isCompressed, err := wsflate.IsCompressed(frame.Header)
+		Require(t, err, tc.name)
+		if isCompressed != tc.compressed {
+			Fail(t, tc.name, "client received a frame with compression", isCompressed)
+		}
+		if isCompressed {
+			frame, err = wsflate.DecompressFrame(frame)
+			Require(t, err, tc.name)
+		}
+		var bm m.BroadcastMessage
+		Require(t, json.Unmarshal(frame.Payload, &bm), tc.name)
+		Expect(t, len(bm.Messages) == 1 && bm.Messages[0].SequenceNumber == 0, tc.name, "client received unexpected messages", bm.Messages)
+	}
+}
+
+func TestServerTimestamp(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	config.IncludeServerTimestamp = true
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+
+	conn, _, _, err := ws.Dial(ctx, "ws://"+server.ListenerAddr().String())
+	Require(t, err)
+	defer func() { _ = conn.Close() }()
+	for server.ClientCount() != 1 {
+		select {
+		case <-ctx.Done():
+			Fail(t, "client not registered")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	server.Broadcast(&m.BroadcastMessage{
+		Version:  m.V1,
+		Messages: m.CreateDummyBroadcastMessages(dummySeqNums(0, 1)),
+	})
+	Require(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	data, _, err := wsutil.ReadServerData(conn)
+	Require(t, err)
+	var bm m.BroadcastMessage
+	Require(t, json.Unmarshal(data, &bm))
+	latency := time.Since(time.Unix(0, bm.ServerTimestamp))
+	Expect(t, latency >= 0 && latency < time.Second, "server timestamp", bm.ServerTimestamp, "is", latency, "from the time received")
+}
+
+func TestChecksums(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	config.EnableChecksums = true
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+
+	conn, _, _, err := ws.Dial(ctx, "ws://"+server.ListenerAddr().String())
+	Require(t, err)
+	defer func() { _ = conn.Close() }()
+	for server.ClientCount() != 1 {
+		select {
+		case <-ctx.Done():
+			Fail(t, "client not registered")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	server.Broadcast(&m.BroadcastMessage{
+		Version:  m.V1,
+		Messages: m.CreateDummyBroadcastMessages(dummySeqNums(0, 1)),
+	})
+	Require(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	data, _, err := wsutil.ReadServerData(conn)
+	Require(t, err)
+	var bm m.BroadcastMessage
+	Require(t, json.Unmarshal(data, &bm))
+	Expect(t, bm.Checksum != nil, "message sent without a checksum:", string(data))
+	Require(t, m.VerifyChecksum(data))
+
+	// a single byte changed in transit
+	corrupted := bytes.Replace(data, []byte(`"sequenceNumber":0`), []byte(`"sequenceNumber":1`), 1)
+	Expect(t, !bytes.Equal(corrupted, data), "sequence number not found in", string(data))
+	err = m.VerifyChecksum(corrupted)
+	Expect(t, errors.Is(err, m.ErrChecksumMismatch), "corrupted message not detected, got", err)
+}
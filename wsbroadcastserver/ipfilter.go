@@ -0,0 +1,196 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+	flag "github.com/spf13/pflag"
+)
+
+var (
+	clientsFilteredCounter = metrics.NewRegisteredCounter("arb/feed/clients/filtered", nil)
+)
+
+type IPFilterConfig struct {
+	Enable             bool     `koanf:"enable" reload:"hot"`
+	Whitelist          []string `koanf:"whitelist" reload:"hot"`
+	Blacklist          []string `koanf:"blacklist" reload:"hot"`
+	DefaultAllow       bool     `koanf:"default-allow" reload:"hot"`
+	TrustedProxies     []string `koanf:"trusted-proxies" reload:"hot"`
+	TrustXForwardedFor bool     `koanf:"trust-x-forwarded-for" reload:"hot"`
+
+	// RequireTrustedProxy ignores the client IP headers of peers that aren't
+	// in TrustedProxies. Off by default, as feeds behind Cloudflare rely on
+	// CF-Connecting-IP from Cloudflare's many edge IPs.
+	RequireTrustedProxy bool `koanf:"require-trusted-proxy" reload:"hot"`
+
+	// parsed holds the CIDR lists as parsed by Validate, so that they aren't
+	// parsed again on every handshake
+	parsed *parsedIPFilter
+}
+
+type parsedIPFilter struct {
+	whitelist      []*net.IPNet
+	blacklist      []*net.IPNet
+	trustedProxies []*net.IPNet
+}
+
+var DefaultIPFilterConfig = IPFilterConfig{
+	Enable:             false,
+	Whitelist:          []string{},
+	Blacklist:          []string{},
+	DefaultAllow:       false,
+	TrustedProxies:     []string{},
+	TrustXForwardedFor: false,
+
+	RequireTrustedProxy: false,
+}
+
+func IPFilterConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.Bool(prefix+".enable", DefaultIPFilterConfig.Enable, "enable filtering of feed clients by IP address")
+	f.StringSlice(prefix+".whitelist", DefaultIPFilterConfig.Whitelist, "CIDR ranges of clients that are allowed to connect")
+	f.StringSlice(prefix+".blacklist", DefaultIPFilterConfig.Blacklist, "CIDR ranges of clients that are never allowed to connect, takes precedence over the whitelist")
+	f.Bool(prefix+".default-allow", DefaultIPFilterConfig.DefaultAllow, "allow clients that match neither the whitelist nor the blacklist, must be set when only a blacklist is used")
+	f.StringSlice(prefix+".trusted-proxies", DefaultIPFilterConfig.TrustedProxies, "CIDR ranges of proxies whose "+HTTPHeaderCloudflareConnectingIP+" and "+HTTPHeaderXForwardedFor+" headers are used as the client IP when require-trusted-proxy is set, and whose "+HTTPHeaderXForwardedFor+" entries are skipped")
+	f.Bool(prefix+".trust-x-forwarded-for", DefaultIPFilterConfig.TrustXForwardedFor, "also take the client IP from the "+HTTPHeaderXForwardedFor+" header")
+	f.Bool(prefix+".require-trusted-proxy", DefaultIPFilterConfig.RequireTrustedProxy, "ignore the client IP headers of peers outside trusted-proxies, only enable once trusted-proxies lists every proxy in front of the server, such as Cloudflare's IP ranges")
+}
+
+func (c *IPFilterConfig) Validate() error {
+	parsed, err := c.parse()
+	if err != nil {
+		return err
+	}
+	if c.Enable && !c.DefaultAllow && len(parsed.whitelist) == 0 {
+		return errors.New("ip-filter with an empty whitelist and default-allow false would reject every client")
+	}
+	c.parsed = parsed
+	return nil
+}
+
+func (c *IPFilterConfig) parse() (*parsedIPFilter, error) {
+	whitelist, err := parseCIDRs(c.Whitelist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip-filter whitelist: %w", err)
+	}
+	blacklist, err := parseCIDRs(c.Blacklist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip-filter blacklist: %w", err)
+	}
+	trustedProxies, err := parseCIDRs(c.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip-filter trusted-proxies: %w", err)
+	}
+	return &parsedIPFilter{
+		whitelist:      whitelist,
+		blacklist:      blacklist,
+		trustedProxies: trustedProxies,
+	}, nil
+}
+
+// nets returns the parsed CIDR lists, parsing them if the config wasn't validated
+func (c *IPFilterConfig) nets() (*parsedIPFilter, error) {
+	if c.parsed != nil {
+		return c.parsed, nil
+	}
+	return c.parse()
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAllowed checks the blacklist, then the whitelist, and otherwise falls back
+// to the default policy. A nil IP is only allowed by the default policy.
+func (c *IPFilterConfig) IsAllowed(ip net.IP) (bool, error) {
+	if !c.Enable {
+		return true, nil
+	}
+	if ip == nil {
+		return c.DefaultAllow, nil
+	}
+	nets, err := c.nets()
+	if err != nil {
+		return false, err
+	}
+	if containsIP(nets.blacklist, ip) {
+		clientsFilteredCounter.Inc(1)
+		return false, nil
+	}
+	if containsIP(nets.whitelist, ip) {
+		return true, nil
+	}
+	if !c.DefaultAllow {
+		clientsFilteredCounter.Inc(1)
+	}
+	return c.DefaultAllow, nil
+}
+
+// forwardedIP returns the client IP reported in the CF-Connecting-IP or, if
+// trusted, the X-Forwarded-For header. With RequireTrustedProxy set, it
+// returns nil if peer isn't a trusted proxy, as any client can send these
+// headers.
+func (c *IPFilterConfig) forwardedIP(peer net.IP, cfConnectingIP net.IP, forwardedFor string) (net.IP, error) {
+	if peer == nil {
+		return nil, nil
+	}
+	nets, err := c.nets()
+	if err != nil {
+		return nil, err
+	}
+	if c.RequireTrustedProxy && !containsIP(nets.trustedProxies, peer) {
+		if cfConnectingIP != nil || (c.TrustXForwardedFor && forwardedFor != "") {
+			log.Warn("ignoring client IP header from peer that isn't in ip-filter.trusted-proxies, add the peer if it's a proxy in front of the server", "peerIP", peer, "cfConnectingIP", cfConnectingIP, "forwardedFor", forwardedFor)
+		}
+		return nil, nil
+	}
+	if cfConnectingIP != nil {
+		return cfConnectingIP, nil
+	}
+	if c.TrustXForwardedFor && forwardedFor != "" {
+		return forwardedForIP(forwardedFor, nets.trustedProxies), nil
+	}
+	return nil, nil
+}
+
+// forwardedForIP returns the originating client IP from an X-Forwarded-For
+// header value. Each proxy appends the address it received the request from,
+// so entries left of the last untrusted one may have been written by the
+// client itself. The rightmost entry that isn't a trusted proxy is used.
+func forwardedForIP(value string, trustedProxies []*net.IPNet) net.IP {
+	entries := strings.Split(value, ",")
+	for i := len(entries) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(entries[i]))
+		if ip == nil {
+			return nil
+		}
+		if i == 0 || !containsIP(trustedProxies, ip) {
+			return ip
+		}
+	}
+	return nil
+}
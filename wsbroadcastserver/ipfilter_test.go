@@ -0,0 +1,120 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	config := DefaultIPFilterConfig
+	config.Enable = true
+	config.Whitelist = []string{"10.0.0.0/8", "2001:db8::/32"}
+	config.Blacklist = []string{"10.1.0.0/16"}
+	Require(t, config.Validate())
+
+	testcases := []struct {
+		ip           string
+		defaultAllow bool
+		allowed      bool
+	}{
+		{"10.0.0.1", false, true},
+		{"10.1.2.3", true, false},
+		{"10.1.2.3", false, false},
+		{"2001:db8::1", false, true},
+		{"192.168.0.1", true, true},
+		{"192.168.0.1", false, false},
+	}
+	for _, tc := range testcases {
+		config.DefaultAllow = tc.defaultAllow
+		allowed, err := config.IsAllowed(net.ParseIP(tc.ip))
+		Require(t, err)
+		Expect(t, allowed == tc.allowed, "ip", tc.ip, "with default allow", tc.defaultAllow, "was allowed:", allowed)
+	}
+
+	config.Enable = false
+	config.DefaultAllow = false
+	allowed, err := config.IsAllowed(net.ParseIP("10.1.2.3"))
+	Require(t, err)
+	Expect(t, allowed, "disabled filter rejected client")
+}
+
+func TestIPFilterInvalidCIDR(t *testing.T) {
+	config := DefaultIPFilterConfig
+	config.Blacklist = []string{"10.0.0.1"}
+	if config.Validate() == nil {
+		Fail(t, "blacklist entry without prefix length was accepted")
+	}
+}
+
+func TestIPFilterRequiresWhitelistOrDefaultAllow(t *testing.T) {
+	config := DefaultIPFilterConfig
+	config.Enable = true
+	config.Blacklist = []string{"10.1.0.0/16"}
+	if config.Validate() == nil {
+		Fail(t, "filter rejecting every client was accepted")
+	}
+	config.DefaultAllow = true
+	Require(t, config.Validate())
+}
+
+func TestForwardedForIP(t *testing.T) {
+	trusted, err := parseCIDRs([]string{"10.0.0.0/8"})
+	Require(t, err)
+	Expect(t, forwardedForIP("203.0.113.7, 10.0.0.1", trusted).Equal(net.ParseIP("203.0.113.7")), "wrong client IP from list")
+	// a client can prepend anything, only the entries added by proxies count
+	Expect(t, forwardedForIP("1.1.1.1, 203.0.113.7", trusted).Equal(net.ParseIP("203.0.113.7")), "client written entry used")
+	Expect(t, forwardedForIP(" 2001:db8::1 ", trusted).Equal(net.ParseIP("2001:db8::1")), "wrong client IP from single entry")
+	Expect(t, forwardedForIP("10.0.0.2, 10.0.0.1", trusted).Equal(net.ParseIP("10.0.0.2")), "wrong client IP from proxies only")
+	Expect(t, forwardedForIP("unknown", trusted) == nil, "invalid entry parsed as IP")
+}
+
+func TestForwardedIPOnlyFromTrustedProxies(t *testing.T) {
+	config := DefaultIPFilterConfig
+	config.TrustedProxies = []string{"10.0.0.0/8"}
+	Require(t, config.Validate())
+
+	proxy := net.ParseIP("10.0.0.1")
+	other := net.ParseIP("192.168.0.1")
+	cfIP := net.ParseIP("203.0.113.7")
+	xffIP := net.ParseIP("198.51.100.2")
+
+	testcases := []struct {
+		peer           net.IP
+		cfConnectingIP net.IP
+		forwardedFor   string
+		trustXFF       bool
+		requireTrusted bool
+		expected       net.IP
+	}{
+		{proxy, cfIP, "", false, true, cfIP},
+		{proxy, cfIP, xffIP.String(), true, true, cfIP},
+		{proxy, nil, xffIP.String(), true, true, xffIP},
+		{proxy, nil, xffIP.String(), false, true, nil},
+		{other, cfIP, "", false, true, nil},
+		{other, nil, xffIP.String(), true, true, nil},
+		{nil, cfIP, "", false, true, nil},
+		// by default the headers of any peer are used, as Cloudflare's are
+		{other, cfIP, "", false, false, cfIP},
+		{other, nil, xffIP.String(), true, false, xffIP},
+		{other, nil, xffIP.String(), false, false, nil},
+	}
+	for i, tc := range testcases {
+		config.TrustXForwardedFor = tc.trustXFF
+		config.RequireTrustedProxy = tc.requireTrusted
+		ip, err := config.forwardedIP(tc.peer, tc.cfConnectingIP, tc.forwardedFor)
+		Require(t, err)
+		Expect(t, ip.Equal(tc.expected), "case", i, "took client IP", ip, "instead of", tc.expected)
+	}
+}
+
+func TestForwardedIPDefaultTrustsCloudflareHeader(t *testing.T) {
+	config := DefaultIPFilterConfig
+	Require(t, config.Validate())
+	cfIP := net.ParseIP("203.0.113.7")
+	ip, err := config.forwardedIP(net.ParseIP("104.16.0.1"), cfIP, "")
+	Require(t, err)
+	Expect(t, ip.Equal(cfIP), "default config took client IP", ip, "instead of", cfIP)
+}
@@ -0,0 +1,85 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/gobwas/ws"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// CloseStatusMigrate is the private use websocket close code telling a feed
+// client to reconnect to the broadcast server whose URL is the close reason.
+const CloseStatusMigrate ws.StatusCode = 4001
+
+// maxCloseReasonLength is what's left of a control frame's 125 byte payload
+// after the 2 byte close code
+const maxCloseReasonLength = 123
+
+// ValidateMigrationTarget checks that target is a websocket URL that fits in a
+// close frame
+func ValidateMigrationTarget(target string) error {
+	if len(target) > maxCloseReasonLength {
+		return fmt.Errorf("migration target %q is longer than %d bytes", target, maxCloseReasonLength)
+	}
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid migration target %q: %w", target, err)
+	}
+	if (parsed.Scheme != "ws" && parsed.Scheme != "wss") || parsed.Host == "" {
+		return fmt.Errorf("migration target %q is not a ws:// or wss:// URL", target)
+	}
+	return nil
+}
+
+// MigrateClient tells the client to reconnect to the broadcast server at
+// targetServerAddr, a ws:// or wss:// URL, and removes it from this one. The
+// client resumes from the message after the last one it received, so a
+// standby server carrying the same feed can take it over without losing
+// messages. An error is returned if the client is stopped before it can be
+// migrated.
+func (cc *ClientConnection) MigrateClient(targetServerAddr string) error {
+	if err := ValidateMigrationTarget(targetServerAddr); err != nil {
+		return err
+	}
+	ctx, err := cc.GetContextSafe()
+	if err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return errors.New("client stopped before it could be migrated")
+	case cc.clientAction <- ClientConnectionAction{
+		cc:          cc,
+		create:      false,
+		closeCode:   CloseStatusMigrate,
+		closeReason: targetServerAddr,
+	}:
+	}
+	return nil
+}
+
+// MigrateClients migrates every client of the server's own feed to the
+// broadcast server at targetServerAddr, and returns how many were migrated.
+// Clients of other chains' topics are left connected.
+func (s *WSBroadcastServer) MigrateClients(targetServerAddr string) (int, error) {
+	if err := ValidateMigrationTarget(targetServerAddr); err != nil {
+		return 0, err
+	}
+	migrated := 0
+	next := s.clientManager.Iterator()
+	for client, ok := next(); ok; client, ok = next() {
+		// clients that disconnect meanwhile aren't migrated
+		if err := client.MigrateClient(targetServerAddr); err != nil {
+			log.Debug("not migrating client", "client", client.Name, "err", err)
+			continue
+		}
+		migrated++
+	}
+	return migrated, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+
+	"github.com/offchainlabs/nitro/broadcaster/backlog"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	allowed := []string{"https://example.com", "https://*.arbitrum.io"}
+	testcases := []struct {
+		origin   string
+		expected bool
+	}{
+		{"https://example.com", true},
+		{"HTTPS://Example.com", true},
+		{"http://example.com", false},
+		{"https://example.com.evil.com", false},
+		{"https://feed.arbitrum.io", true},
+		{"https://a.b.arbitrum.io", true},
+		{"https://arbitrum.io", false},
+		{"https://evilarbitrum.io", false},
+		{"http://feed.arbitrum.io", false},
+	}
+	for _, tc := range testcases {
+		Expect(t, originAllowed(tc.origin, allowed) == tc.expected, "origin", tc.origin, "allowed:", !tc.expected)
+	}
+	Expect(t, originAllowed("https://anything.com", nil), "origin rejected with no allowed origins configured")
+	Expect(t, originAllowed("https://anything.com", []string{"*"}), "origin rejected by wildcard")
+}
+
+func TestOriginCheck(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	config.AllowedOrigins = []string{"https://example.com"}
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+
+	dial := func(origin string) error {
+		var dialer ws.Dialer
+		if origin != "" {
+			dialer.Header = ws.HandshakeHeaderHTTP(http.Header{HTTPHeaderOrigin: []string{origin}})
+		}
+		conn, _, _, err := dialer.Dial(ctx, "ws://"+server.ListenerAddr().String())
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err
+	}
+	Require(t, dial("https://example.com"), "allowed origin")
+	// clients other than browsers don't send an Origin
+	Require(t, dial(""), "no origin")
+	err := dial("https://evil.com")
+	var statusErr ws.StatusError
+	Expect(t, errors.As(err, &statusErr) && int(statusErr) == http.StatusForbidden, "disallowed origin was not rejected with 403:", err)
+}
@@ -0,0 +1,150 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// PROXY protocol headers are described in
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errProxyHeaderMissing = errors.New("connection did not start with a PROXY protocol header")
+)
+
+const (
+	// the longest possible v1 header, including the trailing CRLF
+	proxyV1MaxLength = 107
+
+	proxyV2HeaderLength = 16
+	proxyV2Version      = 0x2
+	proxyV2CommandLocal = 0x0
+	proxyV2CommandProxy = 0x1
+	proxyV2FamilyInet   = 0x1
+	proxyV2FamilyInet6  = 0x2
+)
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from the start of a
+// connection and returns the source address it carries. The IP is nil if the
+// proxy didn't pass on a client address, such as for its own health checks.
+// Only the header is read, so the rest of the connection can be handed to the
+// websocket upgrader as is.
+func readProxyHeader(r io.Reader) (net.IP, error) {
+	prefix := make([]byte, len(proxyV1Prefix))
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, proxyV1Prefix) {
+		return readProxyV1Header(r)
+	}
+	if bytes.Equal(prefix, proxyV2Signature[:len(prefix)]) {
+		return readProxyV2Header(r, prefix)
+	}
+	return nil, errProxyHeaderMissing
+}
+
+func readProxyV1Header(r io.Reader) (net.IP, error) {
+	// the header has no length prefix, so it must be read a byte at a time to
+	// avoid consuming the start of the websocket handshake
+	line := make([]byte, 0, proxyV1MaxLength)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line)+len(proxyV1Prefix) >= proxyV1MaxLength {
+			return nil, errors.New("PROXY v1 header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return nil, errors.New("empty PROXY v1 header")
+	}
+	switch fields[0] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v1 protocol %q", fields[0])
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[1])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid PROXY v1 source address %q", fields[1])
+	}
+	for _, address := range fields[1:3] {
+		if !proxyV1FamilyMatches(fields[0], address) {
+			return nil, fmt.Errorf("PROXY v1 address %q doesn't match protocol %s", address, fields[0])
+		}
+	}
+	return ip, nil
+}
+
+// proxyV1FamilyMatches returns whether address is written in the form the
+// protocol requires, dotted IPv4 for TCP4 and colon separated IPv6 for TCP6
+func proxyV1FamilyMatches(protocol string, address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	isIPv6 := strings.Contains(address, ":")
+	if protocol == "TCP4" {
+		return !isIPv6 && ip.To4() != nil
+	}
+	return isIPv6
+}
+
+func readProxyV2Header(r io.Reader, prefix []byte) (net.IP, error) {
+	header := make([]byte, proxyV2HeaderLength)
+	copy(header, prefix)
+	if _, err := io.ReadFull(r, header[len(prefix):]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(proxyV2Signature)], proxyV2Signature) {
+		return nil, errProxyHeaderMissing
+	}
+	versionCommand := header[12]
+	if versionCommand>>4 != proxyV2Version {
+		return nil, fmt.Errorf("unsupported PROXY v2 version %d", versionCommand>>4)
+	}
+	addresses := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, addresses); err != nil {
+		return nil, err
+	}
+
+	switch versionCommand & 0xf {
+	case proxyV2CommandLocal:
+		return nil, nil
+	case proxyV2CommandProxy:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", versionCommand&0xf)
+	}
+	switch header[13] >> 4 {
+	case proxyV2FamilyInet:
+		if len(addresses) < 2*net.IPv4len+4 {
+			return nil, errors.New("PROXY v2 header too short for IPv4 addresses")
+		}
+		return net.IP(addresses[:net.IPv4len]), nil
+	case proxyV2FamilyInet6:
+		if len(addresses) < 2*net.IPv6len+4 {
+			return nil, errors.New("PROXY v2 header too short for IPv6 addresses")
+		}
+		return net.IP(addresses[:net.IPv6len]), nil
+	default:
+		// unix sockets and unspecified families carry no client IP
+		return nil, nil
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+
+	"github.com/offchainlabs/nitro/broadcaster/backlog"
+)
+
+func proxyV2Header(command byte, family byte, addresses []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, proxyV2Version<<4|command, family<<4|0x1)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func proxyV2InetHeader(src net.IP) []byte {
+	addresses := append([]byte{}, src.To4()...)
+	addresses = append(addresses, net.ParseIP("10.0.0.1").To4()...)
+	addresses = binary.BigEndian.AppendUint16(addresses, 51234)
+	addresses = binary.BigEndian.AppendUint16(addresses, 9642)
+	return proxyV2Header(proxyV2CommandProxy, proxyV2FamilyInet, addresses)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	inet6Addresses := append(append([]byte{}, net.ParseIP("2001:db8::1")...), net.ParseIP("2001:db8::2")...)
+	inet6Addresses = append(inet6Addresses, 0, 1, 0, 2)
+
+	testcases := []struct {
+		name     string
+		header   []byte
+		expected net.IP
+		fail     bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 10.0.0.1 51234 9642\r\n"), net.ParseIP("192.0.2.1"), false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 51234 9642\r\n"), net.ParseIP("2001:db8::1"), false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), nil, false},
+		{"v1 bad address", []byte("PROXY TCP4 nonsense 10.0.0.1 51234 9642\r\n"), nil, true},
+		{"v1 tcp4 with ipv6 source", []byte("PROXY TCP4 2001:db8::1 10.0.0.1 51234 9642\r\n"), nil, true},
+		{"v1 tcp4 with ipv6 destination", []byte("PROXY TCP4 192.0.2.1 2001:db8::2 51234 9642\r\n"), nil, true},
+		{"v1 tcp6 with ipv4 source", []byte("PROXY TCP6 192.0.2.1 2001:db8::2 51234 9642\r\n"), nil, true},
+		{"v1 too long", append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), 200)...), nil, true},
+		{"v2 inet", proxyV2InetHeader(net.ParseIP("192.0.2.1")), net.ParseIP("192.0.2.1"), false},
+		{"v2 inet6", proxyV2Header(proxyV2CommandProxy, proxyV2FamilyInet6, inet6Addresses), net.ParseIP("2001:db8::1"), false},
+		{"v2 local", proxyV2Header(proxyV2CommandLocal, 0, nil), nil, false},
+		{"v2 truncated addresses", proxyV2Header(proxyV2CommandProxy, proxyV2FamilyInet, []byte{192, 0, 2}), nil, true},
+		{"missing header", []byte("GET / HTTP/1.1\r\n"), nil, true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			rest := []byte("GET / HTTP/1.1\r\n")
+			r := bytes.NewReader(append(append([]byte{}, tc.header...), rest...))
+			ip, err := readProxyHeader(r)
+			if tc.fail {
+				Expect(t, err != nil, "malformed header accepted")
+				return
+			}
+			Require(t, err)
+			Expect(t, ip.Equal(tc.expected), "parsed source address", ip, "instead of", tc.expected)
+			unread, err := io.ReadAll(r)
+			Require(t, err)
+			Expect(t, bytes.Equal(unread, rest), "header parsing consumed data after the header")
+		})
+	}
+}
+
+func TestProxyProtocolClientIP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	config.ProxyProtocol = true
+	// the load balancer is trusted, but the client behind it isn't
+	config.IPFilter.TrustedProxies = []string{"127.0.0.0/8"}
+	config.IPFilter.TrustXForwardedFor = true
+	config.IPFilter.RequireTrustedProxy = true
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+
+	clientIP := net.ParseIP("192.0.2.1")
+	dialer := ws.Dialer{
+		// headers the client sends through the load balancer mustn't override
+		// the address in the PROXY header
+		Header: ws.HandshakeHeaderHTTP(http.Header{
+			HTTPHeaderCloudflareConnectingIP: []string{"203.0.113.7"},
+			HTTPHeaderXForwardedFor:          []string{"198.51.100.2"},
+		}),
+		NetDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			// stand in for the load balancer
+			if _, err := conn.Write(proxyV2InetHeader(clientIP)); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		},
+	}
+	conn, _, _, err := dialer.Dial(ctx, "ws://"+server.ListenerAddr().String())
+	Require(t, err)
+	defer func() { _ = conn.Close() }()
+
+	var stats []ClientStats
+	for len(stats) == 0 {
+		stats, err = server.clientManager.Snapshot(ctx, stats)
+		Require(t, err)
+		time.Sleep(time.Millisecond)
+	}
+	Expect(t, stats[0].IP.Equal(clientIP), "client IP", stats[0].IP, "instead of", clientIP)
+
+	// connections without the header are refused
+	_, _, _, err = ws.Dial(ctx, "ws://"+server.ListenerAddr().String())
+	Expect(t, err != nil, "connection without PROXY header accepted")
+}
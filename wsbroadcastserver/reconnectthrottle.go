@@ -0,0 +1,104 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+var (
+	clientsThrottledCounter = metrics.NewRegisteredCounter("arb/feed/clients/throttled", nil)
+)
+
+const (
+	// reconnectThrottleRetryAfter is how long a client that keeps reconnecting
+	// is told to wait before trying again
+	reconnectThrottleRetryAfter = time.Second
+	// reconnectThrottleRejectAfter is how many disconnects within the window
+	// cause an IP's connections to be rejected whatever reconnect-throttle-max
+	// is, and is the most remembered for an IP
+	reconnectThrottleRejectAfter = 10
+)
+
+// reconnectThrottle remembers when clients from each IP recently disconnected,
+// so that clients stuck in a connect/disconnect loop can be slowed down.
+type reconnectThrottle struct {
+	mutex       sync.Mutex
+	disconnects map[string][]time.Time
+}
+
+func newReconnectThrottle() *reconnectThrottle {
+	return &reconnectThrottle{
+		disconnects: make(map[string][]time.Time),
+	}
+}
+
+// throttled reports whether ip should be throttled. If exemptPrivate is set,
+// private and loopback addresses are never throttled, for when they are a
+// proxy in front of the relay rather than a client.
+func throttled(ip net.IP, exemptPrivate bool) bool {
+	if ip == nil {
+		return false
+	}
+	return !exemptPrivate || (!ip.IsPrivate() && !ip.IsLoopback())
+}
+
+// recordDisconnect notes that a client from ip disconnected at now. Only the
+// most recent reconnectThrottleRejectAfter disconnects are needed.
+func (r *reconnectThrottle) recordDisconnect(ip net.IP, now time.Time, window time.Duration, exemptPrivate bool) {
+	if window <= 0 || !throttled(ip, exemptPrivate) {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	key := ip.String()
+	recent := append(r.recentLocked(key, now, window), now)
+	if len(recent) > reconnectThrottleRejectAfter {
+		recent = recent[len(recent)-reconnectThrottleRejectAfter:]
+	}
+	r.disconnects[key] = recent
+}
+
+// recentDisconnects returns how many times clients from ip disconnected within
+// window before now
+func (r *reconnectThrottle) recentDisconnects(ip net.IP, now time.Time, window time.Duration, exemptPrivate bool) int {
+	if window <= 0 || !throttled(ip, exemptPrivate) {
+		return 0
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.recentLocked(ip.String(), now, window))
+}
+
+// recentLocked drops disconnects older than window from the IP's list and
+// returns what's left. The mutex must be held.
+func (r *reconnectThrottle) recentLocked(key string, now time.Time, window time.Duration) []time.Time {
+	times := r.disconnects[key]
+	cutoff := now.Add(-window)
+	start := 0
+	for start < len(times) && !times[start].After(cutoff) {
+		start++
+	}
+	times = times[start:]
+	if len(times) == 0 {
+		delete(r.disconnects, key)
+		return nil
+	}
+	r.disconnects[key] = times
+	return times
+}
+
+// prune forgets IPs with no disconnects within window, so IPs that don't
+// reconnect aren't remembered forever
+func (r *reconnectThrottle) prune(now time.Time, window time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for key := range r.disconnects {
+		r.recentLocked(key, now, window)
+	}
+}
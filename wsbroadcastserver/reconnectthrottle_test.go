@@ -0,0 +1,147 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+
+	"github.com/offchainlabs/nitro/broadcaster/backlog"
+)
+
+func TestReconnectThrottleWindow(t *testing.T) {
+	throttle := newReconnectThrottle()
+	ip := net.ParseIP("1.2.3.4")
+	window := time.Minute
+	start := time.Now()
+	for i := 0; i < 2*reconnectThrottleRejectAfter; i++ {
+		throttle.recordDisconnect(ip, start.Add(time.Duration(i)*time.Second), window, true)
+	}
+	now := start.Add(time.Duration(2*reconnectThrottleRejectAfter) * time.Second)
+	Expect(t, throttle.recentDisconnects(ip, now, window, true) == reconnectThrottleRejectAfter, "disconnects not capped at", reconnectThrottleRejectAfter)
+	Expect(t, throttle.recentDisconnects(net.ParseIP("5.6.7.8"), now, window, true) == 0, "disconnects counted for another IP")
+	Expect(t, throttle.recentDisconnects(ip, now.Add(window), window, true) == 0, "disconnects outside the window counted")
+
+	throttle.recordDisconnect(net.ParseIP("10.0.0.1"), now, window, true)
+	throttle.recordDisconnect(net.ParseIP("127.0.0.1"), now, window, true)
+	throttle.recordDisconnect(ip, now, 0, true)
+	throttle.prune(now.Add(window), window)
+	Expect(t, len(throttle.disconnects) == 0, "throttle still tracking", len(throttle.disconnects), "IPs")
+
+	// private addresses are only exempt if configured to be
+	private := net.ParseIP("10.0.0.1")
+	throttle.recordDisconnect(private, now, window, false)
+	Expect(t, throttle.recentDisconnects(private, now, window, false) == 1, "disconnect from private address not counted")
+	Expect(t, throttle.recentDisconnects(private, now, window, true) == 0, "disconnect from exempt private address counted")
+	throttle.prune(now.Add(window), window)
+	Expect(t, len(throttle.disconnects) == 0, "throttle still tracking", len(throttle.disconnects), "IPs")
+}
+
+func TestReconnectThrottle(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	config.IPFilter.TrustedProxies = []string{"127.0.0.0/8"}
+	config.IPFilter.TrustXForwardedFor = true
+	// long enough that earlier disconnects don't expire during the test
+	config.ReconnectThrottleWindow = time.Minute
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+
+	ip := net.ParseIP("1.2.3.4")
+	var retryAfter string
+	dialer := ws.Dialer{
+		Header: ws.HandshakeHeaderHTTP(http.Header{HTTPHeaderXForwardedFor: []string{ip.String()}}),
+		OnStatusError: func(status int, reason []byte, resp io.Reader) {
+			response, err := http.ReadResponse(bufio.NewReader(resp), nil)
+			if err == nil {
+				retryAfter = response.Header.Get("Retry-After")
+			}
+		},
+	}
+	waitFor := func(condition func() bool, failure ...interface{}) {
+		t.Helper()
+		for !condition() {
+			select {
+			case <-ctx.Done():
+				Fail(t, failure...)
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+	for attempt := 1; attempt <= config.ReconnectThrottleMax+3; attempt++ {
+		retryAfter = ""
+		start := time.Now()
+		conn, _, _, err := dialer.Dial(ctx, "ws://"+server.ListenerAddr().String())
+		if attempt > config.ReconnectThrottleMax+1 {
+			var statusErr ws.StatusError
+			Expect(t, errors.As(err, &statusErr) && int(statusErr) == http.StatusTooManyRequests, "attempt", attempt, "was not rejected with 429:", err)
+			Expect(t, retryAfter == "1", "attempt", attempt, "rejected with Retry-After", retryAfter)
+			// the handshake is rejected at once rather than held up
+			Expect(t, time.Since(start) < reconnectThrottleRetryAfter, "attempt", attempt, "rejected after", time.Since(start))
+			continue
+		}
+		Require(t, err, "attempt", attempt)
+		waitFor(func() bool { return server.ClientCount() == 1 }, "attempt", attempt, "not registered")
+		_ = conn.Close()
+		waitFor(func() bool {
+			return server.clientManager.reconnectThrottle.recentDisconnects(ip, time.Now(), config.ReconnectThrottleWindow, config.ReconnectThrottleExemptPrivate) == attempt
+		}, "attempt", attempt, "disconnect not recorded")
+	}
+}
+
+func TestReconnectThrottleIgnoresServerRemovals(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	config.IPFilter.TrustedProxies = []string{"127.0.0.0/8"}
+	config.IPFilter.TrustXForwardedFor = true
+	config.ReconnectThrottleWindow = time.Minute
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+
+	ip := net.ParseIP("1.2.3.4")
+	dialer := ws.Dialer{
+		Header: ws.HandshakeHeaderHTTP(http.Header{HTTPHeaderXForwardedFor: []string{ip.String()}}),
+	}
+	conn, _, _, err := dialer.Dial(ctx, "ws://"+server.ListenerAddr().String())
+	Require(t, err)
+	defer func() { _ = conn.Close() }()
+	for server.ClientCount() != 1 {
+		select {
+		case <-ctx.Done():
+			Fail(t, "client not registered")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	Expect(t, server.RemoveByIP(ip) == 1, "client not removed")
+	for server.ClientCount() != 0 {
+		select {
+		case <-ctx.Done():
+			Fail(t, "client not removed")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	disconnects := server.clientManager.reconnectThrottle.recentDisconnects(ip, time.Now(), config.ReconnectThrottleWindow, config.ReconnectThrottleExemptPrivate)
+	Expect(t, disconnects == 0, "client removed by the relay counted as", disconnects, "disconnects")
+}
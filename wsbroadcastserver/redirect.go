@@ -0,0 +1,44 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+var (
+	clientsRedirectedCounter = metrics.NewRegisteredCounter("arb/feed/clients/redirected", nil)
+)
+
+func validatePeerAddresses(peers []string) error {
+	for _, peer := range peers {
+		parsed, err := url.Parse(peer)
+		if err != nil {
+			return fmt.Errorf("invalid peer address %q: %w", peer, err)
+		}
+		if (parsed.Scheme != "ws" && parsed.Scheme != "wss") || parsed.Host == "" {
+			return fmt.Errorf("peer address %q is not a ws:// or wss:// URL", peer)
+		}
+	}
+	return nil
+}
+
+// redirectTarget returns where a new client requesting uri should be sent
+// instead, or "" if this server should take it. Peers are taken in turn once
+// more than RedirectThreshold clients are connected to clientManager.
+func (s *WSBroadcastServer) redirectTarget(config *BroadcasterConfig, clientManager *ClientManager, uri string) string {
+	if config.RedirectThreshold <= 0 || len(config.PeerAddresses) == 0 {
+		return ""
+	}
+	if int(clientManager.ClientCount()) <= config.RedirectThreshold {
+		return ""
+	}
+	peer := config.PeerAddresses[s.nextPeer.Add(1)%uint64(len(config.PeerAddresses))]
+	// keep the path, so clients of a topic are redirected to the same topic
+	return strings.TrimSuffix(peer, "/") + uri
+}
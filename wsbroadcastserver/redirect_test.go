@@ -0,0 +1,86 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+
+	"github.com/offchainlabs/nitro/broadcaster/backlog"
+)
+
+func TestRedirectToPeer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	startServer := func(config *BroadcasterConfig) *WSBroadcastServer {
+		bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+		server := NewWSBroadcastServer(func() *BroadcasterConfig { return config }, bklg, 1, nil)
+		Require(t, server.Initialize())
+		Require(t, server.Start(ctx))
+		t.Cleanup(server.StopAndWait)
+		return server
+	}
+	configB := DefaultTestBroadcasterConfig
+	configB.Addr = "127.0.0.1"
+	serverB := startServer(&configB)
+	peerB := "ws://" + serverB.ListenerAddr().String()
+
+	configA := DefaultTestBroadcasterConfig
+	configA.Addr = "127.0.0.1"
+	configA.RedirectThreshold = 2
+	configA.PeerAddresses = []string{peerB}
+	Require(t, configA.Validate())
+	serverA := startServer(&configA)
+
+	for i := 0; i <= configA.RedirectThreshold; i++ {
+		conn, _, _, err := ws.Dial(ctx, "ws://"+serverA.ListenerAddr().String())
+		Require(t, err)
+		defer func() { _ = conn.Close() }()
+		for serverA.ClientCount() != int32(i+1) {
+			select {
+			case <-ctx.Done():
+				Fail(t, "client", i, "not registered")
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+
+	var location string
+	dialer := ws.Dialer{
+		OnStatusError: func(status int, reason []byte, resp io.Reader) {
+			response, err := http.ReadResponse(bufio.NewReader(resp), nil)
+			if err == nil {
+				location = response.Header.Get("Location")
+			}
+		},
+	}
+	_, _, _, err := dialer.Dial(ctx, "ws://"+serverA.ListenerAddr().String())
+	var statusErr ws.StatusError
+	Expect(t, errors.As(err, &statusErr) && int(statusErr) == http.StatusTemporaryRedirect, "client over the threshold was not redirected with 307:", err)
+	Expect(t, location == peerB+"/", "client redirected to", location, "instead of", peerB+"/")
+
+	conn, _, _, err := ws.Dial(ctx, location)
+	Require(t, err)
+	defer func() { _ = conn.Close() }()
+	for serverB.ClientCount() != 1 {
+		select {
+		case <-ctx.Done():
+			Fail(t, "redirected client not registered with peer")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	Expect(t, serverA.ClientCount() == int32(configA.RedirectThreshold+1), "server A has", serverA.ClientCount(), "clients after redirecting")
+
+	invalid := configA
+	invalid.PeerAddresses = []string{"http://example.com"}
+	Expect(t, invalid.Validate() != nil, "non-websocket peer address passed validation")
+}
@@ -0,0 +1,105 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gobwas/ws"
+
+	"github.com/offchainlabs/nitro/broadcaster/backlog"
+	m "github.com/offchainlabs/nitro/broadcaster/message"
+)
+
+// TopicURIPrefix is followed by a chain id to pick which chain's feed a client
+// receives, so several chains can share a single broadcast server port.
+const TopicURIPrefix = "/feed/"
+
+// TopicRegistry maps a chain id to the ClientManager serving its feed
+type TopicRegistry map[uint64]*ClientManager
+
+// parseTopicURI returns the chain id from a /feed/{chainID} request URI. The
+// second return value is false if the URI isn't a topic URI at all, and an
+// error is returned if it is one but the chain id can't be parsed.
+func parseTopicURI(uri string) (uint64, bool, error) {
+	path := strings.SplitN(uri, "?", 2)[0]
+	if !strings.HasPrefix(path, TopicURIPrefix) {
+		return 0, false, nil
+	}
+	chainId, err := strconv.ParseUint(strings.TrimSuffix(path[len(TopicURIPrefix):], "/"), 10, 64)
+	if err != nil {
+		return 0, true, fmt.Errorf("invalid chain id in feed path %s", path)
+	}
+	return chainId, true, nil
+}
+
+// AddTopic serves the feed of another chain from this server at
+// /feed/{chainId}, with its own backlog and ClientManager. Topics must be added
+// before the server is initialized. Clients connecting without a topic path,
+// or to /feed/ with the server's own chain id, receive the server's own feed.
+func (s *WSBroadcastServer) AddTopic(chainId uint64, bklg backlog.Backlog) error {
+	if s.poller != nil {
+		return errors.New("topics must be added before the broadcast server is initialized")
+	}
+	if chainId == s.chainId {
+		return fmt.Errorf("chain id %d is already the broadcast server's own feed", chainId)
+	}
+	if _, exists := s.topicBacklogs[chainId]; exists {
+		return fmt.Errorf("topic for chain id %d already added", chainId)
+	}
+	if s.topicBacklogs == nil {
+		s.topicBacklogs = make(map[uint64]backlog.Backlog)
+	}
+	s.topicBacklogs[chainId] = bklg
+	return nil
+}
+
+// topicFor returns the ClientManager and backlog serving a connection to uri,
+// rejecting the connection if it asks for a chain this server doesn't carry.
+func (s *WSBroadcastServer) topicFor(uri string) (*ClientManager, backlog.Backlog, uint64, error) {
+	chainId, isTopic, err := parseTopicURI(uri)
+	if !isTopic || (err == nil && chainId == s.chainId) {
+		return s.clientManager, s.backlog, s.chainId, nil
+	}
+	if err == nil {
+		if cm, ok := s.topics[chainId]; ok {
+			return cm, cm.backlog, chainId, nil
+		}
+		err = fmt.Errorf("unknown chain id %d", chainId)
+	}
+	return nil, nil, 0, ws.RejectConnectionError(
+		ws.RejectionStatus(http.StatusNotFound),
+		ws.RejectionReason(err.Error()),
+	)
+}
+
+// BroadcastTopic sends a message to the clients of the given chain's feed
+func (s *WSBroadcastServer) BroadcastTopic(chainId uint64, bm *m.BroadcastMessage) error {
+	if chainId == s.chainId {
+		s.clientManager.Broadcast(bm)
+		return nil
+	}
+	cm, ok := s.topics[chainId]
+	if !ok {
+		return fmt.Errorf("unknown chain id %d", chainId)
+	}
+	cm.Broadcast(bm)
+	return nil
+}
+
+// TopicClientCount returns the number of clients of the given chain's feed
+func (s *WSBroadcastServer) TopicClientCount(chainId uint64) int32 {
+	if chainId == s.chainId {
+		return s.clientManager.ClientCount()
+	}
+	cm, ok := s.topics[chainId]
+	if !ok {
+		return 0
+	}
+	return cm.ClientCount()
+}
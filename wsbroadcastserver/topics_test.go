@@ -0,0 +1,117 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	"github.com/offchainlabs/nitro/broadcaster/backlog"
+	m "github.com/offchainlabs/nitro/broadcaster/message"
+)
+
+func TestParseTopicURI(t *testing.T) {
+	testcases := []struct {
+		uri     string
+		chainId uint64
+		isTopic bool
+		valid   bool
+	}{
+		{"/", 0, false, true},
+		{"/admin/ws", 0, false, true},
+		{"/feed/42161", 42161, true, true},
+		{"/feed/42161/", 42161, true, true},
+		{"/feed/42161?x=1", 42161, true, true},
+		{"/feed/", 0, true, false},
+		{"/feed/arbitrum", 0, true, false},
+	}
+	for _, tc := range testcases {
+		chainId, isTopic, err := parseTopicURI(tc.uri)
+		if isTopic != tc.isTopic || (err == nil) != tc.valid || chainId != tc.chainId {
+			Fail(t, "unexpected result parsing", tc.uri, "chain id", chainId, "topic", isTopic, "err", err)
+		}
+	}
+}
+
+func TestTopicRouting(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	newBacklog := func() backlog.Backlog {
+		return backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	}
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, newBacklog(), 1, nil)
+	Require(t, server.AddTopic(2, newBacklog()))
+	Expect(t, server.AddTopic(2, newBacklog()) != nil, "topic added twice")
+	Expect(t, server.AddTopic(1, newBacklog()) != nil, "server's own chain added as a topic")
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+
+	dial := func(chainId uint64) net.Conn {
+		var handshakeChainId string
+		dialer := ws.Dialer{
+			OnHeader: func(key, value []byte) error {
+				if textproto.CanonicalMIMEHeaderKey(string(key)) == HTTPHeaderChainId {
+					handshakeChainId = string(value)
+				}
+				return nil
+			},
+		}
+		conn, _, _, err := dialer.Dial(ctx, fmt.Sprintf("ws://%s/feed/%d", server.ListenerAddr(), chainId))
+		Require(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		Expect(t, handshakeChainId == strconv.FormatUint(chainId, 10), "handshake chain id", handshakeChainId, "for topic", chainId)
+		return conn
+	}
+	client1 := dial(1)
+	client2 := dial(2)
+	for server.TopicClientCount(1) != 1 || server.TopicClientCount(2) != 1 {
+		select {
+		case <-ctx.Done():
+			Fail(t, "clients were not registered with their topics")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	_, _, _, err := ws.Dial(ctx, fmt.Sprintf("ws://%s/feed/3", server.ListenerAddr()))
+	var statusErr ws.StatusError
+	Expect(t, errors.As(err, &statusErr) && int(statusErr) == http.StatusNotFound, "unknown chain id was not rejected with 404:", err)
+
+	messageCount := 10
+	for i := 0; i < messageCount; i++ {
+		Require(t, server.BroadcastTopic(1, &m.BroadcastMessage{
+			Version:  m.V1,
+			Messages: m.CreateDummyBroadcastMessages(dummySeqNums(i, 1)),
+		}))
+	}
+	Expect(t, server.BroadcastTopic(3, &m.BroadcastMessage{Version: m.V1}) != nil, "broadcast to unknown chain id succeeded")
+	Require(t, readFeed(client1, messageCount))
+
+	// chain 2 has only been sent a confirmation, so that must be the first
+	// thing its client receives
+	Require(t, server.BroadcastTopic(2, &m.BroadcastMessage{
+		Version:                        m.V1,
+		ConfirmedSequenceNumberMessage: &m.ConfirmedSequenceNumberMessage{SequenceNumber: 7},
+	}))
+	data, _, err := wsutil.ReadServerData(client2)
+	Require(t, err)
+	var bm m.BroadcastMessage
+	Require(t, json.Unmarshal(data, &bm))
+	Expect(t, len(bm.Messages) == 0, "chain 2 client received", len(bm.Messages), "messages broadcast to chain 1")
+	Expect(t, bm.ConfirmedSequenceNumberMessage != nil && bm.ConfirmedSequenceNumberMessage.SequenceNumber == 7, "chain 2 client did not receive its confirmation")
+}
@@ -0,0 +1,51 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+func TestReadDataReassemblesFragments(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer func() { _ = serverConn.Close() }()
+	defer func() { _ = clientConn.Close() }()
+
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	fragmentCount := 5
+	fragmentSize := (len(payload) + fragmentCount - 1) / fragmentCount
+	writeErr := make(chan error, 1)
+	go func() {
+		for i := 0; i < fragmentCount; i++ {
+			opCode := ws.OpContinuation
+			if i == 0 {
+				opCode = ws.OpText
+			}
+			end := (i + 1) * fragmentSize
+			if end > len(payload) {
+				end = len(payload)
+			}
+			fin := i == fragmentCount-1
+			// clients must mask their frames
+			frame := ws.MaskFrameInPlace(ws.NewFrame(opCode, fin, append([]byte{}, payload[i*fragmentSize:end]...)))
+			if err := ws.WriteFrame(clientConn, frame); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+		writeErr <- nil
+	}()
+
+	data, opCode, err := ReadData(context.Background(), serverConn, nil, 5*time.Second, ws.StateServerSide, false, nil)
+	Require(t, err)
+	Require(t, <-writeErr)
+	Expect(t, opCode == ws.OpText, "message reassembled with opcode", opCode)
+	Expect(t, bytes.Equal(data, payload), "reassembled", len(data), "bytes not matching the", len(payload), "sent")
+}
@@ -5,14 +5,17 @@ package wsbroadcastserver
 
 import (
 	"context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/textproto"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gobwas/httphead"
@@ -31,10 +34,13 @@ import (
 
 var (
 	HTTPHeaderCloudflareConnectingIP  = textproto.CanonicalMIMEHeaderKey("CF-Connecting-IP")
+	HTTPHeaderXForwardedFor           = textproto.CanonicalMIMEHeaderKey("X-Forwarded-For")
 	HTTPHeaderFeedServerVersion       = textproto.CanonicalMIMEHeaderKey("Arbitrum-Feed-Server-Version")
 	HTTPHeaderFeedClientVersion       = textproto.CanonicalMIMEHeaderKey("Arbitrum-Feed-Client-Version")
 	HTTPHeaderRequestedSequenceNumber = textproto.CanonicalMIMEHeaderKey("Arbitrum-Requested-Sequence-Number")
 	HTTPHeaderChainId                 = textproto.CanonicalMIMEHeaderKey("Arbitrum-Chain-Id")
+	HTTPHeaderAdminToken              = textproto.CanonicalMIMEHeaderKey("Arbitrum-Admin-Token")
+	HTTPHeaderOrigin                  = textproto.CanonicalMIMEHeaderKey("Origin")
 	upgradeToWSTimer                  = metrics.NewRegisteredTimer("arb/feed/clients/upgrade/duration", nil)
 	startWithHeaderTimer              = metrics.NewRegisteredTimer("arb/feed/clients/start/duration", nil)
 )
@@ -43,38 +49,93 @@ const (
 	FeedServerVersion = 2
 	FeedClientVersion = 2
 	LivenessProbeURI  = "livenessprobe"
+	// FeedSubprotocolV1 names the JSON feed format. Clients may request it, or
+	// no subprotocol at all, and receive the same messages either way.
+	FeedSubprotocolV1 = "arbitrum-feed-v1"
 )
 
 type BroadcasterConfig struct {
-	Enable             bool                    `koanf:"enable"`
-	Signed             bool                    `koanf:"signed"`
-	Addr               string                  `koanf:"addr"`
-	ReadTimeout        time.Duration           `koanf:"read-timeout" reload:"hot"`      // reloaded value will affect all clients (next time the timeout is checked)
-	WriteTimeout       time.Duration           `koanf:"write-timeout" reload:"hot"`     // reloading will affect only new connections
-	HandshakeTimeout   time.Duration           `koanf:"handshake-timeout" reload:"hot"` // reloading will affect only new connections
-	Port               string                  `koanf:"port"`
-	Ping               time.Duration           `koanf:"ping" reload:"hot"`           // reloaded value will change future ping intervals
-	ClientTimeout      time.Duration           `koanf:"client-timeout" reload:"hot"` // reloaded value will affect all clients (next time the timeout is checked)
-	Queue              int                     `koanf:"queue"`
-	Workers            int                     `koanf:"workers"`
-	MaxSendQueue       int                     `koanf:"max-send-queue" reload:"hot"`  // reloaded value will affect only new connections
-	RequireVersion     bool                    `koanf:"require-version" reload:"hot"` // reloaded value will affect only future upgrades to websocket
-	DisableSigning     bool                    `koanf:"disable-signing"`
-	LogConnect         bool                    `koanf:"log-connect"`
-	LogDisconnect      bool                    `koanf:"log-disconnect"`
-	EnableCompression  bool                    `koanf:"enable-compression" reload:"hot"`  // if reloaded to false will cause disconnection of clients with enabled compression on next broadcast
-	RequireCompression bool                    `koanf:"require-compression" reload:"hot"` // if reloaded to true will cause disconnection of clients with disabled compression on next broadcast
-	LimitCatchup       bool                    `koanf:"limit-catchup" reload:"hot"`
-	MaxCatchup         int                     `koanf:"max-catchup" reload:"hot"`
-	ConnectionLimits   ConnectionLimiterConfig `koanf:"connection-limits" reload:"hot"`
-	ClientDelay        time.Duration           `koanf:"client-delay" reload:"hot"`
-	Backlog            backlog.Config          `koanf:"backlog" reload:"hot"`
+	Enable               bool                    `koanf:"enable"`
+	Signed               bool                    `koanf:"signed"`
+	Addr                 string                  `koanf:"addr"`
+	ReadTimeout          time.Duration           `koanf:"read-timeout" reload:"hot"`      // reloaded value will affect all clients (next time the timeout is checked)
+	WriteTimeout         time.Duration           `koanf:"write-timeout" reload:"hot"`     // reloading will affect only new connections
+	HandshakeTimeout     time.Duration           `koanf:"handshake-timeout" reload:"hot"` // reloading will affect only new connections
+	Port                 string                  `koanf:"port"`
+	Ping                 time.Duration           `koanf:"ping" reload:"hot"`           // reloaded value will change future ping intervals
+	ClientTimeout        time.Duration           `koanf:"client-timeout" reload:"hot"` // reloaded value will affect all clients (next time the timeout is checked)
+	Queue                int                     `koanf:"queue"`
+	Workers              int                     `koanf:"workers"`
+	MaxSendQueue         int                     `koanf:"max-send-queue" reload:"hot"`        // reloaded value will affect only new connections
+	SlowConsumerTimeout  time.Duration           `koanf:"slow-consumer-timeout" reload:"hot"` // reloaded value will affect all clients (next time the timeout is checked)
+	RequireVersion       bool                    `koanf:"require-version" reload:"hot"`       // reloaded value will affect only future upgrades to websocket
+	DisableSigning       bool                    `koanf:"disable-signing"`
+	LogConnect           bool                    `koanf:"log-connect"`
+	LogDisconnect        bool                    `koanf:"log-disconnect"`
+	EnableCompression    bool                    `koanf:"enable-compression" reload:"hot"`  // if reloaded to false will cause disconnection of clients with enabled compression on next broadcast
+	RequireCompression   bool                    `koanf:"require-compression" reload:"hot"` // if reloaded to true will cause disconnection of clients with disabled compression on next broadcast
+	CompressionThreshold int                     `koanf:"compression-threshold" reload:"hot"`
+	LimitCatchup         bool                    `koanf:"limit-catchup" reload:"hot"`
+	MaxCatchup           int                     `koanf:"max-catchup" reload:"hot"`
+	ConnectionLimits     ConnectionLimiterConfig `koanf:"connection-limits" reload:"hot"`
+	IPFilter             IPFilterConfig          `koanf:"ip-filter" reload:"hot"`
+	ClientDelay          time.Duration           `koanf:"client-delay" reload:"hot"`
+	ClientDelayJitter    float64                 `koanf:"client-delay-jitter" reload:"hot"`
+	Backlog              backlog.Config          `koanf:"backlog" reload:"hot"`
+	AdminToken           string                  `koanf:"admin-token" reload:"hot"` // reloaded value will affect only future admin connections
+	ShutdownBatchSize    int                     `koanf:"shutdown-batch-size" reload:"hot"`
+	ShutdownBatchDelay   time.Duration           `koanf:"shutdown-batch-delay" reload:"hot"`
+	ProxyProtocol        bool                    `koanf:"proxy-protocol" reload:"hot"` // reloading will affect only new connections
+	MaxPauseBuffer       int                     `koanf:"max-pause-buffer" reload:"hot"`
+
+	ReconnectThrottleWindow time.Duration `koanf:"reconnect-throttle-window" reload:"hot"`
+	ReconnectThrottleMax    int           `koanf:"reconnect-throttle-max" reload:"hot"`
+	MaxEgressBitsPerSecond  uint64        `koanf:"max-egress-bits-per-second" reload:"hot"`
+	EgressThrottleDuration  time.Duration `koanf:"egress-throttle-duration" reload:"hot"`
+	AllowedOrigins          []string      `koanf:"allowed-origins" reload:"hot"`
+	IncludeServerTimestamp  bool          `koanf:"include-server-timestamp" reload:"hot"`
+	EnableChecksums         bool          `koanf:"enable-checksums" reload:"hot"`
+	RedirectThreshold       int           `koanf:"redirect-threshold" reload:"hot"`
+	PeerAddresses           []string      `koanf:"peer-addresses" reload:"hot"`
+
+	// ReconnectThrottleExemptPrivate stops private and loopback addresses
+	// being throttled, for relays whose clients all connect through a proxy
+	// that doesn't pass on their IPs
+	ReconnectThrottleExemptPrivate bool `koanf:"reconnect-throttle-exempt-private" reload:"hot"`
+
+	// ClientQueueDepth, if set, overrides MaxSendQueue for clients connecting
+	// from the given IP, for example to give relayers a larger queue than
+	// other clients. A result of zero or less uses MaxSendQueue.
+	ClientQueueDepth func(ip net.IP) int `koanf:"-" reload:"hot"`
+}
+
+// sendQueueSize returns the number of messages that may be queued for a client
+// connecting from ip before it is disconnected
+func (bc *BroadcasterConfig) sendQueueSize(ip net.IP) int {
+	if bc.ClientQueueDepth != nil {
+		if depth := bc.ClientQueueDepth(ip); depth > 0 {
+			return depth
+		}
+	}
+	return bc.MaxSendQueue
 }
 
 func (bc *BroadcasterConfig) Validate() error {
 	if !bc.EnableCompression && bc.RequireCompression {
 		return errors.New("require-compression cannot be true while enable-compression is false")
 	}
+	if bc.ReconnectThrottleMax < 0 {
+		return fmt.Errorf("reconnect-throttle-max must not be negative, got %d", bc.ReconnectThrottleMax)
+	}
+	if err := validatePeerAddresses(bc.PeerAddresses); err != nil {
+		return err
+	}
+	if bc.ClientDelayJitter < 0 || bc.ClientDelayJitter > 0.5 {
+		return fmt.Errorf("client-delay-jitter must be between 0 and 0.5, got %v", bc.ClientDelayJitter)
+	}
+	if err := bc.IPFilter.Validate(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -93,69 +154,130 @@ func BroadcasterConfigAddOptions(prefix string, f *flag.FlagSet) {
 	f.Int(prefix+".queue", DefaultBroadcasterConfig.Queue, "queue size for HTTP to WS upgrade")
 	f.Int(prefix+".workers", DefaultBroadcasterConfig.Workers, "number of threads to reserve for HTTP to WS upgrade")
 	f.Int(prefix+".max-send-queue", DefaultBroadcasterConfig.MaxSendQueue, "maximum number of messages allowed to accumulate before client is disconnected")
+	f.Duration(prefix+".slow-consumer-timeout", DefaultBroadcasterConfig.SlowConsumerTimeout, "duration a client's send queue may stay at least half full before the client is disconnected (0 to disable)")
 	f.Bool(prefix+".require-version", DefaultBroadcasterConfig.RequireVersion, "don't connect if client version not present")
 	f.Bool(prefix+".disable-signing", DefaultBroadcasterConfig.DisableSigning, "don't sign feed messages")
 	f.Bool(prefix+".log-connect", DefaultBroadcasterConfig.LogConnect, "log every client connect")
 	f.Bool(prefix+".log-disconnect", DefaultBroadcasterConfig.LogDisconnect, "log every client disconnect")
 	f.Bool(prefix+".enable-compression", DefaultBroadcasterConfig.EnableCompression, "enable per message deflate compression support")
 	f.Bool(prefix+".require-compression", DefaultBroadcasterConfig.RequireCompression, "require clients to use compression")
-	f.Bool(prefix+".limit-catchup", DefaultBroadcasterConfig.LimitCatchup, "only supply catchup buffer if requested sequence number is reasonable")
+	f.Int(prefix+".compression-threshold", DefaultBroadcasterConfig.CompressionThreshold, "messages smaller than this many bytes are sent uncompressed, even to clients with compression enabled")
+	f.Bool(prefix+".limit-catchup", DefaultBroadcasterConfig.LimitCatchup, "reject clients whose requested sequence number is ahead of the feed or more than max-catchup messages behind it")
 	f.Int(prefix+".max-catchup", DefaultBroadcasterConfig.MaxCatchup, "the maximum size of the catchup buffer (-1 means unlimited)")
 	ConnectionLimiterConfigAddOptions(prefix+".connection-limits", f)
+	IPFilterConfigAddOptions(prefix+".ip-filter", f)
 	f.Duration(prefix+".client-delay", DefaultBroadcasterConfig.ClientDelay, "delay the first messages sent to each client by this amount")
+	f.Float64(prefix+".client-delay-jitter", DefaultBroadcasterConfig.ClientDelayJitter, "randomly increase each client's delay by up to this fraction (0 to 0.5) so clients connecting together aren't sent their first messages at once")
 	backlog.AddOptions(prefix+".backlog", f)
+	f.String(prefix+".admin-token", DefaultBroadcasterConfig.AdminToken, "token admin clients must send in the "+HTTPHeaderAdminToken+" header to stream connection stats from "+AdminURI+" (empty to disable)")
+	f.Int(prefix+".shutdown-batch-size", DefaultBroadcasterConfig.ShutdownBatchSize, "on shutdown, disconnect clients oldest first in batches of this size (0 to disconnect all clients at once)")
+	f.Duration(prefix+".shutdown-batch-delay", DefaultBroadcasterConfig.ShutdownBatchDelay, "delay between batches of clients disconnected on shutdown")
+	f.Bool(prefix+".proxy-protocol", DefaultBroadcasterConfig.ProxyProtocol, "require a PROXY protocol v1 or v2 header on every connection and take the client IP from it, only enable behind a load balancer that sends one")
+	f.Int(prefix+".max-pause-buffer", DefaultBroadcasterConfig.MaxPauseBuffer, "maximum number of broadcasts buffered while broadcasting is paused, after which clients are disconnected and broadcasting resumes")
+	f.Duration(prefix+".reconnect-throttle-window", DefaultBroadcasterConfig.ReconnectThrottleWindow, "window over which client disconnects are counted per IP, IPs disconnecting more than reconnect-throttle-max times are rejected with 429 and told to retry after a second (0 to disable)")
+	f.Int(prefix+".reconnect-throttle-max", DefaultBroadcasterConfig.ReconnectThrottleMax, "number of disconnects per IP allowed within reconnect-throttle-window before its handshakes are rejected")
+	f.Bool(prefix+".reconnect-throttle-exempt-private", DefaultBroadcasterConfig.ReconnectThrottleExemptPrivate, "never throttle reconnects from private or loopback addresses, only enable if clients connect through a proxy that doesn't pass on their IPs")
+	f.Uint64(prefix+".max-egress-bits-per-second", DefaultBroadcasterConfig.MaxEgressBitsPerSecond, "cap on the rate data is written to all clients together, writes beyond it are paused for up to egress-throttle-duration (0 to disable)")
+	f.Duration(prefix+".egress-throttle-duration", DefaultBroadcasterConfig.EgressThrottleDuration, "maximum time a write is paused when max-egress-bits-per-second is exceeded")
+	f.StringSlice(prefix+".allowed-origins", DefaultBroadcasterConfig.AllowedOrigins, "origins browser clients may connect from, such as https://example.com, https://*.example.com or * (empty allows all), connections sending no Origin header are always allowed")
+	f.Bool(prefix+".include-server-timestamp", DefaultBroadcasterConfig.IncludeServerTimestamp, "include the time each message was sent in broadcast messages, so clients can measure feed latency")
+	f.Bool(prefix+".enable-checksums", DefaultBroadcasterConfig.EnableChecksums, "include a CRC32C checksum of the feed messages in each broadcast message, so clients can detect corruption in transit")
+	f.Int(prefix+".redirect-threshold", DefaultBroadcasterConfig.RedirectThreshold, "number of connected clients above which new clients are redirected to peer-addresses (0 to disable)")
+	f.StringSlice(prefix+".peer-addresses", DefaultBroadcasterConfig.PeerAddresses, "ws:// or wss:// URLs of broadcast servers carrying the same feed, which new clients are redirected to in turn once redirect-threshold is exceeded")
 }
 
 var DefaultBroadcasterConfig = BroadcasterConfig{
-	Enable:             false,
-	Signed:             false,
-	Addr:               "",
-	ReadTimeout:        time.Second,
-	WriteTimeout:       2 * time.Second,
-	HandshakeTimeout:   time.Second,
-	Port:               "9642",
-	Ping:               5 * time.Second,
-	ClientTimeout:      15 * time.Second,
-	Queue:              100,
-	Workers:            100,
-	MaxSendQueue:       4096,
-	RequireVersion:     false,
-	DisableSigning:     true,
-	LogConnect:         false,
-	LogDisconnect:      false,
-	EnableCompression:  false,
-	RequireCompression: false,
-	LimitCatchup:       false,
-	MaxCatchup:         -1,
-	ConnectionLimits:   DefaultConnectionLimiterConfig,
-	ClientDelay:        0,
-	Backlog:            backlog.DefaultConfig,
+	Enable:               false,
+	Signed:               false,
+	Addr:                 "",
+	ReadTimeout:          time.Second,
+	WriteTimeout:         2 * time.Second,
+	HandshakeTimeout:     time.Second,
+	Port:                 "9642",
+	Ping:                 5 * time.Second,
+	ClientTimeout:        15 * time.Second,
+	Queue:                100,
+	Workers:              100,
+	MaxSendQueue:         4096,
+	SlowConsumerTimeout:  30 * time.Second,
+	RequireVersion:       false,
+	DisableSigning:       true,
+	LogConnect:           false,
+	LogDisconnect:        false,
+	EnableCompression:    false,
+	RequireCompression:   false,
+	CompressionThreshold: 512,
+	LimitCatchup:         false,
+	MaxCatchup:           -1,
+	ConnectionLimits:     DefaultConnectionLimiterConfig,
+	IPFilter:             DefaultIPFilterConfig,
+	ClientDelay:          0,
+	ClientDelayJitter:    0.1,
+	Backlog:              backlog.DefaultConfig,
+	AdminToken:           "",
+	ShutdownBatchSize:    0,
+	ShutdownBatchDelay:   100 * time.Millisecond,
+	ProxyProtocol:        false,
+	MaxPauseBuffer:       10000,
+
+	ReconnectThrottleWindow: 5 * time.Second,
+	ReconnectThrottleMax:    5,
+	MaxEgressBitsPerSecond:  0,
+	EgressThrottleDuration:  10 * time.Millisecond,
+	AllowedOrigins:          []string{},
+	IncludeServerTimestamp:  false,
+	EnableChecksums:         false,
+	RedirectThreshold:       0,
+	PeerAddresses:           []string{},
+
+	ReconnectThrottleExemptPrivate: false,
 }
 
 var DefaultTestBroadcasterConfig = BroadcasterConfig{
-	Enable:             false,
-	Signed:             false,
-	Addr:               "0.0.0.0",
-	ReadTimeout:        2 * time.Second,
-	WriteTimeout:       2 * time.Second,
-	HandshakeTimeout:   2 * time.Second,
-	Port:               "0",
-	Ping:               5 * time.Second,
-	ClientTimeout:      15 * time.Second,
-	Queue:              1,
-	Workers:            100,
-	MaxSendQueue:       4096,
-	RequireVersion:     false,
-	DisableSigning:     false,
-	LogConnect:         false,
-	LogDisconnect:      false,
-	EnableCompression:  true,
-	RequireCompression: false,
-	LimitCatchup:       false,
-	MaxCatchup:         -1,
-	ConnectionLimits:   DefaultConnectionLimiterConfig,
-	ClientDelay:        0,
-	Backlog:            backlog.DefaultTestConfig,
+	Enable:               false,
+	Signed:               false,
+	Addr:                 "0.0.0.0",
+	ReadTimeout:          2 * time.Second,
+	WriteTimeout:         2 * time.Second,
+	HandshakeTimeout:     2 * time.Second,
+	Port:                 "0",
+	Ping:                 5 * time.Second,
+	ClientTimeout:        15 * time.Second,
+	Queue:                1,
+	Workers:              100,
+	MaxSendQueue:         4096,
+	SlowConsumerTimeout:  30 * time.Second,
+	RequireVersion:       false,
+	DisableSigning:       false,
+	LogConnect:           false,
+	LogDisconnect:        false,
+	EnableCompression:    true,
+	RequireCompression:   false,
+	CompressionThreshold: 0,
+	LimitCatchup:         false,
+	MaxCatchup:           -1,
+	ConnectionLimits:     DefaultConnectionLimiterConfig,
+	IPFilter:             DefaultIPFilterConfig,
+	ClientDelay:          0,
+	ClientDelayJitter:    0.1,
+	Backlog:              backlog.DefaultTestConfig,
+	AdminToken:           "",
+	ShutdownBatchSize:    0,
+	ShutdownBatchDelay:   0,
+	ProxyProtocol:        false,
+	MaxPauseBuffer:       10000,
+
+	ReconnectThrottleWindow: 5 * time.Second,
+	ReconnectThrottleMax:    5,
+	MaxEgressBitsPerSecond:  0,
+	EgressThrottleDuration:  10 * time.Millisecond,
+	AllowedOrigins:          []string{},
+	IncludeServerTimestamp:  false,
+	EnableChecksums:         false,
+	RedirectThreshold:       0,
+	PeerAddresses:           []string{},
+
+	ReconnectThrottleExemptPrivate: true,
 }
 
 type WSBroadcastServer struct {
@@ -164,6 +286,7 @@ type WSBroadcastServer struct {
 
 	acceptDescMutex sync.Mutex
 	acceptDesc      *netpoll.Desc
+	unixAcceptDesc  *netpoll.Desc
 
 	listener      net.Listener
 	config        BroadcasterConfigFetcher
@@ -172,6 +295,15 @@ type WSBroadcastServer struct {
 	backlog       backlog.Backlog
 	chainId       uint64
 	fatalErrChan  chan error
+
+	topicBacklogs map[uint64]backlog.Backlog
+	topics        TopicRegistry
+
+	unixSocketPath string
+	unixListener   net.Listener
+
+	// nextPeer round-robins the peers clients are redirected to
+	nextPeer atomic.Uint64
 }
 
 func NewWSBroadcastServer(config BroadcasterConfigFetcher, bklg backlog.Backlog, chainId uint64, fatalErrChan chan error) *WSBroadcastServer {
@@ -199,6 +331,10 @@ func (s *WSBroadcastServer) Initialize() error {
 	// Make pool of X size, Y sized work queue and one pre-spawned
 	// goroutine.
 	s.clientManager = NewClientManager(s.poller, s.config, s.backlog)
+	s.topics = make(TopicRegistry, len(s.topicBacklogs))
+	for chainId, bklg := range s.topicBacklogs {
+		s.topics[chainId] = NewClientManager(s.poller, s.config, bklg)
+	}
 
 	return nil
 }
@@ -225,6 +361,9 @@ func (s *WSBroadcastServer) StartWithHeader(ctx context.Context, header ws.Hands
 	}
 
 	s.clientManager.Start(ctx)
+	for _, cm := range s.topics {
+		cm.Start(ctx)
+	}
 
 	// handle incoming connection requests.
 	// It upgrades TCP connection to WebSocket, registers netpoll listener on
@@ -247,6 +386,17 @@ func (s *WSBroadcastServer) StartWithHeader(ctx context.Context, header ws.Hands
 			return
 		}
 
+		var proxyIP net.IP
+		if config.ProxyProtocol {
+			proxyIP, err = readProxyHeader(conn)
+			if err != nil {
+				log.Debug("error reading PROXY protocol header", "remoteAddr", conn.RemoteAddr(), "err", err)
+				clientsTotalFailedUpgradeCounter.Inc(1)
+				_ = conn.Close()
+				return
+			}
+		}
+
 		var compress *wsflate.Extension
 		var negotiate func(httphead.Option) (httphead.Option, error)
 		if config.EnableCompression {
@@ -257,14 +407,48 @@ func (s *WSBroadcastServer) StartWithHeader(ctx context.Context, header ws.Hands
 		}
 		var feedClientVersionSeen bool
 		var connectingIP net.IP
+		var cfConnectingIP net.IP
+		var forwardedFor string
 		var requestedSeqNum arbutil.MessageIndex
+		var seqNumRequested bool
+		var isAdmin bool
+		var adminToken []byte
+		var origin string
+		var requestURI string
+		// the server's own feed unless the client asks for another chain's topic
+		clientManager := s.clientManager
+		bklg := s.backlog
+		topicHeader := header
 		upgrader := ws.Upgrader{
 			OnRequest: func(uri []byte) error {
+				requestURI = string(uri)
 				if strings.Contains(string(uri), LivenessProbeURI) {
 					return ws.RejectConnectionError(
 						ws.RejectionStatus(http.StatusOK),
 					)
 				}
+				if strings.SplitN(string(uri), "?", 2)[0] == AdminURI {
+					if config.AdminToken == "" {
+						return ws.RejectConnectionError(
+							ws.RejectionStatus(http.StatusNotFound),
+							ws.RejectionReason("Admin endpoint is disabled."),
+						)
+					}
+					isAdmin = true
+					return nil
+				}
+				topicManager, topicBacklog, chainId, err := s.topicFor(string(uri))
+				if err != nil {
+					return err
+				}
+				if topicManager != s.clientManager {
+					clientManager = topicManager
+					bklg = topicBacklog
+					topicHeader = ws.HandshakeHeaderHTTP(http.Header{
+						HTTPHeaderFeedServerVersion: []string{strconv.Itoa(FeedServerVersion)},
+						HTTPHeaderChainId:           []string{strconv.FormatUint(chainId, 10)},
+					})
+				}
 				return nil
 			},
 			OnHeader: func(key []byte, value []byte) error {
@@ -293,37 +477,122 @@ func (s *WSBroadcastServer) StartWithHeader(ctx context.Context, header ws.Hands
 						)
 					}
 					requestedSeqNum = arbutil.MessageIndex(num)
+					seqNumRequested = true
+				} else if headerName == HTTPHeaderAdminToken {
+					adminToken = append([]byte{}, value...)
+				} else if headerName == HTTPHeaderOrigin {
+					origin = string(value)
+				} else if headerName == HTTPHeaderXForwardedFor {
+					// a request may carry the list over several headers
+					if forwardedFor != "" {
+						forwardedFor += ","
+					}
+					forwardedFor += string(value)
 				} else if headerName == HTTPHeaderCloudflareConnectingIP {
-					connectingIP = net.ParseIP(string(value))
-					log.Trace("Client IP parsed from header", "ip", connectingIP, "header", headerName, "value", string(value))
+					cfConnectingIP = net.ParseIP(string(value))
+					log.Trace("Client IP parsed from header", "ip", cfConnectingIP, "header", headerName, "value", string(value))
 				}
 
 				return nil
 			},
 			OnBeforeUpgrade: func() (ws.HandshakeHeader, error) {
+				// only browsers send an Origin, other clients aren't restricted
+				if origin != "" && !originAllowed(origin, config.AllowedOrigins) {
+					return nil, ws.RejectConnectionError(
+						ws.RejectionStatus(http.StatusForbidden),
+						ws.RejectionReason("Origin is not allowed."),
+					)
+				}
+				if isAdmin {
+					if subtle.ConstantTimeCompare(adminToken, []byte(config.AdminToken)) != 1 {
+						return nil, ws.RejectConnectionError(
+							ws.RejectionStatus(http.StatusUnauthorized),
+							ws.RejectionReason(fmt.Sprintf("Missing or invalid HTTP header %s", HTTPHeaderAdminToken)),
+						)
+					}
+					return header, nil
+				}
 				if config.RequireVersion && !feedClientVersionSeen {
 					return nil, ws.RejectConnectionError(
 						ws.RejectionStatus(http.StatusBadRequest),
 						ws.RejectionReason(fmt.Sprintf("Missing HTTP header %s", HTTPHeaderFeedClientVersion)),
 					)
 				}
-				if connectingIP == nil {
-					if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
-						connectingIP = addr.IP
-						log.Trace("Client IP taken from socket", "ip", connectingIP, "remoteAddr", conn.RemoteAddr())
-					} else {
-						log.Warn("No client IP could be determined from socket", "remoteAddr", conn.RemoteAddr())
-					}
+				if target := s.redirectTarget(config, clientManager, requestURI); target != "" {
+					clientsRedirectedCounter.Inc(1)
+					return nil, ws.RejectConnectionError(
+						ws.RejectionStatus(http.StatusTemporaryRedirect),
+						ws.RejectionHeader(ws.HandshakeHeaderHTTP(http.Header{"Location": []string{target}})),
+						ws.RejectionReason("Server is at capacity, connect to the peer in the Location header."),
+					)
+				}
+				// The load balancer's PROXY header says who connected to it, so
+				// it takes the place of the socket's peer. With
+				// require-trusted-proxy, HTTP headers are only used if that peer
+				// is itself a trusted proxy.
+				peerIP := socketIP(conn)
+				if proxyIP != nil {
+					peerIP = proxyIP
+					log.Trace("Client IP taken from PROXY protocol header", "ip", peerIP, "remoteAddr", conn.RemoteAddr())
+				}
+				forwardedIP, err := config.IPFilter.forwardedIP(peerIP, cfConnectingIP, forwardedFor)
+				if err != nil {
+					log.Error("error checking client IP against trusted proxies", "peerIP", peerIP, "err", err)
+				}
+				if forwardedIP != nil {
+					connectingIP = forwardedIP
+					log.Trace("Client IP taken from header", "ip", connectingIP, "peerIP", peerIP)
+				} else {
+					connectingIP = peerIP
 				}
 
-				if config.ConnectionLimits.Enable && !s.clientManager.connectionLimiter.IsAllowed(connectingIP) {
+				if err := validateRequestedSeqNum(requestedSeqNum, bklg, clientManager.LatestSeqNum(), config.LimitCatchup, config.MaxCatchup); err != nil {
+					return nil, ws.RejectConnectionError(
+						ws.RejectionStatus(http.StatusBadRequest),
+						ws.RejectionReason(err.Error()),
+					)
+				}
+
+				allowed, err := config.IPFilter.IsAllowed(connectingIP)
+				if err != nil {
+					log.Error("error checking client IP against filter", "ip", connectingIP, "err", err)
+				}
+				if !allowed {
+					return nil, ws.RejectConnectionError(
+						ws.RejectionStatus(http.StatusForbidden),
+						ws.RejectionHeader(ws.HandshakeHeaderHTTP(http.Header{"Content-Type": []string{"application/json"}})),
+						ws.RejectionReason(`{"error":"client IP address is not allowed"}`),
+					)
+				}
+
+				if config.ConnectionLimits.Enable && !clientManager.connectionLimiter.IsAllowed(connectingIP) {
 					return nil, ws.RejectConnectionError(
 						ws.RejectionStatus(http.StatusTooManyRequests),
 						ws.RejectionReason("Too many open feed connections."),
 					)
 				}
 
-				return header, nil
+				// throttled clients are rejected rather than delayed, as
+				// delaying them would hold up a handshake worker
+				disconnects := clientManager.reconnectThrottle.recentDisconnects(connectingIP, time.Now(), config.ReconnectThrottleWindow, config.ReconnectThrottleExemptPrivate)
+				if disconnects > config.ReconnectThrottleMax || disconnects >= reconnectThrottleRejectAfter {
+					clientsThrottledCounter.Inc(1)
+					log.Debug("rejecting client reconnecting too often", "connectingIP", connectingIP, "disconnects", disconnects)
+					retryAfter := strconv.Itoa(int(reconnectThrottleRetryAfter / time.Second))
+					return nil, ws.RejectConnectionError(
+						ws.RejectionStatus(http.StatusTooManyRequests),
+						ws.RejectionHeader(ws.HandshakeHeaderHTTP(http.Header{"Retry-After": []string{retryAfter}})),
+						ws.RejectionReason("Reconnecting too often."),
+					)
+				}
+
+				return topicHeader, nil
+			},
+			// Only subprotocols the server can speak are accepted, a client
+			// offering none of them is answered without a subprotocol and
+			// gets the v1 format.
+			Protocol: func(protocol []byte) bool {
+				return string(protocol) == FeedSubprotocolV1
 			},
 			Negotiate: negotiate,
 		}
@@ -367,6 +636,12 @@ func (s *WSBroadcastServer) StartWithHeader(ctx context.Context, header ws.Hands
 			return
 		}
 
+		if isAdmin {
+			// Admin clients only receive stats, so they aren't registered as feed clients
+			s.clientManager.adminBroadcaster.AddAdmin(writeDeadliner{conn, config.WriteTimeout})
+			return
+		}
+
 		// Create netpoll event descriptor to handle only read events.
 		desc, err := netpoll.HandleRead(conn)
 		if err != nil {
@@ -375,10 +650,27 @@ func (s *WSBroadcastServer) StartWithHeader(ctx context.Context, header ws.Hands
 			return
 		}
 
+		// a client taken over from another server resumes where it left off
+		if !seqNumRequested {
+			if resumeSeqNum, ok := clientManager.takeResumePoint(connectingIP, time.Now()); ok {
+				log.Debug("resuming client from imported snapshot", "connectingIP", connectingIP, "sequenceNumber", resumeSeqNum)
+				requestedSeqNum = resumeSeqNum
+			}
+		}
+
 		// Register incoming client in clientManager.
 		safeConn := writeDeadliner{conn, config.WriteTimeout}
 
-		client := NewClientConnection(safeConn, desc, s.clientManager.clientAction, requestedSeqNum, connectingIP, compressionAccepted, s.config().MaxSendQueue, s.config().ClientDelay, s.backlog)
+		client := NewClientConnection(safeConn, desc, clientManager.clientAction, ClientConnectionOptions{
+			RequestedSeqNum:      requestedSeqNum,
+			ConnectingIP:         connectingIP,
+			Compression:          compressionAccepted,
+			CompressionThreshold: config.CompressionThreshold,
+			MaxSendQueue:         config.sendQueueSize(connectingIP),
+			Delay:                jitterDelay(config.ClientDelay, config.ClientDelayJitter),
+			Backlog:              bklg,
+		})
+		client.egress = clientManager.egress
 		client.Start(ctx)
 
 		// Subscribe to events about conn.
@@ -387,7 +679,7 @@ func (s *WSBroadcastServer) StartWithHeader(ctx context.Context, header ws.Hands
 				// ReadHup or Hup received, means the client has close the connection
 				// remove it from the clientManager registry.
 				log.Debug("Hup received", "age", client.Age(), "client", client.Name)
-				client.Remove()
+				client.Disconnected()
 				return
 			}
 
@@ -396,10 +688,10 @@ func (s *WSBroadcastServer) StartWithHeader(ctx context.Context, header ws.Hands
 			}
 
 			// receive client messages, close on error
-			s.clientManager.pool.Schedule(func() {
+			clientManager.pool.Schedule(func() {
 				// Ignore any messages sent from client, close on any error
 				if _, _, err := client.Receive(ctx, s.config().ReadTimeout); err != nil {
-					client.Remove()
+					client.Disconnected()
 					return
 				}
 			})
@@ -422,6 +714,32 @@ func (s *WSBroadcastServer) StartWithHeader(ctx context.Context, header ws.Hands
 
 	log.Info("arbitrum websocket broadcast server is listening", "address", ln.Addr().String())
 
+	if err := s.acceptConnections(ctx, ln, &s.acceptDesc, handle); err != nil {
+		return err
+	}
+
+	if s.unixSocketPath != "" {
+		unixLn, err := net.Listen("unix", s.unixSocketPath)
+		if err != nil {
+			log.Error("error listening on unix socket", "path", s.unixSocketPath, "err", err)
+			return err
+		}
+		s.unixListener = unixLn
+		log.Info("arbitrum websocket broadcast server is listening", "unixSocket", s.unixSocketPath)
+		if err := s.acceptConnections(ctx, unixLn, &s.unixAcceptDesc, handle); err != nil {
+			return err
+		}
+	}
+
+	s.started = true
+
+	return nil
+}
+
+// acceptConnections accepts connections from ln through the netpoll poller and
+// passes them to handle. The listener's descriptor is kept in descField, under
+// acceptDescMutex, so that closeListener can stop it.
+func (s *WSBroadcastServer) acceptConnections(ctx context.Context, ln net.Listener, descField **netpoll.Desc, handle func(net.Conn)) error {
 	// Create netpoll descriptor for the listener.
 	// We use OneShot here to synchronously manage the rate that new connections are accepted
 	acceptDesc, err := netpoll.HandleListener(ln, netpoll.EventRead|netpoll.EventOneShot)
@@ -429,7 +747,9 @@ func (s *WSBroadcastServer) StartWithHeader(ctx context.Context, header ws.Hands
 		log.Error("error calling HandleListener", "err", err)
 		return err
 	}
-	s.acceptDesc = acceptDesc
+	s.acceptDescMutex.Lock()
+	*descField = acceptDesc
+	s.acceptDescMutex.Unlock()
 
 	// acceptErrChan blocks until connection accepted or error occurred
 	// OneShot is used, so reusing a single channel is fine
@@ -480,12 +800,12 @@ func (s *WSBroadcastServer) StartWithHeader(ctx context.Context, header ws.Hands
 		}
 
 		s.acceptDescMutex.Lock()
-		if s.acceptDesc == nil {
+		if *descField == nil {
 			// Already shutting down
 			s.acceptDescMutex.Unlock()
 			return
 		}
-		err = s.poller.Resume(s.acceptDesc)
+		err = s.poller.Resume(*descField)
 		s.acceptDescMutex.Unlock()
 		if err != nil {
 			log.Warn("error in poller.Resume", "err", err)
@@ -497,9 +817,68 @@ func (s *WSBroadcastServer) StartWithHeader(ctx context.Context, header ws.Hands
 		log.Warn("error in starting broadcaster poller", "err", err)
 		return err
 	}
+	return nil
+}
+
+// socketIP returns the IP of the peer of conn. Clients on a unix socket are on
+// the same host.
+func socketIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		log.Trace("Client IP taken from socket", "ip", addr.IP, "remoteAddr", conn.RemoteAddr())
+		return addr.IP
+	}
+	if _, ok := conn.(*net.UnixConn); ok {
+		log.Trace("Client connected over unix socket", "socket", conn.LocalAddr())
+		return net.IPv4(127, 0, 0, 1)
+	}
+	log.Warn("No client IP could be determined from socket", "remoteAddr", conn.RemoteAddr())
+	return nil
+}
 
-	s.started = true
+// jitterDelay randomly increases delay by up to the given fraction, so that
+// clients connecting at the same time don't all receive messages at once.
+func jitterDelay(delay time.Duration, fraction float64) time.Duration {
+	if delay == 0 || fraction <= 0 {
+		return delay
+	}
+	return time.Duration(float64(delay) * (1 + rand.Float64()*fraction))
+}
 
+// validateRequestedSeqNum checks that a client's requested sequence number
+// isn't ahead of the feed or more than maxCatchup messages behind it. Both are
+// only checked if limitCatchup is set; otherwise a client ahead of the feed
+// just waits for it to catch up. The feed is taken to be at whichever is
+// further of the backlog and latestSeqNum, the last message broadcast, which
+// is nil if none has been. A requested sequence number of 0 means the client
+// didn't request one.
+func validateRequestedSeqNum(requestedSeqNum arbutil.MessageIndex, bklg backlog.Backlog, latestSeqNum *arbutil.MessageIndex, limitCatchup bool, maxCatchup int) error {
+	if !limitCatchup || requestedSeqNum == 0 {
+		return nil
+	}
+	// next is the sequence number of the next message to be broadcast
+	var next uint64
+	known := false
+	if segment := bklg.Head(); bklg.Count() > 0 && !backlog.IsBacklogSegmentNil(segment) {
+		// the backlog holds contiguous sequence numbers, so the next message
+		// follows directly after the last one in the backlog
+		next = segment.Start() + bklg.Count()
+		known = true
+	}
+	if latestSeqNum != nil && uint64(*latestSeqNum)+1 > next {
+		next = uint64(*latestSeqNum) + 1
+		known = true
+	}
+	if !known {
+		// nothing has been broadcast, so where the feed is isn't known yet
+		return nil
+	}
+	requested := uint64(requestedSeqNum)
+	if requested > next {
+		return fmt.Errorf("requested sequence number %d is ahead of the next sequence number %d", requested, next)
+	}
+	if maxCatchup >= 0 && next-requested > uint64(maxCatchup) {
+		return fmt.Errorf("requested sequence number %d is more than %d messages behind the next sequence number %d", requested, maxCatchup, next)
+	}
 	return nil
 }
 
@@ -507,29 +886,72 @@ func (s *WSBroadcastServer) ListenerAddr() net.Addr {
 	return s.listener.Addr()
 }
 
-func (s *WSBroadcastServer) StopAndWait() {
-	err := s.listener.Close()
-	if err != nil {
-		log.Warn("error in listener.Close", "err", err)
+// ListenUnix additionally serves the feed on a unix domain socket at path, for
+// clients on the same host. It must be called before the server is started.
+func (s *WSBroadcastServer) ListenUnix(path string) error {
+	s.startMutex.Lock()
+	defer s.startMutex.Unlock()
+	if s.started {
+		return errors.New("unix socket must be added before the broadcast server is started")
+	}
+	s.unixSocketPath = path
+	return nil
+}
+
+// UnixListenerAddr returns the address of the unix socket listener, or nil if
+// the server isn't listening on one
+func (s *WSBroadcastServer) UnixListenerAddr() net.Addr {
+	if s.unixListener == nil {
+		return nil
 	}
+	return s.unixListener.Addr()
+}
 
-	err = s.poller.Stop(s.acceptDesc)
+func (s *WSBroadcastServer) closeListener(ln net.Listener, descField **netpoll.Desc) {
+	err := ln.Close()
 	if err != nil {
-		log.Warn("error in poller.Stop", "err", err)
+		log.Warn("error in listener.Close", "err", err)
 	}
 
 	s.acceptDescMutex.Lock()
-	err = s.acceptDesc.Close()
-	s.acceptDesc = nil
+	acceptDesc := *descField
+	*descField = nil
 	s.acceptDescMutex.Unlock()
+	if acceptDesc == nil {
+		return
+	}
+
+	err = s.poller.Stop(acceptDesc)
+	if err != nil {
+		log.Warn("error in poller.Stop", "err", err)
+	}
+	err = acceptDesc.Close()
 	if err != nil {
 		log.Warn("error in acceptDesc.Close", "err", err)
 	}
+}
+
+func (s *WSBroadcastServer) StopAndWait() {
+	s.closeListener(s.listener, &s.acceptDesc)
+	if s.unixListener != nil {
+		s.closeListener(s.unixListener, &s.unixAcceptDesc)
+		s.unixListener = nil
+	}
 
-	s.clientManager.StopAndWait()
+	for _, cm := range s.topics {
+		s.stopClientManager(cm)
+	}
+	s.stopClientManager(s.clientManager)
 	s.started = false
 }
 
+func (s *WSBroadcastServer) stopClientManager(cm *ClientManager) {
+	if config := s.config(); config.ShutdownBatchSize > 0 {
+		cm.OrderedShutdown(config.ShutdownBatchSize, config.ShutdownBatchDelay)
+	}
+	cm.StopAndWait()
+}
+
 func (s *WSBroadcastServer) Started() bool {
 	return s.started
 }
@@ -543,6 +965,26 @@ func (s *WSBroadcastServer) ClientCount() int32 {
 	return s.clientManager.ClientCount()
 }
 
+// RemoveByIP disconnects every client connected from ip, from all topics, and
+// returns how many were removed.
+func (s *WSBroadcastServer) RemoveByIP(ip net.IP) int {
+	removed := s.clientManager.RemoveByIP(ip)
+	for _, cm := range s.topics {
+		removed += cm.RemoveByIP(ip)
+	}
+	return removed
+}
+
+// EvictSlowConsumers disconnects every client, from all topics, whose send
+// queue is more than queueDepthFraction full, and returns how many were removed.
+func (s *WSBroadcastServer) EvictSlowConsumers(queueDepthFraction float64) int {
+	evicted := s.clientManager.EvictSlowConsumers(queueDepthFraction)
+	for _, cm := range s.topics {
+		evicted += cm.EvictSlowConsumers(queueDepthFraction)
+	}
+	return evicted
+}
+
 // writeDeadliner is a wrapper around net.Conn that sets write deadlines before
 // every Write() call.
 type writeDeadliner struct {
@@ -0,0 +1,635 @@
+// Copyright 2021-2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package wsbroadcastserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	"github.com/offchainlabs/nitro/arbutil"
+	"github.com/offchainlabs/nitro/broadcaster/backlog"
+	m "github.com/offchainlabs/nitro/broadcaster/message"
+)
+
+func TestValidateRequestedSeqNum(t *testing.T) {
+	emptyBacklog := backlog.NewBacklog(func() *backlog.Config { return &backlog.DefaultTestConfig })
+	// backlog holds messages 10 to 19, so 20 is the next sequence number
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &backlog.DefaultTestConfig })
+	Require(t, bklg.Append(&m.BroadcastMessage{Messages: m.CreateDummyBroadcastMessages(dummySeqNums(10, 10))}))
+
+	latest := func(seqNum arbutil.MessageIndex) *arbutil.MessageIndex { return &seqNum }
+
+	testcases := []struct {
+		name         string
+		backlog      backlog.Backlog
+		latest       *arbutil.MessageIndex
+		requested    arbutil.MessageIndex
+		limitCatchup bool
+		maxCatchup   int
+		valid        bool
+	}{
+		{"no request", bklg, latest(19), 0, true, 5, true},
+		{"nothing broadcast", emptyBacklog, nil, 1000, true, 5, true},
+		{"empty backlog ahead of latest", emptyBacklog, latest(19), 21, true, 5, false},
+		{"empty backlog at latest", emptyBacklog, latest(19), 20, true, 5, true},
+		{"next message", bklg, latest(19), 20, true, 5, true},
+		{"one ahead of next message", bklg, latest(19), 21, true, 5, false},
+		{"ahead without limit-catchup", bklg, latest(19), 21, false, 5, true},
+		{"far ahead without limit-catchup", bklg, latest(19), math.MaxUint64, false, 5, true},
+		{"ahead of backlog but not latest", bklg, latest(25), 26, true, -1, true},
+		{"max uint64", bklg, latest(19), math.MaxUint64, true, 5, false},
+		{"at max catchup", bklg, latest(19), 15, true, 5, true},
+		{"one past max catchup", bklg, latest(19), 14, true, 5, false},
+		{"past max catchup without limit-catchup", bklg, latest(19), 1, false, 5, true},
+		{"unlimited catchup", bklg, latest(19), 1, true, -1, true},
+		{"zero catchup", bklg, latest(19), 19, true, 0, false},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateRequestedSeqNum(tc.requested, tc.backlog, tc.latest, tc.limitCatchup, tc.maxCatchup)
+			if tc.valid && err != nil {
+				Fail(t, "unexpected rejection:", err)
+			}
+			if !tc.valid && err == nil {
+				Fail(t, "requested sequence number", tc.requested, "was not rejected")
+			}
+		})
+	}
+}
+
+func TestJitterDelay(t *testing.T) {
+	delay := time.Second
+	fraction := 0.1
+
+	numClients := 100
+	delays := make([]float64, numClients)
+	var sum float64
+	for i := range delays {
+		jittered := jitterDelay(delay, fraction)
+		Expect(t, jittered >= delay, "jittered delay", jittered, "is below", delay)
+		Expect(t, float64(jittered) <= float64(delay)*(1+fraction), "jittered delay", jittered, "exceeds max jitter")
+		delays[i] = float64(jittered)
+		sum += delays[i]
+	}
+	mean := sum / float64(numClients)
+	var variance float64
+	for _, d := range delays {
+		variance += (d - mean) * (d - mean)
+	}
+	stdDev := math.Sqrt(variance / float64(numClients))
+	// uniform jitter over [0, fraction) has a standard deviation of about 0.29 * fraction * delay
+	minStdDev := float64(delay) * fraction * 0.2
+	Expect(t, stdDev >= minStdDev, "delays weren't spread out, standard deviation", time.Duration(stdDev))
+
+	Expect(t, jitterDelay(delay, 0) == delay, "delay changed with jitter disabled")
+	Expect(t, jitterDelay(0, fraction) == 0, "zero delay was jittered")
+}
+
+func TestOrderedShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+
+	clientCount := 4
+	closed := make(chan int, clientCount)
+	for i := 0; i < clientCount; i++ {
+		conn, _, _, err := ws.Dial(ctx, "ws://"+server.ListenerAddr().String())
+		Require(t, err)
+		defer func() { _ = conn.Close() }()
+		// make sure clients are registered, and so created, in dial order
+		for server.ClientCount() != int32(i+1) {
+			time.Sleep(time.Millisecond)
+		}
+		go func(i int) {
+			for {
+				frame, err := ws.ReadFrame(conn)
+				if err != nil {
+					return
+				}
+				if frame.Header.OpCode == ws.OpClose {
+					if code, _ := ws.ParseCloseFrameData(frame.Payload); code == closeStatusServiceRestart {
+						closed <- i
+					}
+					return
+				}
+			}
+		}(i)
+	}
+
+	server.clientManager.OrderedShutdown(1, 20*time.Millisecond)
+	Expect(t, server.ClientCount() == 0, "clients left connected after shutdown", server.ClientCount())
+	for i := 0; i < clientCount; i++ {
+		select {
+		case closedIdx := <-closed:
+			Expect(t, closedIdx == i, "client", closedIdx, "disconnected before client", i)
+		case <-time.After(5 * time.Second):
+			Fail(t, "client", i, "wasn't sent a restart close frame")
+		}
+	}
+}
+
+func TestRemoveByIP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	config.IPFilter.TrustedProxies = []string{"127.0.0.0/8"}
+	config.IPFilter.TrustXForwardedFor = true
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+
+	dial := func(forwardedFor string) net.Conn {
+		var dialer ws.Dialer
+		if forwardedFor != "" {
+			dialer.Header = ws.HandshakeHeaderHTTP(http.Header{HTTPHeaderXForwardedFor: []string{forwardedFor}})
+		}
+		conn, _, _, err := dialer.Dial(ctx, "ws://"+server.ListenerAddr().String())
+		Require(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	}
+	bannedCount := 5
+	banned := make([]net.Conn, bannedCount)
+	for i := range banned {
+		banned[i] = dial("1.2.3.4")
+	}
+	other := dial("")
+	for server.ClientCount() != int32(bannedCount+1) {
+		select {
+		case <-ctx.Done():
+			Fail(t, "only", server.ClientCount(), "of", bannedCount+1, "clients registered")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	removed := server.RemoveByIP(net.ParseIP("1.2.3.4"))
+	Expect(t, removed == bannedCount, "removed", removed, "clients instead of", bannedCount)
+	Expect(t, server.ClientCount() == 1, "client count", server.ClientCount(), "after removing by IP")
+	for i, conn := range banned {
+		Require(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		if _, _, err := wsutil.ReadServerData(conn); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			Fail(t, "client", i, "wasn't disconnected:", err)
+		}
+	}
+	Expect(t, server.RemoveByIP(net.ParseIP("1.2.3.4")) == 0, "clients removed twice")
+
+	// the remaining client must still receive broadcasts
+	server.Broadcast(&m.BroadcastMessage{
+		Version:  m.V1,
+		Messages: m.CreateDummyBroadcastMessages(dummySeqNums(0, 1)),
+	})
+	Require(t, readFeed(other, 1))
+}
+
+func TestClientQueueDepth(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	relayerIP := net.ParseIP("10.0.0.1")
+	relayerQueue := DefaultTestBroadcasterConfig.MaxSendQueue * 4
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	config.IPFilter.TrustedProxies = []string{"127.0.0.0/8"}
+	config.IPFilter.TrustXForwardedFor = true
+	config.ClientQueueDepth = func(ip net.IP) int {
+		if ip.Equal(relayerIP) {
+			return relayerQueue
+		}
+		return 0
+	}
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+
+	for _, forwardedFor := range []string{relayerIP.String(), "1.2.3.4"} {
+		dialer := ws.Dialer{
+			Header: ws.HandshakeHeaderHTTP(http.Header{HTTPHeaderXForwardedFor: []string{forwardedFor}}),
+		}
+		conn, _, _, err := dialer.Dial(ctx, "ws://"+server.ListenerAddr().String())
+		Require(t, err)
+		defer func() { _ = conn.Close() }()
+	}
+	for server.ClientCount() != 2 {
+		select {
+		case <-ctx.Done():
+			Fail(t, "only", server.ClientCount(), "of 2 clients registered")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	next := server.clientManager.Iterator()
+	for client, ok := next(); ok; client, ok = next() {
+		expected := config.MaxSendQueue
+		if client.clientIp.Equal(relayerIP) {
+			expected = relayerQueue
+		}
+		Expect(t, cap(client.out) == expected, "client", client.Name, "has send queue of", cap(client.out), "instead of", expected)
+	}
+}
+
+func TestClientManagerIterator(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+
+	stableCount := 5
+	for i := 0; i < stableCount; i++ {
+		conn, _, _, err := ws.Dial(ctx, "ws://"+server.ListenerAddr().String())
+		Require(t, err)
+		defer func() { _ = conn.Close() }()
+	}
+
+	// connect and disconnect other clients while iterating
+	churnCtx, stopChurn := context.WithCancel(ctx)
+	churnDone := make(chan struct{})
+	go func() {
+		defer close(churnDone)
+		for churnCtx.Err() == nil {
+			conn, _, _, err := ws.Dial(churnCtx, "ws://"+server.ListenerAddr().String())
+			if err != nil {
+				continue
+			}
+			time.Sleep(time.Millisecond)
+			_ = conn.Close()
+		}
+	}()
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		next := server.clientManager.Iterator()
+		for client, ok := next(); ok; client, ok = next() {
+			_ = client.Name
+			_ = client.Age()
+			_ = client.GetLastHeard()
+		}
+	}
+	stopChurn()
+	<-churnDone
+
+	for server.ClientCount() != int32(stableCount) {
+		select {
+		case <-ctx.Done():
+			Fail(t, "client count", server.ClientCount(), "didn't settle at", stableCount)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	count := 0
+	next := server.clientManager.Iterator()
+	for _, ok := next(); ok; _, ok = next() {
+		count++
+	}
+	Expect(t, count == stableCount, "iterated over", count, "clients instead of", stableCount)
+	if client, ok := next(); ok || client != nil {
+		Fail(t, "exhausted iterator returned another client")
+	}
+}
+
+func TestMaxQueueDepth(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+	Expect(t, server.clientManager.MaxQueueDepth() == 0, "max queue depth with no clients was", server.clientManager.MaxQueueDepth())
+
+	clientCount := 3
+	for i := 0; i < clientCount; i++ {
+		conn, _, _, err := ws.Dial(ctx, "ws://"+server.ListenerAddr().String())
+		Require(t, err)
+		defer func() { _ = conn.Close() }()
+	}
+	for server.ClientCount() != int32(clientCount) {
+		select {
+		case <-ctx.Done():
+			Fail(t, "only", server.ClientCount(), "of", clientCount, "clients registered")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	// stop each client's write thread so that its queue fills up, the i-th
+	// client holding i messages
+	depth := 0
+	next := server.clientManager.Iterator()
+	for client, ok := next(); ok; client, ok = next() {
+		client.StopAndWait()
+		for i := 0; i < depth; i++ {
+			client.out <- message{data: []byte("hello")}
+		}
+		depth++
+	}
+	maxDepth := server.clientManager.MaxQueueDepth()
+	Expect(t, maxDepth == clientCount-1, "max queue depth was", maxDepth, "instead of", clientCount-1)
+}
+
+func TestUnixSocketFeed(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	socketPath := filepath.Join(t.TempDir(), "feed.sock")
+	Require(t, server.ListenUnix(socketPath))
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+	Expect(t, server.ListenUnix(socketPath) != nil, "unix socket added after start")
+
+	dialer := ws.Dialer{
+		NetDial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	conn, _, _, err := dialer.Dial(ctx, "ws://localhost/")
+	Require(t, err)
+	defer func() { _ = conn.Close() }()
+	for server.ClientCount() != 1 {
+		select {
+		case <-ctx.Done():
+			Fail(t, "unix socket client wasn't registered")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	next := server.clientManager.Iterator()
+	client, _ := next()
+	Expect(t, strings.Contains(client.Name, "unix:"+socketPath), "unix socket client name", client.Name, "doesn't name the socket")
+
+	messageCount := 100
+	for i := 0; i < messageCount; i++ {
+		server.Broadcast(&m.BroadcastMessage{
+			Version:  m.V1,
+			Messages: m.CreateDummyBroadcastMessages(dummySeqNums(i, 1)),
+		})
+	}
+	Require(t, readFeed(conn, messageCount))
+}
+
+func TestFeedSubprotocolNegotiation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+
+	testcases := []struct {
+		name      string
+		protocols []string
+		expected  string
+	}{
+		{"none", nil, ""},
+		{"v1", []string{FeedSubprotocolV1}, FeedSubprotocolV1},
+		{"unknown preferred", []string{"arbitrum-feed-v2", FeedSubprotocolV1}, FeedSubprotocolV1},
+		{"only unknown", []string{"arbitrum-feed-v2"}, ""},
+	}
+	for i, tc := range testcases {
+		dialer := ws.Dialer{Protocols: tc.protocols}
+		conn, _, hs, err := dialer.Dial(ctx, "ws://"+server.ListenerAddr().String())
+		Require(t, err, tc.name)
+		defer func() { _ = conn.Close() }()
+		if hs.Protocol != tc.expected {
+			Fail(t, tc.name, "negotiated subprotocol", hs.Protocol, "instead of", tc.expected)
+		}
+		for server.ClientCount() != int32(i+1) {
+			time.Sleep(time.Millisecond)
+		}
+		// every client gets the v1 format whatever it negotiated, here the
+		// messages broadcast to earlier clients from the backlog followed by
+		// a new one
+		server.Broadcast(&m.BroadcastMessage{
+			Version:  m.V1,
+			Messages: m.CreateDummyBroadcastMessages(dummySeqNums(i, 1)),
+		})
+		Require(t, readFeed(conn, i+1), tc.name)
+	}
+}
+
+func TestHandshakeTimeoutClosesSlowUpgrade(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	config.HandshakeTimeout = 200 * time.Millisecond
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+
+	conn, err := net.Dial("tcp", server.ListenerAddr().String())
+	Require(t, err)
+	defer func() { _ = conn.Close() }()
+
+	// start the upgrade request but never finish it
+	start := time.Now()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n"))
+	Require(t, err)
+
+	Require(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.ReadAll(conn)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		Fail(t, "server didn't close the connection of an incomplete upgrade")
+	}
+	elapsed := time.Since(start)
+	Expect(t, elapsed >= config.HandshakeTimeout, "connection closed after", elapsed, "before the handshake timeout")
+}
+
+func TestPauseAndResumeBroadcasting(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+
+	conn, _, _, err := ws.Dial(ctx, "ws://"+server.ListenerAddr().String())
+	Require(t, err)
+	defer func() { _ = conn.Close() }()
+	for server.ClientCount() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	messageCount := 100
+	server.clientManager.Pause()
+	for i := 0; i < messageCount; i++ {
+		server.Broadcast(&m.BroadcastMessage{
+			Version:  m.V1,
+			Messages: m.CreateDummyBroadcastMessages(dummySeqNums(i, 1)),
+		})
+	}
+
+	// nothing is sent while paused
+	Require(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, _, err = wsutil.ReadServerData(conn)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		Fail(t, "client received data while broadcasting was paused", err)
+	}
+	Require(t, conn.SetReadDeadline(time.Time{}))
+	Expect(t, server.ClientCount() == 1, "client disconnected while broadcasting was paused")
+
+	server.clientManager.Resume()
+	Require(t, readFeed(conn, messageCount))
+}
+
+func TestPauseBufferFull(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	config.MaxPauseBuffer = 10
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+
+	conn, _, _, err := ws.Dial(ctx, "ws://"+server.ListenerAddr().String())
+	Require(t, err)
+	defer func() { _ = conn.Close() }()
+	for server.ClientCount() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// broadcasting more than the buffer holds mustn't block the sequencer
+	messageCount := config.MaxPauseBuffer * 3
+	server.clientManager.Pause()
+	broadcastDone := make(chan struct{})
+	go func() {
+		defer close(broadcastDone)
+		for i := 0; i < messageCount; i++ {
+			server.Broadcast(&m.BroadcastMessage{
+				Version:  m.V1,
+				Messages: m.CreateDummyBroadcastMessages(dummySeqNums(i, 1)),
+			})
+		}
+	}()
+	select {
+	case <-broadcastDone:
+	case <-ctx.Done():
+		Fail(t, "broadcast blocked once the pause buffer was full")
+	}
+
+	// the paused client is disconnected rather than sent the buffered messages
+	Require(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	if _, _, err := wsutil.ReadServerData(conn); err == nil {
+		Fail(t, "paused client received data once the pause buffer was full")
+	} else {
+		var closedErr wsutil.ClosedError
+		if !errors.As(err, &closedErr) || closedErr.Code != ws.StatusGoingAway {
+			Fail(t, "paused client wasn't disconnected once the pause buffer was full", err)
+		}
+	}
+
+	// broadcasting has resumed and a reconnecting client catches up on
+	// everything from the backlog
+	reconnected, _, _, err := ws.Dial(ctx, "ws://"+server.ListenerAddr().String())
+	Require(t, err)
+	defer func() { _ = reconnected.Close() }()
+	Require(t, readFeed(reconnected, messageCount))
+}
+
+func TestEvictSlowConsumers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	config := DefaultTestBroadcasterConfig
+	config.Addr = "127.0.0.1"
+	config.MaxSendQueue = 20
+	bklg := backlog.NewBacklog(func() *backlog.Config { return &config.Backlog })
+	server := NewWSBroadcastServer(func() *BroadcasterConfig { return &config }, bklg, 1, nil)
+	Require(t, server.Initialize())
+	Require(t, server.Start(ctx))
+	defer server.StopAndWait()
+
+	slowCount := 10
+	for i := 0; i < slowCount+1; i++ {
+		conn, _, _, err := ws.Dial(ctx, "ws://"+server.ListenerAddr().String())
+		Require(t, err)
+		defer func() { _ = conn.Close() }()
+	}
+	for server.ClientCount() != int32(slowCount+1) {
+		select {
+		case <-ctx.Done():
+			Fail(t, "only", server.ClientCount(), "of", slowCount+1, "clients registered")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	// stop the clients' write threads so their queues fill up, 95% full for
+	// the slow clients and half full for the other one
+	var healthy *ClientConnection
+	filled := 0
+	next := server.clientManager.Iterator()
+	for client, ok := next(); ok; client, ok = next() {
+		client.StopAndWait()
+		queued := cap(client.out) / 2
+		if filled < slowCount {
+			queued = cap(client.out) * 95 / 100
+			filled++
+		} else {
+			healthy = client
+		}
+		for i := 0; i < queued; i++ {
+			client.out <- message{}
+		}
+	}
+
+	evicted := server.EvictSlowConsumers(0.9)
+	Expect(t, evicted == slowCount, "evicted", evicted, "clients instead of", slowCount)
+	Expect(t, server.ClientCount() == 1, "client count", server.ClientCount(), "after evicting slow consumers")
+	next = server.clientManager.Iterator()
+	client, _ := next()
+	Expect(t, client == healthy, "wrong client left connected")
+	Expect(t, server.EvictSlowConsumers(0.9) == 0, "clients evicted twice")
+}